@@ -2,19 +2,40 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/virtual-kubelet/virtual-kubelet/node"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
 	"vk-provider-nersc/pkg/provider"
+	"vk-provider-nersc/pkg/superfacility"
 )
 
+// credentialReloadInterval is how often credential files are checked for
+// changes.
+const credentialReloadInterval = 30 * time.Second
+
 func main() {
 	endpoint := os.Getenv("SF_API_ENDPOINT")
 	token := os.Getenv("SF_API_TOKEN")
@@ -23,9 +44,84 @@ func main() {
 		nodeName = "perlmutter-vk"
 	}
 
-	prov, err := provider.NewNerscProvider(endpoint, token, nodeName)
+	var opts []provider.Option
+	if archiveDir := os.Getenv("VK_LOG_ARCHIVE_DIR"); archiveDir != "" {
+		opts = append(opts, provider.WithLogArchiveDir(archiveDir))
+	}
+
+	ctx := context.Background()
+
+	clientOpts, err := clientOptions()
 	if err != nil {
-		log.Fatalf("Failed to create provider: %v", err)
+		log.Fatalf("Invalid SF API client configuration: %v", err)
+	}
+	if addr := os.Getenv("VK_METRICS_ADDR"); addr != "" {
+		metrics, err := superfacility.NewMetrics(prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatalf("Failed to register SF API metrics: %v", err)
+		}
+		clientOpts = append(clientOpts, superfacility.WithHooks(metrics))
+		go serveMetrics(addr)
+	}
+	opts = append(opts, provider.WithClientOptions(clientOpts...))
+
+	// Authenticate with a Superfacility API client instead of a static token.
+	// Credentials read from files, such as a mounted Secret, are reloaded
+	// when they are rotated.
+	files := superfacility.CredentialFiles{
+		TokenFile:      os.Getenv("SF_API_TOKEN_FILE"),
+		ClientID:       os.Getenv("SF_API_CLIENT_ID"),
+		ClientIDFile:   os.Getenv("SF_API_CLIENT_ID_FILE"),
+		PrivateKeyFile: os.Getenv("SF_API_PRIVATE_KEY_FILE"),
+		TokenURL:       os.Getenv("SF_API_TOKEN_URL"),
+		HTTPClient:     superfacility.NewHTTPClient(clientOpts...),
+	}
+	if files.TokenFile != "" || files.PrivateKeyFile != "" {
+		auth, err := superfacility.NewFileAuthenticator(files)
+		if err != nil {
+			log.Fatalf("Failed to load SF API credentials: %v", err)
+		}
+		go auth.Watch(ctx, credentialReloadInterval)
+		opts = append(opts, provider.WithAuthenticator(auth))
+	} else if files.ClientID != "" {
+		auth, err := superfacility.NewClientCredentials(files.TokenURL, files.ClientID, []byte(os.Getenv("SF_API_PRIVATE_KEY")))
+		if err != nil {
+			log.Fatalf("Failed to configure SF API client credentials: %v", err)
+		}
+		auth.SetHTTPClient(files.HTTPClient)
+		opts = append(opts, provider.WithAuthenticator(auth))
+	}
+
+	if spec := os.Getenv("SF_API_RATE_LIMITS"); spec != "" {
+		limits, err := superfacility.ParseLimits(spec, superfacility.DefaultLimits)
+		if err != nil {
+			log.Fatalf("Invalid SF_API_RATE_LIMITS: %v", err)
+		}
+		opts = append(opts, provider.WithRequestLimits(limits))
+	}
+	if name := os.Getenv("SF_API_DIALECT"); name != "" {
+		dialect, err := superfacility.ParseDialect(name)
+		if err != nil {
+			log.Fatalf("Invalid SF_API_DIALECT: %v", err)
+		}
+		opts = append(opts, provider.WithAPIDialect(dialect))
+	}
+	if spec := os.Getenv("VK_CHARGE_FACTORS"); spec != "" {
+		factors, err := provider.ParseChargeFactors(spec, provider.DefaultChargeFactors)
+		if err != nil {
+			log.Fatalf("Invalid VK_CHARGE_FACTORS: %v", err)
+		}
+		opts = append(opts, provider.WithChargeFactors(factors))
+	}
+	if machine := os.Getenv("SF_API_MACHINE"); machine != "" {
+		opts = append(opts, provider.WithMachine(machine))
+	}
+	if name := os.Getenv("SF_API_TIME_ZONE"); name != "" {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			log.Fatalf("Invalid SF_API_TIME_ZONE: %v", err)
+		}
+		opts = append(opts, provider.WithSlurmLocation(loc))
 	}
 
 	// Create Kubernetes client
@@ -47,6 +143,56 @@ func main() {
 		log.Fatalf("Failed to create Kubernetes client: %v", err)
 	}
 
+	// Record pod events, such as probe failures, as the kubelet would
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	defer broadcaster.Shutdown()
+	opts = append(opts, provider.WithEventRecorder(broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{
+		Component: "vk-nersc",
+		Host:      nodeName,
+	})))
+
+	opts = append(opts, provider.WithPodAnnotator(podAnnotator{pods: clientset.CoreV1()}))
+
+	kubeletPort := int32(provider.DefaultKubeletPort)
+	if value := os.Getenv("VK_KUBELET_PORT"); value != "" {
+		port, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || port <= 0 || port > 65535 {
+			log.Fatalf("Invalid VK_KUBELET_PORT %q", value)
+		}
+		kubeletPort = int32(port)
+	}
+	opts = append(opts, provider.WithKubeletEndpoint(os.Getenv("VK_POD_IP"), kubeletPort))
+
+	prov, err := provider.NewNerscProvider(endpoint, token, nodeName, opts...)
+	if err != nil {
+		log.Fatalf("Failed to create provider: %v", err)
+	}
+
+	// Serve the kubelet API that the API server calls for kubectl logs and
+	// exec, and metrics-server scrapes for kubectl top.
+	if certFile, keyFile := os.Getenv("VK_KUBELET_CERT_FILE"), os.Getenv("VK_KUBELET_KEY_FILE"); certFile != "" || keyFile != "" {
+		server, err := kubeletServer(fmt.Sprintf(":%d", kubeletPort), os.Getenv("VK_KUBELET_CLIENT_CA_FILE"), api.PodHandlerConfig{
+			RunInContainer:        prov.RunInContainer,
+			GetContainerLogs:      containerLogs(prov),
+			GetPods:               prov.GetPods,
+			GetPodsFromKubernetes: nodePods(clientset.CoreV1(), nodeName),
+			GetStatsSummary:       prov.GetStatsSummary,
+			GetMetricsResource:    prov.GetMetricsResource,
+		})
+		if err != nil {
+			log.Fatalf("Invalid kubelet API configuration: %v", err)
+		}
+		go func() {
+			log.Printf("Serving the kubelet API on %s", server.Addr)
+			if err := server.ListenAndServeTLS(certFile, keyFile); err != nil {
+				log.Fatalf("Kubelet API server exited: %v", err)
+			}
+		}()
+	} else {
+		log.Printf("VK_KUBELET_CERT_FILE and VK_KUBELET_KEY_FILE are not set, so kubectl logs, exec and top are unavailable")
+	}
+
 	// Create the virtual node
 	virtualNode := &corev1.Node{
 		ObjectMeta: metav1.ObjectMeta{
@@ -70,8 +216,6 @@ func main() {
 		},
 	}
 
-	ctx := context.Background()
-
 	// Create and run the virtual kubelet node controller
 	nodeController, err := node.NewNodeController(
 		prov,
@@ -87,3 +231,142 @@ func main() {
 		log.Fatalf("VK exited: %v", err)
 	}
 }
+
+// podAnnotator sets pod annotations with a merge patch.
+type podAnnotator struct {
+	pods typedcorev1.PodsGetter
+}
+
+func (a podAnnotator) AnnotatePod(ctx context.Context, namespace, name string, annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.pods.Pods(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// kubeletServer returns a server for the kubelet API routes in config at
+// addr. If clientCAFile is set, clients must present a certificate it
+// signed, such as the API server's kubelet client certificate.
+func kubeletServer(addr, clientCAFile string, config api.PodHandlerConfig) (*http.Server, error) {
+	mux := http.NewServeMux()
+	api.AttachPodRoutes(config, mux, false)
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		data, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("client CA %s has no PEM certificates", clientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 30 * time.Second,
+	}, nil
+}
+
+// containerLogs adapts the provider's GetContainerLogs to the kubelet API's
+// log options.
+func containerLogs(prov *provider.NerscProvider) api.ContainerLogsHandlerFunc {
+	return func(ctx context.Context, namespace, name, container string, opts api.ContainerLogOpts) (io.ReadCloser, error) {
+		logOpts := &corev1.PodLogOptions{
+			Container:  container,
+			Follow:     opts.Follow,
+			Previous:   opts.Previous,
+			Timestamps: opts.Timestamps,
+		}
+		if opts.Tail > 0 {
+			tail := int64(opts.Tail)
+			logOpts.TailLines = &tail
+		}
+		if opts.LimitBytes > 0 {
+			limit := int64(opts.LimitBytes)
+			logOpts.LimitBytes = &limit
+		}
+		if opts.SinceSeconds > 0 {
+			since := int64(opts.SinceSeconds)
+			logOpts.SinceSeconds = &since
+		} else if !opts.SinceTime.IsZero() {
+			since := metav1.NewTime(opts.SinceTime)
+			logOpts.SinceTime = &since
+		}
+		return prov.GetContainerLogs(ctx, namespace, name, container, logOpts)
+	}
+}
+
+// nodePods lists the pods scheduled to the node.
+func nodePods(pods typedcorev1.PodsGetter, nodeName string) api.PodListerFunc {
+	return func(ctx context.Context) ([]*corev1.Pod, error) {
+		list, err := pods.Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + nodeName})
+		if err != nil {
+			return nil, err
+		}
+		out := make([]*corev1.Pod, 0, len(list.Items))
+		for i := range list.Items {
+			out = append(out, &list.Items[i])
+		}
+		return out, nil
+	}
+}
+
+// clientOptions configures the Superfacility API client's transport from
+// the environment, such as for an egress proxy with a private CA.
+func clientOptions() ([]superfacility.ClientOption, error) {
+	var opts []superfacility.ClientOption
+	if path := os.Getenv("SF_API_CA_BUNDLE"); path != "" {
+		pool, err := superfacility.LoadCABundle(path)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, superfacility.WithRootCAs(pool))
+	}
+	certFile, keyFile := os.Getenv("SF_API_CLIENT_CERT"), os.Getenv("SF_API_CLIENT_KEY")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		opts = append(opts, superfacility.WithClientCertificate(cert))
+	}
+	if proxy := os.Getenv("SF_API_PROXY"); proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SF_API_PROXY: %w", err)
+		}
+		opts = append(opts, superfacility.WithProxy(proxyURL))
+	}
+	if spec := os.Getenv("SF_API_TIMEOUTS"); spec != "" {
+		timeouts, err := superfacility.ParseTimeouts(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SF_API_TIMEOUTS: %w", err)
+		}
+		opts = append(opts, timeouts...)
+	}
+	if userAgent := os.Getenv("SF_API_USER_AGENT"); userAgent != "" {
+		opts = append(opts, superfacility.WithUserAgent(userAgent))
+	}
+	if debug, _ := strconv.ParseBool(os.Getenv("SF_API_DEBUG")); debug {
+		opts = append(opts, superfacility.WithHooks(superfacility.DebugLogger(nil)))
+	}
+	return opts, nil
+}
+
+// serveMetrics serves Prometheus metrics on /metrics at addr.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Printf("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Metrics server exited: %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"vk-provider-nersc/pkg/scripts"
+)
+
+const (
+	accountingTimeout = 5 * time.Minute
+
+	annotationElapsed       = "nersc.sf/elapsed"
+	annotationCPUEfficiency = "nersc.sf/cpuEfficiency"
+	annotationMaxRSS        = "nersc.sf/maxRSS"
+	annotationNodeHours     = "nersc.sf/nodeHours"
+	annotationNERSCHours    = "nersc.sf/estimatedNERSCHours"
+	annotationChargeAccount = "nersc.sf/chargeAccount"
+
+	// Perlmutter nodes have 256 CPUs on CPU nodes and 128 on GPU nodes, as
+	// Slurm counts them. Shared jobs are charged for their share of a node.
+	cpusPerCPUNode = 256
+	cpusPerGPUNode = 128
+)
+
+// ChargeFactors multiply the node hours of a job into the NERSC hours
+// charged to its project, by QOS and separately for CPU and GPU nodes. A
+// QOS without a factor is charged at 1.
+type ChargeFactors struct {
+	CPU map[string]float64
+	GPU map[string]float64
+}
+
+// DefaultChargeFactors are the QOS charge factors used unless
+// WithChargeFactors sets others. NERSC revises them each allocation year.
+var DefaultChargeFactors = ChargeFactors{
+	CPU: map[string]float64{"premium": 2, "preempt": 0.5, "overrun": 0},
+	GPU: map[string]float64{"premium": 2, "preempt": 0.5, "overrun": 0},
+}
+
+// ParseChargeFactors parses charge factors such as
+// "premium=2,gpu:preempt=0.25". A QOS prefixed with cpu: or gpu: sets the
+// factor of that kind of node only, and an unprefixed one sets both. QOS
+// that are not mentioned keep their factors in base.
+func ParseChargeFactors(spec string, base ChargeFactors) (ChargeFactors, error) {
+	factors := ChargeFactors{
+		CPU: make(map[string]float64, len(base.CPU)),
+		GPU: make(map[string]float64, len(base.GPU)),
+	}
+	for qos, factor := range base.CPU {
+		factors.CPU[qos] = factor
+	}
+	for qos, factor := range base.GPU {
+		factors.GPU[qos] = factor
+	}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return ChargeFactors{}, fmt.Errorf("invalid charge factor %q: want [cpu:|gpu:]qos=factor", item)
+		}
+		factor, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || factor < 0 {
+			return ChargeFactors{}, fmt.Errorf("invalid factor in charge factor %q", item)
+		}
+		targets := []map[string]float64{factors.CPU, factors.GPU}
+		if node, qos, ok := strings.Cut(name, ":"); ok {
+			switch strings.TrimSpace(node) {
+			case "cpu":
+				targets = targets[:1]
+			case "gpu":
+				targets = targets[1:]
+			default:
+				return ChargeFactors{}, fmt.Errorf("unknown node type %q in charge factor %q", node, item)
+			}
+			name = qos
+		}
+		qos := strings.TrimSpace(name)
+		if qos == "" {
+			return ChargeFactors{}, fmt.Errorf("invalid charge factor %q: want [cpu:|gpu:]qos=factor", item)
+		}
+		for _, target := range targets {
+			target[qos] = factor
+		}
+	}
+	return factors, nil
+}
+
+// PodAnnotator sets annotations on pods in the API server.
+type PodAnnotator interface {
+	AnnotatePod(ctx context.Context, namespace, name string, annotations map[string]string) error
+}
+
+// jobAccounting is what sacct reports about a finished job.
+type jobAccounting struct {
+	state     string
+	account   string
+	qos       string
+	elapsed   time.Duration
+	cpuTime   time.Duration
+	allocCPUs int64
+	nodes     int64
+	maxRSS    uint64
+	gpu       bool
+}
+
+// cpuEfficiency is the share of the allocated CPU time the job used, in
+// percent.
+func (a jobAccounting) cpuEfficiency() float64 {
+	available := a.elapsed.Seconds() * float64(a.allocCPUs)
+	if available <= 0 {
+		return 0
+	}
+	return 100 * a.cpuTime.Seconds() / available
+}
+
+// nodeHours is the node time allocated to the job. Shared jobs count their
+// share of a single node.
+func (a jobAccounting) nodeHours() float64 {
+	nodes := float64(a.nodes)
+	if a.qos == "shared" {
+		cpusPerNode := cpusPerCPUNode
+		if a.gpu {
+			cpusPerNode = cpusPerGPUNode
+		}
+		nodes = math.Min(float64(a.allocCPUs)/float64(cpusPerNode), 1)
+	}
+	return nodes * a.elapsed.Hours()
+}
+
+// nerscHours estimates the node hours charged to the project after the
+// QOS charge factor.
+func (a jobAccounting) nerscHours(factors ChargeFactors) float64 {
+	qosFactors := factors.CPU
+	if a.gpu {
+		qosFactors = factors.GPU
+	}
+	factor, ok := qosFactors[a.qos]
+	if !ok {
+		factor = 1
+	}
+	return a.nodeHours() * factor
+}
+
+func (a jobAccounting) annotations(factors ChargeFactors) map[string]string {
+	return map[string]string{
+		annotationElapsed:       a.elapsed.String(),
+		annotationCPUEfficiency: fmt.Sprintf("%.1f%%", a.cpuEfficiency()),
+		annotationMaxRSS:        resource.NewQuantity(int64(a.maxRSS), resource.BinarySI).String(),
+		annotationNodeHours:     strconv.FormatFloat(a.nodeHours(), 'f', 4, 64),
+		annotationNERSCHours:    strconv.FormatFloat(a.nerscHours(factors), 'f', 4, 64),
+		annotationChargeAccount: a.account,
+	}
+}
+
+// chargeFactors returns the QOS charge factors of NERSC hour estimates.
+func (p *NerscProvider) chargeFactors() ChargeFactors {
+	if p.qosChargeFactors != nil {
+		return *p.qosChargeFactors
+	}
+	return DefaultChargeFactors
+}
+
+// startAccountingReport records the job's accounting on the pod in the
+// background once its job has finished, as annotations and an event. A
+// report that failed, or that sacct could not give yet, is retried on the
+// next status poll.
+func (p *NerscProvider) startAccountingReport(key, jobID string) {
+	if p.podAnnotator == nil && p.eventRecorder == nil {
+		return
+	}
+
+	p.mu.Lock()
+	state := p.jobStateMap[key]
+	if state == nil || state.accountingReported || state.accountingReporting {
+		p.mu.Unlock()
+		return
+	}
+	state.accountingReporting = true
+	p.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), accountingTimeout)
+		defer cancel()
+
+		err := p.reportAccounting(ctx, key, jobID, state)
+
+		p.mu.Lock()
+		state.accountingReporting = false
+		state.accountingReported = err == nil
+		p.mu.Unlock()
+		if err != nil {
+			log.Printf("Failed to report accounting for pod %s job %s: %v", key, jobID, err)
+		}
+	}()
+}
+
+func (p *NerscProvider) reportAccounting(ctx context.Context, key, jobID string, state *podJobState) error {
+	result, err := p.sfClient.RunCommandAndWait(ctx, p.machine(), scripts.AccountingCommand(jobID))
+	if err != nil {
+		return err
+	}
+	accounting, err := parseSacct(result.Output, jobID)
+	if err != nil {
+		return err
+	}
+	if !sacctStateFinal(accounting.state) {
+		return fmt.Errorf("sacct reports job state %s", accounting.state)
+	}
+
+	factors := p.chargeFactors()
+	if p.podAnnotator != nil {
+		if err := p.podAnnotator.AnnotatePod(ctx, state.podRef.Namespace, state.podRef.Name, accounting.annotations(factors)); err != nil {
+			return fmt.Errorf("annotate pod: %w", err)
+		}
+	}
+	if p.eventRecorder != nil {
+		p.eventRecorder.Eventf(&state.podRef, corev1.EventTypeNormal, "JobAccounting",
+			"Slurm job %s ran for %s on %d node(s) with %.1f%% CPU efficiency and %s max RSS, charging an estimated %.4f NERSC hours to %s",
+			jobID, accounting.elapsed, accounting.nodes, accounting.cpuEfficiency(),
+			resource.NewQuantity(int64(accounting.maxRSS), resource.BinarySI), accounting.nerscHours(factors), accounting.account)
+	}
+	log.Printf("Reported accounting for pod %s job %s", key, jobID)
+	return nil
+}
+
+// parseSacct parses the output of an AccountingCommand. The job's own line
+// gives its allocation and the steps give its peak memory.
+func parseSacct(output, jobID string) (jobAccounting, error) {
+	index := make(map[string]int, len(scripts.AccountingFields))
+	for i, name := range scripts.AccountingFields {
+		index[name] = i
+	}
+
+	var accounting jobAccounting
+	found := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), "|")
+		if len(fields) != len(scripts.AccountingFields) {
+			continue
+		}
+		field := func(name string) string { return fields[index[name]] }
+
+		if rss := parseSlurmSize(field("MaxRSS")); rss > accounting.maxRSS {
+			accounting.maxRSS = rss
+		}
+		if field("JobID") != jobID {
+			continue
+		}
+		found = true
+		// sacct appends who cancelled a job, as in "CANCELLED by 1234".
+		accounting.state, _, _ = strings.Cut(field("State"), " ")
+		accounting.account = field("Account")
+		accounting.qos = field("QOS")
+		elapsed, err := strconv.ParseInt(field("ElapsedRaw"), 10, 64)
+		if err != nil {
+			return jobAccounting{}, fmt.Errorf("invalid sacct elapsed time %q", field("ElapsedRaw"))
+		}
+		accounting.elapsed = time.Duration(elapsed) * time.Second
+		if accounting.cpuTime, err = parseSlurmDuration(field("TotalCPU")); err != nil {
+			return jobAccounting{}, fmt.Errorf("invalid sacct CPU time: %w", err)
+		}
+		accounting.allocCPUs, _ = strconv.ParseInt(field("AllocCPUS"), 10, 64)
+		accounting.nodes, _ = strconv.ParseInt(field("NNodes"), 10, 64)
+		_, accounting.gpu = parseTRES(field("AllocTRES"))["gres/gpu"]
+	}
+	if !found {
+		return jobAccounting{}, fmt.Errorf("sacct has no record of job %s", jobID)
+	}
+	return accounting, nil
+}
+
+// sacctStateFinal reports whether sacct has the final accounting of a job in
+// state.
+func sacctStateFinal(state string) bool {
+	switch state {
+	case "PENDING", "RUNNING", "COMPLETING", "REQUEUED", "RESIZING", "SUSPENDED", "STOPPED":
+		return false
+	}
+	return state != ""
+}
@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"context"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"vk-provider-nersc/pkg/superfacility"
+)
+
+// nodeConditionSFAPIUnauthorized is true while the Superfacility API rejects
+// the provider's credentials. Expired credentials affect every pod on the
+// node, so they are reported on the node rather than failing pods.
+const nodeConditionSFAPIUnauthorized corev1.NodeConditionType = "SFAPIUnauthorized"
+
+// cancelJob cancels a Slurm job. A job the API no longer knows has already
+// ended, so its cancellation succeeds.
+func (p *NerscProvider) cancelJob(ctx context.Context, jobID string) error {
+	err := p.sfClient.CancelJob(ctx, jobID)
+	p.noteAPIResult(err)
+	if superfacility.IsNotFound(err) {
+		log.Printf("Job %s was not found while cancelling it, treating it as already ended", jobID)
+		return nil
+	}
+	return err
+}
+
+// noteAPIResult tracks whether the Superfacility API accepts the provider's
+// credentials, from the result of a request. Errors other than a 401 say
+// nothing about the credentials.
+func (p *NerscProvider) noteAPIResult(err error) {
+	unauthorized := superfacility.IsUnauthorized(err)
+	if err != nil && !unauthorized {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !unauthorized {
+		if p.apiAuthErr != nil {
+			p.apiAuthErr = nil
+			p.apiAuthChanged = time.Now()
+		}
+		return
+	}
+	if p.apiAuthErr == nil {
+		p.apiAuthChanged = time.Now()
+		log.Printf("The Superfacility API rejected the provider's credentials: %v", err)
+	}
+	p.apiAuthErr = err
+}
+
+// apiAuthCondition reports whether the Superfacility API rejects the
+// provider's credentials.
+func (p *NerscProvider) apiAuthCondition() corev1.NodeCondition {
+	p.mu.RLock()
+	authErr, changed := p.apiAuthErr, p.apiAuthChanged
+	p.mu.RUnlock()
+	if changed.IsZero() {
+		changed = p.startTime
+	}
+
+	condition := corev1.NodeCondition{
+		Type:               nodeConditionSFAPIUnauthorized,
+		Status:             corev1.ConditionFalse,
+		LastHeartbeatTime:  metav1.NewTime(time.Now()),
+		LastTransitionTime: metav1.NewTime(changed),
+		Reason:             "CredentialsAccepted",
+		Message:            "The Superfacility API accepts the provider's credentials",
+	}
+	if authErr != nil {
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "CredentialsRejected"
+		condition.Message = "The Superfacility API rejected the provider's credentials: " + authErr.Error()
+	}
+	return condition
+}
+
+// transientAPIError reports whether err is expected to clear up on its own,
+// so that the operation should be retried later rather than failing a pod.
+func transientAPIError(err error) bool {
+	return superfacility.IsUnauthorized(err) || superfacility.IsRateLimited(err) || superfacility.IsUnavailable(err)
+}
@@ -0,0 +1,198 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"vk-provider-nersc/pkg/scripts"
+	"vk-provider-nersc/pkg/superfacility"
+)
+
+const (
+	logArchiveTimeout     = 30 * time.Minute
+	maxArchivedLogBytes   = 64 << 20
+	maxLogArchiveAttempts = 5
+	logArchiveRetryDelay  = time.Minute
+)
+
+func (p *NerscProvider) archiveDirForPodKey(key string) string {
+	if p.logArchiveDir == "" {
+		return ""
+	}
+	return filepath.Join(p.logArchiveDir, filepath.FromSlash(key))
+}
+
+// startLogArchive archives the pod's container logs in the background once
+// its job has finished. An archive that failed for a transient error is
+// retried on a later status poll, after a back-off, up to
+// maxLogArchiveAttempts times.
+func (p *NerscProvider) startLogArchive(key, jobID string) {
+	archiveDir := p.archiveDirForPodKey(key)
+	if archiveDir == "" {
+		return
+	}
+
+	p.mu.Lock()
+	state := p.jobStateMap[key]
+	if state == nil || state.logsArchived || state.logsArchiving || state.logsArchiveAbandoned || time.Now().Before(state.logsArchiveRetryAt) {
+		p.mu.Unlock()
+		return
+	}
+	state.logsArchiving = true
+	p.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), logArchiveTimeout)
+		defer cancel()
+
+		err := p.archiveLogs(ctx, jobID, state, archiveDir)
+
+		p.mu.Lock()
+		state.logsArchiving = false
+		state.logsArchived = err == nil
+		var retryDelay time.Duration
+		if err != nil {
+			state.logsArchiveAttempts++
+			if permanentArchiveError(err) || state.logsArchiveAttempts >= maxLogArchiveAttempts {
+				state.logsArchiveAbandoned = true
+			} else {
+				retryDelay = logArchiveRetryDelay << (state.logsArchiveAttempts - 1)
+				state.logsArchiveRetryAt = time.Now().Add(retryDelay)
+			}
+		}
+		deleted := p.jobStateMap[key] != state
+		p.mu.Unlock()
+
+		if deleted {
+			// The pod was deleted while its logs were being copied.
+			p.removeLogArchive(key)
+			return
+		}
+		if err != nil && retryDelay > 0 {
+			log.Printf("Failed to archive logs for pod %s job %s, retrying in %s: %v", key, jobID, retryDelay, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Giving up archiving logs for pod %s job %s: %v", key, jobID, err)
+			return
+		}
+		log.Printf("Archived logs for pod %s job %s to %s", key, jobID, archiveDir)
+	}()
+}
+
+// permanentArchiveError reports whether archiving failed in a way that
+// retrying cannot fix, such as for logs that were already purged.
+func permanentArchiveError(err error) bool {
+	return superfacility.IsNotFound(err) || errors.Is(err, superfacility.ErrFileTooLarge)
+}
+
+func (p *NerscProvider) archiveLogs(ctx context.Context, jobID string, state *podJobState, archiveDir string) error {
+	if err := os.MkdirAll(archiveDir, 0o755); err != nil {
+		return fmt.Errorf("create log archive directory: %w", err)
+	}
+	for _, container := range state.allContainers() {
+		for _, name := range []string{scripts.ContainerStdoutFile(container), scripts.ContainerStderrFile(container)} {
+			if err := p.archiveLogFile(ctx, jobID, state.containerFile(name), filepath.Join(archiveDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveLogFile copies at most maxArchivedLogBytes from the end of a job log
+// file to dst, writing through a temporary file so readers never see a
+// partial archive.
+func (p *NerscProvider) archiveLogFile(ctx context.Context, jobID, src, dst string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".archive-*")
+	if err != nil {
+		return fmt.Errorf("create log archive file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var offset int64
+	sized := false
+	for {
+		chunk, err := p.sfClient.FetchJobLogRange(ctx, jobID, src, offset, logChunkSize)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", src, err)
+		}
+		if !sized {
+			sized = true
+			if chunk.Size > maxArchivedLogBytes {
+				offset = chunk.Size - maxArchivedLogBytes
+				continue
+			}
+		}
+		if _, err := tmp.Write(chunk.Data); err != nil {
+			return fmt.Errorf("write log archive %s: %w", dst, err)
+		}
+		offset = chunk.Offset + int64(len(chunk.Data))
+		if int64(len(chunk.Data)) < logChunkSize {
+			break
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close log archive %s: %w", dst, err)
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("rename log archive %s: %w", dst, err)
+	}
+	return nil
+}
+
+func (p *NerscProvider) removeLogArchive(key string) {
+	archiveDir := p.archiveDirForPodKey(key)
+	if archiveDir == "" {
+		return
+	}
+	if err := os.RemoveAll(archiveDir); err != nil {
+		log.Printf("Failed to remove log archive for pod %s: %v", key, err)
+	}
+}
+
+// readArchivedLogRange serves range reads from an archived log file with the
+// same semantics as superfacility.Client.FetchJobLogRange.
+func readArchivedLogRange(path string, offset, length int64) (superfacility.LogChunk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return superfacility.LogChunk{}, nil
+		}
+		return superfacility.LogChunk{}, fmt.Errorf("open archived log: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return superfacility.LogChunk{}, fmt.Errorf("stat archived log: %w", err)
+	}
+	size := info.Size()
+	start := offset
+	if start < 0 {
+		start = size + offset
+		if start < 0 {
+			start = 0
+		}
+	} else if start > size {
+		start = size
+	}
+	end := size
+	if offset >= 0 && length > 0 && start+length < size {
+		end = start + length
+	}
+
+	data := make([]byte, end-start)
+	if _, err := f.ReadAt(data, start); err != nil && err != io.EOF {
+		return superfacility.LogChunk{}, fmt.Errorf("read archived log: %w", err)
+	}
+	return superfacility.LogChunk{Data: data, Offset: start, Size: size}, nil
+}
@@ -0,0 +1,46 @@
+package provider
+
+import (
+	"context"
+	"strings"
+
+	"vk-provider-nersc/pkg/scripts"
+)
+
+// deadlineExceeded reports whether the job ended because it reached its
+// Slurm time limit. Slurm reports a timeout when the job is killed at the
+// limit, but the job script usually exits earlier: Slurm signals it
+// terminationGracePeriodSeconds before the limit and it stops the containers.
+// The script marks a SIGTERM that arrives that close to the limit in the job
+// directory, and the mark is read once after the job has finished.
+func (p *NerscProvider) deadlineExceeded(ctx context.Context, key, jobID, jobStatus string) bool {
+	switch strings.ToLower(jobStatus) {
+	case "timeout":
+		return true
+	case "completed", "success", "failed", "error":
+	default:
+		return false
+	}
+
+	state := p.jobStateForPodKey(key)
+	if state == nil {
+		return false
+	}
+	p.mu.RLock()
+	read, hit := state.deadlineRead, state.deadlineHit
+	p.mu.RUnlock()
+	if read {
+		return hit
+	}
+
+	// Reading the marker fails when it does not exist, which is the usual
+	// case for a job that did not reach its time limit.
+	chunk, err := p.sfClient.FetchJobLogRange(ctx, jobID, state.containerFile(scripts.DeadlineFile), 0, 1)
+	hit = err == nil && len(chunk.Data) > 0
+
+	p.mu.Lock()
+	state.deadlineRead = true
+	state.deadlineHit = hit
+	p.mu.Unlock()
+	return hit
+}
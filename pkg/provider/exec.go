@@ -0,0 +1,78 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	corev1 "k8s.io/api/core/v1"
+	utilexec "k8s.io/utils/exec"
+
+	"vk-provider-nersc/pkg/scripts"
+)
+
+// RunInContainer runs cmd in a running container through the Superfacility
+// API's command facility, which runs it from a login node in a job step that
+// overlaps the pod's job. The API reports a command's output only once it
+// has finished, so output is written to attach at the end. A non-zero exit
+// code is returned as a utilexec.CodeExitError so kubectl exec reports it.
+// Stdin and TTYs are not supported.
+func (p *NerscProvider) RunInContainer(ctx context.Context, namespace, name, container string, cmd []string, attach api.AttachIO) error {
+	key := namespace + "/" + name
+	if len(cmd) == 0 {
+		return fmt.Errorf("a command is required to exec in pod %s", key)
+	}
+	if attach.TTY() {
+		return fmt.Errorf("exec with a TTY is not supported for HPC jobs")
+	}
+	if attach.Stdin() != nil {
+		return fmt.Errorf("exec with stdin is not supported for HPC jobs")
+	}
+
+	jobID, ok := p.jobIDForPodKey(key)
+	state := p.jobStateForPodKey(key)
+	if !ok || state == nil {
+		return fmt.Errorf("pod %s not found", key)
+	}
+	containerName, err := state.resolveContainer(key, container)
+	if err != nil {
+		return err
+	}
+	status, err := p.sfClient.GetJobStatus(ctx, jobID)
+	if err != nil {
+		return fmt.Errorf("get status of job %s for pod %s: %w", jobID, key, err)
+	}
+	if phase := mapJobStatusToPodPhase(status); phase != corev1.PodRunning {
+		return fmt.Errorf("container %s of pod %s is not running: job %s is %s", containerName, key, jobID, status)
+	}
+
+	log.Printf("Running exec in container %s of pod %s job %s", containerName, key, jobID)
+	result, err := p.sfClient.RunCommandAndWait(ctx, p.machine(), scripts.ExecCommand(jobID, containerName, cmd))
+	if err != nil {
+		return fmt.Errorf("exec in container %s of pod %s: %w", containerName, key, err)
+	}
+	output, exitCode, ok := scripts.ParseExecOutput(result.Output)
+	writeExecOutput(attach.Stdout(), output)
+	writeExecOutput(attach.Stderr(), result.Error)
+	if !ok {
+		return fmt.Errorf("exec in container %s of pod %s did not report an exit code", containerName, key)
+	}
+	if exitCode != 0 {
+		return utilexec.CodeExitError{
+			Err:  fmt.Errorf("command terminated with exit code %d", exitCode),
+			Code: exitCode,
+		}
+	}
+	return nil
+}
+
+func writeExecOutput(w io.Writer, output string) {
+	if w == nil || output == "" {
+		return
+	}
+	if _, err := io.WriteString(w, output); err != nil {
+		log.Printf("Failed to write exec output: %v", err)
+	}
+}
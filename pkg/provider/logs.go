@@ -0,0 +1,343 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"vk-provider-nersc/pkg/scripts"
+	"vk-provider-nersc/pkg/superfacility"
+)
+
+const (
+	defaultLogPollInterval = 2 * time.Second
+	logChunkSize           = 1 << 20
+	logTailChunkSize       = 64 << 10
+)
+
+var errLogLimitReached = errors.New("log limit reached")
+
+// logLine is one line of container output with the timestamp prefix written
+// by the job script split off.
+type logLine struct {
+	timestamp time.Time
+	text      []byte
+}
+
+func (l logLine) render(timestamps bool) []byte {
+	if !timestamps || l.timestamp.IsZero() {
+		return l.text
+	}
+	out := make([]byte, 0, len(l.text)+len(time.RFC3339Nano)+1)
+	out = l.timestamp.AppendFormat(out, time.RFC3339Nano)
+	out = append(out, ' ')
+	return append(out, l.text...)
+}
+
+// logSource tracks how far a log file has been read. Lines written without a
+// timestamp inherit the previous line's timestamp.
+type logSource struct {
+	path    string
+	offset  int64
+	eof     bool
+	pending []byte
+	lastTS  time.Time
+}
+
+func (s *logSource) split(data []byte, final bool) []logLine {
+	if len(s.pending) > 0 {
+		data = append(s.pending, data...)
+		s.pending = nil
+	}
+
+	var lines []logLine
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			if !final {
+				s.pending = append([]byte(nil), data...)
+				break
+			}
+			end = len(data)
+		}
+		lines = append(lines, s.parse(data[:end]))
+		data = data[end:]
+	}
+	return lines
+}
+
+func (s *logSource) parse(raw []byte) logLine {
+	if prefix, rest, ok := bytes.Cut(raw, []byte{' '}); ok {
+		if ts, err := time.Parse(time.RFC3339Nano, string(prefix)); err == nil {
+			s.lastTS = ts
+			return logLine{timestamp: ts, text: rest}
+		}
+	}
+	return logLine{timestamp: s.lastTS, text: raw}
+}
+
+// logWriter applies the since, timestamps and limitBytes options to lines
+// as they are written.
+type logWriter struct {
+	w          io.Writer
+	timestamps bool
+	since      time.Time
+	remaining  int64
+}
+
+func newLogWriter(w io.Writer, opts *corev1.PodLogOptions) *logWriter {
+	lw := &logWriter{w: w, timestamps: opts.Timestamps, remaining: -1}
+	if opts.SinceSeconds != nil {
+		lw.since = time.Now().Add(-time.Duration(*opts.SinceSeconds) * time.Second)
+	} else if opts.SinceTime != nil {
+		lw.since = opts.SinceTime.Time
+	}
+	if opts.LimitBytes != nil {
+		lw.remaining = *opts.LimitBytes
+	}
+	return lw
+}
+
+func (lw *logWriter) write(lines []logLine) error {
+	for _, line := range lines {
+		if !lw.since.IsZero() && line.timestamp.Before(lw.since) {
+			continue
+		}
+		data := line.render(lw.timestamps)
+		if lw.remaining >= 0 {
+			if int64(len(data)) >= lw.remaining {
+				if _, err := lw.w.Write(data[:lw.remaining]); err != nil {
+					return err
+				}
+				return errLogLimitReached
+			}
+			lw.remaining -= int64(len(data))
+		}
+		if _, err := lw.w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *NerscProvider) GetContainerLogs(ctx context.Context, namespace, name, container string, opts *corev1.PodLogOptions) (io.ReadCloser, error) {
+	key := fmt.Sprintf("%s/%s", namespace, name)
+	jobID, exists := p.jobIDForPodKey(key)
+	if !exists {
+		return nil, fmt.Errorf("pod %s not found", key)
+	}
+
+	state := p.jobStateForPodKey(key)
+	if state == nil {
+		logs, err := p.sfClient.FetchJobLogs(ctx, jobID)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(strings.NewReader(logs)), nil
+	}
+
+	container, err := state.resolveContainer(key, container)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &corev1.PodLogOptions{}
+	}
+	paths := []string{
+		state.containerFile(scripts.ContainerStdoutFile(container)),
+		state.containerFile(scripts.ContainerStderrFile(container)),
+	}
+
+	read, err := p.logReaderForPod(ctx, key, jobID, state, paths[0])
+	if err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		err := p.streamLogs(ctx, writer, jobID, read, paths, opts)
+		if errors.Is(err, errLogLimitReached) {
+			err = nil
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+// logRangeFunc reads a byte range from a log file, following the semantics
+// of superfacility.Client.FetchJobLogRange.
+type logRangeFunc func(ctx context.Context, path string, offset, length int64) (superfacility.LogChunk, error)
+
+// logReaderForPod reads logs from the job directory on Perlmutter, falling
+// back to the local archive once the live files are gone. Logs are only
+// archived after the job has finished, so a live read that the API answers
+// with not found means the files or the job were purged. Any other error,
+// such as a 429 or 503, is returned rather than served from the archive,
+// which may be missing lines the live files still have.
+func (p *NerscProvider) logReaderForPod(ctx context.Context, key, jobID string, state *podJobState, probePath string) (logRangeFunc, error) {
+	live := func(ctx context.Context, path string, offset, length int64) (superfacility.LogChunk, error) {
+		return p.sfClient.FetchJobLogRange(ctx, jobID, path, offset, length)
+	}
+
+	p.mu.RLock()
+	archived := state.logsArchived
+	p.mu.RUnlock()
+	if !archived {
+		return live, nil
+	}
+
+	_, err := live(ctx, probePath, -1, 0)
+	if err == nil {
+		return live, nil
+	}
+	if !superfacility.IsNotFound(err) {
+		return nil, fmt.Errorf("read logs of job %s: %w", jobID, err)
+	}
+	log.Printf("Serving archived logs for pod %s: live log unavailable: %v", key, err)
+	archiveDir := p.archiveDirForPodKey(key)
+	return func(ctx context.Context, path string, offset, length int64) (superfacility.LogChunk, error) {
+		return readArchivedLogRange(filepath.Join(archiveDir, filepath.Base(path)), offset, length)
+	}, nil
+}
+
+// streamLogs copies the given log files to w, merging lines by timestamp.
+// Files are read in ranges so large logs are never held in memory. With
+// opts.Follow it keeps polling for appended bytes until the job finishes.
+func (p *NerscProvider) streamLogs(ctx context.Context, w io.Writer, jobID string, read logRangeFunc, paths []string, opts *corev1.PodLogOptions) error {
+	lw := newLogWriter(w, opts)
+	sources := make([]*logSource, 0, len(paths))
+	for _, path := range paths {
+		sources = append(sources, &logSource{path: path})
+	}
+
+	if opts.TailLines != nil {
+		var tail []logLine
+		for _, source := range sources {
+			lines, err := tailLog(ctx, read, source, *opts.TailLines, opts.Follow)
+			if err != nil {
+				return err
+			}
+			tail = append(tail, lines...)
+		}
+		if err := lw.write(lastLogLines(mergeLogLines(tail), *opts.TailLines)); err != nil {
+			return err
+		}
+	}
+
+	pollInterval := p.logPollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultLogPollInterval
+	}
+	finished := false
+	for {
+		var batch []logLine
+		allEOF := true
+		for _, source := range sources {
+			if source.eof && !opts.Follow {
+				continue
+			}
+			chunk, err := read(ctx, source.path, source.offset, logChunkSize)
+			if err != nil {
+				return err
+			}
+			source.offset = chunk.Offset + int64(len(chunk.Data))
+			source.eof = int64(len(chunk.Data)) < logChunkSize
+			batch = append(batch, source.split(chunk.Data, source.eof && (!opts.Follow || finished))...)
+			allEOF = allEOF && source.eof
+		}
+		if err := lw.write(mergeLogLines(batch)); err != nil {
+			return err
+		}
+		if !allEOF {
+			continue
+		}
+		if !opts.Follow || finished {
+			return nil
+		}
+
+		done, err := p.jobFinished(ctx, jobID)
+		if err != nil {
+			return err
+		}
+		if done {
+			// Read once more so output written just before exit is included.
+			finished = true
+			continue
+		}
+
+		timer := time.NewTimer(pollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// tailLog reads the last n lines of a log file with suffix range requests,
+// widening the range until enough lines are found, and leaves source
+// positioned at the end of the file for following.
+func tailLog(ctx context.Context, read logRangeFunc, source *logSource, n int64, follow bool) ([]logLine, error) {
+	length := int64(logTailChunkSize)
+	for {
+		chunk, err := read(ctx, source.path, -length, 0)
+		if err != nil {
+			return nil, err
+		}
+		data := chunk.Data
+		if chunk.Offset > 0 {
+			// The range most likely starts mid-line, so drop the partial line.
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				data = data[i+1:]
+			} else {
+				data = nil
+			}
+		}
+
+		source.pending = nil
+		source.lastTS = time.Time{}
+		lines := source.split(data, !follow)
+		if int64(len(lines)) >= n || chunk.Offset == 0 {
+			source.offset = chunk.Offset + int64(len(chunk.Data))
+			return lastLogLines(lines, n), nil
+		}
+		length *= 4
+	}
+}
+
+func (p *NerscProvider) jobFinished(ctx context.Context, jobID string) (bool, error) {
+	status, err := p.sfClient.GetJobStatus(ctx, jobID)
+	if err != nil {
+		return false, err
+	}
+	phase := mapJobStatusToPodPhase(status)
+	return phase == corev1.PodSucceeded || phase == corev1.PodFailed, nil
+}
+
+// mergeLogLines orders lines from several files by timestamp, keeping the
+// original order for lines with the same timestamp.
+func mergeLogLines(lines []logLine) []logLine {
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].timestamp.Before(lines[j].timestamp)
+	})
+	return lines
+}
+
+func lastLogLines(lines []logLine, n int64) []logLine {
+	if n <= 0 {
+		return nil
+	}
+	if int64(len(lines)) > n {
+		return lines[int64(len(lines))-n:]
+	}
+	return lines
+}
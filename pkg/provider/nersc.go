@@ -2,11 +2,13 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/url"
 	"os"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -26,23 +28,61 @@ type NerscProvider struct {
 	nodeName             string
 	transferPollInterval time.Duration
 	transferTimeout      time.Duration
+	logPollInterval      time.Duration
+	shutdownPollInterval time.Duration
+	statsMaxAge          time.Duration
+	startTime            time.Time
+	logArchiveDir        string
+	eventRecorder        EventRecorder
+	podAnnotator         PodAnnotator
+	sfAuth               superfacility.Authenticator
+	sfLimits             *superfacility.Limits
+	sfDialect            superfacility.Dialect
+	sfLocation           *time.Location
+	sfMachine            string
+	qosChargeFactors     *ChargeFactors
+	sfClientOpts         []superfacility.ClientOption
+	kubeletAddress       string
+	kubeletPort          int32
+	apiAuthErr           error
+	apiAuthChanged       time.Time
 	mu                   sync.RWMutex
-	podMap               map[string]string // podKey -> jobID
-	stagingMap           map[string]*podStagingState
+	statsMu              sync.Mutex
+	// stopping counts the deleted pods whose jobs are still being given
+	// their grace period to exit.
+	stopping    sync.WaitGroup
+	podMap      map[string]string // podKey -> jobID
+	stagingMap  map[string]*podStagingState
+	jobStateMap map[string]*podJobState
+	// submitTasks holds the submit tasks that were accepted for a pod but
+	// could not be resolved to a job yet.
+	submitTasks map[string]string // podKey -> taskID
 }
 
 type jobClient interface {
 	SubmitJob(context.Context, superfacility.JobSubmissionRequest) (string, error)
+	ResolveSubmitTask(context.Context, string) (string, error)
 	GetJobStatus(context.Context, string) (string, error)
 	CancelJob(context.Context, string) error
+	SignalJob(context.Context, string, superfacility.JobSignalRequest) error
 	FetchJobLogs(context.Context, string) (string, error)
+	FetchJobLogRange(context.Context, string, string, int64, int64) (superfacility.LogChunk, error)
 	StartGlobusTransfer(context.Context, superfacility.GlobusTransferRequest) (superfacility.GlobusTransfer, error)
 	CheckGlobusTransfer(context.Context, string) (superfacility.GlobusTransferResult, error)
+	RunCommandAndWait(context.Context, string, string) (superfacility.CommandResult, error)
+	UploadFile(context.Context, string, io.Reader, int64) error
+	DownloadFile(context.Context, string, int64, int64) (io.ReadCloser, error)
+	ListDirectory(context.Context, string) ([]superfacility.FileEntry, error)
 }
 
+// DefaultKubeletPort is the kubelet API port the node reports unless
+// WithKubeletEndpoint sets another.
+const DefaultKubeletPort = 10250
+
 const (
 	defaultTransferPollInterval = 15 * time.Second
 	defaultTransferTimeout      = 30 * time.Minute
+	defaultKubeletAddress       = "127.0.0.1"
 
 	annotationInputSource    = "nersc.sf/inputSource"
 	annotationOutputDest     = "nersc.sf/outputDest"
@@ -51,8 +91,46 @@ const (
 	annotationInputVolume    = "nersc.sf/inputVolume"
 	annotationOutputVolume   = "nersc.sf/outputVolume"
 	annotationGlobusUsername = "nersc.sf/globusUsername"
+
+	jobDirName = ".vk-nersc"
 )
 
+// podJobState records what the provider needs to know about a submitted
+// pod after the original spec is gone, such as where its job writes logs.
+type podJobState struct {
+	jobDir               string
+	initContainers       []string
+	containers           []string
+	sidecars             map[string]bool
+	submitReq            superfacility.JobSubmissionRequest
+	requeues             int
+	lastRequeue          string
+	deadlineRead         bool
+	deadlineHit          bool
+	images               map[string]string
+	results              map[string]containerResult
+	resultsJobID         string
+	manifestOffset       int64
+	resultsFinal         bool
+	logsArchiving        bool
+	logsArchived         bool
+	logsArchiveAttempts  int
+	logsArchiveRetryAt   time.Time
+	logsArchiveAbandoned bool
+	accountingReporting  bool
+	accountingReported   bool
+	podRef               corev1.ObjectReference
+	probeKinds           map[string]map[string]bool
+	probeMu              sync.Mutex
+	probeOffset          int64
+	probeStatuses        map[string]probeStatus
+	polledJobID          string
+	polledPhase          corev1.PodPhase
+	usageStart           time.Time
+	usage                *usageSample
+	lastUsage            *usageSample
+}
+
 type podStagingState struct {
 	inputTransferID  string
 	inputSource      *globusLocation
@@ -80,7 +158,100 @@ type globusLocation struct {
 	Path     string
 }
 
-func NewNerscProvider(endpoint, token, nodeName string) (*NerscProvider, error) {
+// Option configures optional NerscProvider behavior.
+type Option func(*NerscProvider)
+
+// WithLogArchiveDir copies the logs of every finished pod into dir, which is
+// expected to be durable storage such as a PVC mounted into the provider pod.
+func WithLogArchiveDir(dir string) Option {
+	return func(p *NerscProvider) {
+		p.logArchiveDir = strings.TrimSpace(dir)
+	}
+}
+
+// WithEventRecorder reports pod events, such as probe failures, through
+// recorder.
+func WithEventRecorder(recorder EventRecorder) Option {
+	return func(p *NerscProvider) {
+		p.eventRecorder = recorder
+	}
+}
+
+// WithPodAnnotator records the Slurm accounting of finished jobs as pod
+// annotations through annotator.
+func WithPodAnnotator(annotator PodAnnotator) Option {
+	return func(p *NerscProvider) {
+		p.podAnnotator = annotator
+	}
+}
+
+// WithAuthenticator authorizes Superfacility API requests with auth instead
+// of a static token.
+func WithAuthenticator(auth superfacility.Authenticator) Option {
+	return func(p *NerscProvider) {
+		p.sfAuth = auth
+	}
+}
+
+// WithRequestLimits replaces the default rate and concurrency limits of
+// Superfacility API requests.
+func WithRequestLimits(limits superfacility.Limits) Option {
+	return func(p *NerscProvider) {
+		p.sfLimits = &limits
+	}
+}
+
+// WithAPIDialect selects the shapes of the Superfacility API job endpoints,
+// such as the compatibility dialect of a mock API.
+func WithAPIDialect(dialect superfacility.Dialect) Option {
+	return func(p *NerscProvider) {
+		p.sfDialect = dialect
+	}
+}
+
+// WithSlurmLocation sets the time zone of the machine's Slurm timestamps,
+// which defaults to superfacility.DefaultTimeZone.
+func WithSlurmLocation(loc *time.Location) Option {
+	return func(p *NerscProvider) {
+		p.sfLocation = loc
+	}
+}
+
+// WithMachine sets the machine that runs the pods' jobs and commands,
+// which defaults to superfacility.DefaultMachine.
+func WithMachine(machine string) Option {
+	return func(p *NerscProvider) {
+		p.sfMachine = machine
+	}
+}
+
+// WithChargeFactors sets the QOS charge factors from which job accounting
+// estimates NERSC hours, which default to DefaultChargeFactors.
+func WithChargeFactors(factors ChargeFactors) Option {
+	return func(p *NerscProvider) {
+		p.qosChargeFactors = &factors
+	}
+}
+
+// WithKubeletEndpoint sets the address and port at which the node serves
+// the kubelet API, which the API server calls for logs and exec. They
+// default to 127.0.0.1 and 10250.
+func WithKubeletEndpoint(address string, port int32) Option {
+	return func(p *NerscProvider) {
+		p.kubeletAddress = address
+		p.kubeletPort = port
+	}
+}
+
+// WithClientOptions configures the Superfacility API client, such as its
+// transport, CA bundle, proxy and timeouts.
+func WithClientOptions(opts ...superfacility.ClientOption) Option {
+	return func(p *NerscProvider) {
+		p.sfClientOpts = append(p.sfClientOpts, opts...)
+	}
+}
+
+func NewNerscProvider(endpoint, token, nodeName string, opts ...Option) (*NerscProvider, error) {
 	endpoint = strings.TrimSpace(endpoint)
 	token = strings.TrimSpace(token)
 	nodeName = strings.TrimSpace(nodeName)
@@ -94,22 +265,45 @@ func NewNerscProvider(endpoint, token, nodeName string) (*NerscProvider, error)
 	if endpointURL.Scheme == "" || endpointURL.Host == "" {
 		return nil, fmt.Errorf("invalid SF_API_ENDPOINT: must include scheme and host")
 	}
-	if token == "" {
-		return nil, fmt.Errorf("SF_API_TOKEN is required")
-	}
 	if nodeName == "" {
 		nodeName = "perlmutter-vk"
 	}
 
-	client := superfacility.New(endpoint, token)
-	return &NerscProvider{
-		sfClient:             client,
+	p := &NerscProvider{
 		nodeName:             nodeName,
 		transferPollInterval: defaultTransferPollInterval,
 		transferTimeout:      defaultTransferTimeout,
+		logPollInterval:      defaultLogPollInterval,
+		shutdownPollInterval: defaultShutdownPollInterval,
+		statsMaxAge:          defaultStatsMaxAge,
+		startTime:            time.Now(),
 		podMap:               make(map[string]string),
 		stagingMap:           make(map[string]*podStagingState),
-	}, nil
+		jobStateMap:          make(map[string]*podJobState),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	client := superfacility.New(endpoint, token, p.sfClientOpts...)
+	p.sfClient = client
+	if p.sfLimits != nil {
+		client.SetLimits(*p.sfLimits)
+	}
+	if p.sfDialect != "" {
+		client.Dialect = p.sfDialect
+	}
+	if p.sfLocation != nil {
+		client.Location = p.sfLocation
+	}
+	if p.sfMachine != "" {
+		client.Machine = p.sfMachine
+	}
+	if p.sfAuth != nil {
+		client.Auth = p.sfAuth
+	} else if token == "" {
+		return nil, fmt.Errorf("SF_API_TOKEN is required")
+	}
+	return p, nil
 }
 
 func (p *NerscProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
@@ -119,6 +313,13 @@ func (p *NerscProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 	if len(pod.Spec.Containers) == 0 {
 		return fmt.Errorf("pod %s has no containers", podKey(pod))
 	}
+	sidecars, err := scripts.Sidecars(pod)
+	if err != nil {
+		return fmt.Errorf("pod %s: %w", podKey(pod), err)
+	}
+	if err := scripts.ValidateLifecycleHooks(pod); err != nil {
+		return fmt.Errorf("pod %s: %w", podKey(pod), err)
+	}
 
 	key := podKey(pod)
 	if jobID, exists := p.jobIDForPodKey(key); exists {
@@ -165,19 +366,22 @@ func (p *NerscProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 		log.Printf("Pod %s input staged with Globus transfer %s", key, transferID)
 	}
 
+	jobDir := path.Join(jobScratchBase, jobDirName)
 	var script string
-	if len(pod.Spec.Containers) > 1 {
-		script = scripts.PodToSlurmPodmanMultiWithVolumes(pod, volumeScratchPaths)
+	if len(pod.Spec.Containers) > 1 || len(sidecars) > 0 {
+		script = scripts.PodToSlurmPodmanMultiWithVolumes(pod, volumeScratchPaths, jobDir)
 	} else {
-		script = scripts.PodToSlurmPodmanWithVolumes(pod, volumeScratchPaths)
+		script = scripts.PodToSlurmPodmanWithVolumes(pod, volumeScratchPaths, jobDir)
 	}
 
-	jobID, err := p.sfClient.SubmitJob(ctx, superfacility.JobSubmissionRequest{
+	submitReq := superfacility.JobSubmissionRequest{
 		Script:  script,
-		System:  "perlmutter",
+		System:  p.machine(),
 		Queue:   "regular",
 		Project: getProjectFromAnnotations(pod),
-	})
+	}
+	jobID, err := p.submitJob(ctx, key, submitReq)
+	p.noteAPIResult(err)
 	if err != nil {
 		return err
 	}
@@ -185,7 +389,7 @@ func (p *NerscProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 	p.mu.Lock()
 	if existingJobID, exists := p.podMap[key]; exists {
 		p.mu.Unlock()
-		if cancelErr := p.sfClient.CancelJob(ctx, jobID); cancelErr != nil {
+		if cancelErr := p.cancelJob(ctx, jobID); cancelErr != nil {
 			return fmt.Errorf("pod %s was concurrently submitted as job %s; failed to cancel duplicate job %s: %w", key, existingJobID, jobID, cancelErr)
 		}
 		log.Printf("Pod %s was concurrently submitted as job %s; cancelled duplicate job %s", key, existingJobID, jobID)
@@ -198,12 +402,48 @@ func (p *NerscProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 	if staging != nil {
 		p.stagingMap[key] = staging
 	}
+	if p.jobStateMap == nil {
+		p.jobStateMap = make(map[string]*podJobState)
+	}
+	jobState := newPodJobState(pod, jobDir, sidecars)
+	jobState.submitReq = submitReq
+	p.jobStateMap[key] = jobState
 	p.mu.Unlock()
 
 	log.Printf("Pod %s submitted as job %s (StatefulSet: %s, Ordinal: %d)", key, jobID, ssName, ordinal)
 	return nil
 }
 
+// submitJob submits req for the pod. A submit task left unresolved by an
+// earlier attempt is resolved instead, so the job is not submitted twice.
+func (p *NerscProvider) submitJob(ctx context.Context, key string, req superfacility.JobSubmissionRequest) (string, error) {
+	p.mu.RLock()
+	taskID := p.submitTasks[key]
+	p.mu.RUnlock()
+
+	var jobID string
+	var err error
+	if taskID != "" {
+		log.Printf("Resolving submit task %s of pod %s", taskID, key)
+		jobID, err = p.sfClient.ResolveSubmitTask(ctx, taskID)
+	} else {
+		jobID, err = p.sfClient.SubmitJob(ctx, req)
+	}
+
+	var pending *superfacility.PendingSubmitError
+	p.mu.Lock()
+	if errors.As(err, &pending) {
+		if p.submitTasks == nil {
+			p.submitTasks = make(map[string]string)
+		}
+		p.submitTasks[key] = pending.TaskID
+	} else {
+		delete(p.submitTasks, key)
+	}
+	p.mu.Unlock()
+	return jobID, err
+}
+
 func (p *NerscProvider) UpdatePod(ctx context.Context, pod *corev1.Pod) error {
 	// Pods are immutable in HPC context, so this is a no-op
 	return nil
@@ -216,28 +456,55 @@ func (p *NerscProvider) DeletePod(ctx context.Context, pod *corev1.Pod) error {
 
 	key := podKey(pod)
 	if jobID, exists := p.jobIDForPodKey(key); exists {
-		err := p.sfClient.CancelJob(ctx, jobID)
-		if err != nil {
-			log.Printf("Failed to cancel job %s for pod %s: %v", jobID, key, err)
-			return err
+		stopped := p.stopJobGracefully(ctx, key, jobID, deletionGracePeriod(pod))
+		if !stopped {
+			if err := p.cancelJob(ctx, jobID); err != nil {
+				log.Printf("Failed to cancel job %s for pod %s: %v", jobID, key, err)
+				return err
+			}
 		}
 
 		p.mu.Lock()
 		if p.podMap[key] == jobID {
 			delete(p.podMap, key)
 			delete(p.stagingMap, key)
+			delete(p.jobStateMap, key)
 		}
 		p.mu.Unlock()
 
-		log.Printf("Cancelled job %s for pod %s", jobID, key)
+		if !stopped {
+			log.Printf("Cancelled job %s for pod %s", jobID, key)
+		}
 	} else {
 		p.mu.Lock()
+		taskID := p.submitTasks[key]
+		delete(p.submitTasks, key)
 		delete(p.stagingMap, key)
+		delete(p.jobStateMap, key)
 		p.mu.Unlock()
+
+		if taskID != "" {
+			p.cancelSubmitTask(ctx, key, taskID)
+		}
 	}
+	p.removeLogArchive(key)
 	return nil
 }
 
+// cancelSubmitTask cancels the job of a deleted pod's unresolved submit task.
+func (p *NerscProvider) cancelSubmitTask(ctx context.Context, key, taskID string) {
+	jobID, err := p.sfClient.ResolveSubmitTask(ctx, taskID)
+	if err != nil {
+		log.Printf("Failed to resolve submit task %s of deleted pod %s: %v", taskID, key, err)
+		return
+	}
+	if err := p.cancelJob(ctx, jobID); err != nil {
+		log.Printf("Failed to cancel job %s of deleted pod %s: %v", jobID, key, err)
+		return
+	}
+	log.Printf("Cancelled job %s for pod %s", jobID, key)
+}
+
 func (p *NerscProvider) jobIDForPodKey(key string) (string, bool) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -262,6 +529,12 @@ func (p *NerscProvider) stagingForPodKey(key string) *podStagingState {
 	return p.stagingMap[key]
 }
 
+func (p *NerscProvider) jobStateForPodKey(key string) *podJobState {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.jobStateMap[key]
+}
+
 func (p *NerscProvider) GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
 	key := fmt.Sprintf("%s/%s", namespace, name)
 	jobID, exists := p.jobIDForPodKey(key)
@@ -269,13 +542,11 @@ func (p *NerscProvider) GetPod(ctx context.Context, namespace, name string) (*co
 		return nil, fmt.Errorf("pod %s not found", key)
 	}
 
-	status, err := p.sfClient.GetJobStatus(ctx, jobID)
+	podStatus, err := p.podStatusForKey(ctx, key, jobID)
 	if err != nil {
 		return nil, err
 	}
 
-	podStatus := p.podStatusForJob(ctx, key, mapJobStatusToPodPhase(status))
-
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
@@ -312,7 +583,7 @@ func (p *NerscProvider) GetPods(ctx context.Context) ([]*corev1.Pod, error) {
 		}
 		namespace, name := parts[0], parts[1]
 
-		status, err := p.sfClient.GetJobStatus(ctx, jobID)
+		status, err := p.podStatusForKey(ctx, key, jobID)
 		if err != nil {
 			log.Printf("Failed to get status for job %s: %v", jobID, err)
 			continue
@@ -323,15 +594,43 @@ func (p *NerscProvider) GetPods(ctx context.Context) ([]*corev1.Pod, error) {
 				Name:      name,
 				Namespace: namespace,
 			},
-			Status: p.podStatusForJob(ctx, key, mapJobStatusToPodPhase(status)),
+			Status: status,
 		}
 		pods = append(pods, pod)
 	}
 	return pods, nil
 }
 
-func (p *NerscProvider) podStatusForJob(ctx context.Context, key string, jobPhase corev1.PodPhase) corev1.PodStatus {
+func (p *NerscProvider) podStatusForKey(ctx context.Context, key, jobID string) (corev1.PodStatus, error) {
+	status, err := p.sfClient.GetJobStatus(ctx, jobID)
+	p.noteAPIResult(err)
+	if err != nil {
+		return corev1.PodStatus{}, err
+	}
+	if state := p.jobStateForPodKey(key); state != nil {
+		p.mu.Lock()
+		state.polledJobID, state.polledPhase = jobID, mapJobStatusToPodPhase(status)
+		p.mu.Unlock()
+	}
+	if jobInterrupted(status) {
+		return p.requeueJob(ctx, key, jobID, status), nil
+	}
+	podStatus := p.podStatusForJob(ctx, key, jobID, mapJobStatusToPodPhase(status))
+	if p.deadlineExceeded(ctx, key, jobID, status) {
+		podStatus.Phase = corev1.PodFailed
+		podStatus.Reason = "DeadlineExceeded"
+		podStatus.Message = fmt.Sprintf("Pod was active on the node longer than the specified deadline: Slurm job %s reached its time limit", jobID)
+	}
+	return podStatus, nil
+}
+
+func (p *NerscProvider) podStatusForJob(ctx context.Context, key, jobID string, jobPhase corev1.PodPhase) corev1.PodStatus {
 	status := corev1.PodStatus{Phase: jobPhase}
+	if jobPhase == corev1.PodSucceeded || jobPhase == corev1.PodFailed {
+		p.startLogArchive(key, jobID)
+		p.startAccountingReport(key, jobID)
+	}
+	p.setContainerStatuses(ctx, key, jobID, &status)
 	if jobPhase != corev1.PodSucceeded {
 		return status
 	}
@@ -341,30 +640,15 @@ func (p *NerscProvider) podStatusForJob(ctx context.Context, key string, jobPhas
 		return status
 	}
 
-	return p.reconcileStageOut(ctx, key)
+	stageOut := p.reconcileStageOut(ctx, key)
+	status.Phase = stageOut.Phase
+	status.Reason = stageOut.Reason
+	status.Message = stageOut.Message
+	return status
 }
 
 func (p *NerscProvider) GetPodLogs(ctx context.Context, namespace, name, container string, opts *corev1.PodLogOptions) (io.ReadCloser, error) {
-	key := fmt.Sprintf("%s/%s", namespace, name)
-	jobID, exists := p.jobIDForPodKey(key)
-	if !exists {
-		return nil, fmt.Errorf("pod %s not found", key)
-	}
-
-	logs, err := p.sfClient.FetchJobLogs(ctx, jobID)
-	if err != nil {
-		return nil, err
-	}
-
-	return io.NopCloser(strings.NewReader(logs)), nil
-}
-
-func (p *NerscProvider) RunInContainer(ctx context.Context, namespace, name, container string, cmd []string, attach interface{}) error {
-	return fmt.Errorf("exec not supported for HPC jobs")
-}
-
-func (p *NerscProvider) GetContainerLogs(ctx context.Context, namespace, name, container string, opts *corev1.PodLogOptions) (io.ReadCloser, error) {
-	return p.GetPodLogs(ctx, namespace, name, container, opts)
+	return p.GetContainerLogs(ctx, namespace, name, container, opts)
 }
 
 func (p *NerscProvider) NodeConditions(ctx context.Context) []corev1.NodeCondition {
@@ -377,14 +661,19 @@ func (p *NerscProvider) NodeConditions(ctx context.Context) []corev1.NodeConditi
 			Reason:             "KubeletReady",
 			Message:            "NERSC provider is ready",
 		},
+		p.apiAuthCondition(),
 	}
 }
 
 func (p *NerscProvider) NodeAddresses(ctx context.Context) []corev1.NodeAddress {
+	address := p.kubeletAddress
+	if address == "" {
+		address = defaultKubeletAddress
+	}
 	return []corev1.NodeAddress{
 		{
 			Type:    corev1.NodeInternalIP,
-			Address: "127.0.0.1",
+			Address: address,
 		},
 		{
 			Type:    corev1.NodeHostName,
@@ -394,13 +683,25 @@ func (p *NerscProvider) NodeAddresses(ctx context.Context) []corev1.NodeAddress
 }
 
 func (p *NerscProvider) NodeDaemonEndpoints(ctx context.Context) *corev1.NodeDaemonEndpoints {
+	port := p.kubeletPort
+	if port == 0 {
+		port = DefaultKubeletPort
+	}
 	return &corev1.NodeDaemonEndpoints{
 		KubeletEndpoint: corev1.DaemonEndpoint{
-			Port: 10250,
+			Port: port,
 		},
 	}
 }
 
+// machine returns the machine that runs the pods' jobs.
+func (p *NerscProvider) machine() string {
+	if p.sfMachine != "" {
+		return p.sfMachine
+	}
+	return superfacility.DefaultMachine
+}
+
 func (p *NerscProvider) OperatingSystem() string {
 	return "linux"
 }
@@ -459,6 +760,74 @@ func (p *NerscProvider) nodeStatus(ctx context.Context) *corev1.Node {
 	}
 }
 
+func newPodJobState(pod *corev1.Pod, jobDir string, sidecars []string) *podJobState {
+	state := &podJobState{
+		jobDir:   jobDir,
+		images:   make(map[string]string, len(pod.Spec.InitContainers)+len(pod.Spec.Containers)),
+		sidecars: make(map[string]bool, len(sidecars)),
+		podRef: corev1.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Namespace:  pod.Namespace,
+			Name:       pod.Name,
+			UID:        pod.UID,
+		},
+	}
+	for _, name := range sidecars {
+		state.sidecars[name] = true
+	}
+	for _, c := range pod.Spec.InitContainers {
+		state.initContainers = append(state.initContainers, c.Name)
+		state.images[c.Name] = c.Image
+	}
+	for _, c := range pod.Spec.Containers {
+		state.containers = append(state.containers, c.Name)
+		state.images[c.Name] = c.Image
+	}
+	for _, c := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		for kind, probe := range map[string]*corev1.Probe{
+			scripts.ProbeStartup:   c.StartupProbe,
+			scripts.ProbeLiveness:  c.LivenessProbe,
+			scripts.ProbeReadiness: c.ReadinessProbe,
+		} {
+			if !scripts.HasExecProbe(probe) {
+				continue
+			}
+			if state.probeKinds == nil {
+				state.probeKinds = make(map[string]map[string]bool)
+			}
+			if state.probeKinds[c.Name] == nil {
+				state.probeKinds[c.Name] = make(map[string]bool)
+			}
+			state.probeKinds[c.Name][kind] = true
+		}
+	}
+	return state
+}
+
+func (s *podJobState) resolveContainer(key, container string) (string, error) {
+	if container == "" {
+		if len(s.containers) == 1 {
+			return s.containers[0], nil
+		}
+		return "", fmt.Errorf("a container name must be specified for pod %s, choose one of: %v", key, s.containers)
+	}
+	for _, name := range s.allContainers() {
+		if name == container {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("container %s is not valid for pod %s", container, key)
+}
+
+func (s *podJobState) allContainers() []string {
+	return append(append([]string{}, s.initContainers...), s.containers...)
+}
+
+func (s *podJobState) containerFile(name string) string {
+	return path.Join(s.jobDir, name)
+}
+
 func detectStatefulSet(pod *corev1.Pod) (string, int) {
 	for _, owner := range pod.OwnerReferences {
 		if owner.Kind == "StatefulSet" {
@@ -489,11 +858,11 @@ func mapJobStatusToPodPhase(status string) corev1.PodPhase {
 	switch strings.ToLower(status) {
 	case "pending", "queued":
 		return corev1.PodPending
-	case "running":
+	case "running", "completing":
 		return corev1.PodRunning
 	case "completed", "success":
 		return corev1.PodSucceeded
-	case "failed", "error", "cancelled":
+	case "failed", "error", "cancelled", "timeout", "out_of_memory", "deadline":
 		return corev1.PodFailed
 	default:
 		return corev1.PodPending
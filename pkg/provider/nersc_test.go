@@ -2,15 +2,30 @@ package provider
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	vkapi "github.com/virtual-kubelet/virtual-kubelet/node/api"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilexec "k8s.io/utils/exec"
 
+	"vk-provider-nersc/pkg/scripts"
 	"vk-provider-nersc/pkg/superfacility"
 )
 
@@ -20,13 +35,26 @@ type fakeJobClient struct {
 	submitReq       superfacility.JobSubmissionRequest
 	submitCount     int
 	statusByJob     map[string]string
+	statusErr       error
 	cancelErr       error
 	cancelledIDs    []string
+	signals         []superfacility.JobSignalRequest
+	onSignal        func()
 	logsByJob       map[string]string
+	filesByJob      map[string]map[string]string
+	submitErr       error
+	resolveErr      error
+	statusCalls     int
+	rangeReads      int
+	rangeReadPaths  []string
+	logReadErr      error
 	operations      []string
 	transferID      string
 	transferReqs    []superfacility.GlobusTransferRequest
 	transferResults map[string][]superfacility.GlobusTransferResult
+	commands        []string
+	tasks           []superfacility.Task
+	remoteFiles     map[string]string
 }
 
 func (f *fakeJobClient) SubmitJob(ctx context.Context, req superfacility.JobSubmissionRequest) (string, error) {
@@ -35,12 +63,29 @@ func (f *fakeJobClient) SubmitJob(ctx context.Context, req superfacility.JobSubm
 	f.submitCount++
 	f.submitReq = req
 	f.operations = append(f.operations, "submit")
+	if f.submitErr != nil {
+		return "", f.submitErr
+	}
+	return f.submitJobID, nil
+}
+
+func (f *fakeJobClient) ResolveSubmitTask(ctx context.Context, taskID string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.operations = append(f.operations, "resolve "+taskID)
+	if f.resolveErr != nil {
+		return "", f.resolveErr
+	}
 	return f.submitJobID, nil
 }
 
 func (f *fakeJobClient) GetJobStatus(ctx context.Context, jobID string) (string, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	f.statusCalls++
+	if f.statusErr != nil {
+		return "", f.statusErr
+	}
 	return f.statusByJob[jobID], nil
 }
 
@@ -54,12 +99,84 @@ func (f *fakeJobClient) CancelJob(ctx context.Context, jobID string) error {
 	return nil
 }
 
+func (f *fakeJobClient) SignalJob(ctx context.Context, jobID string, signal superfacility.JobSignalRequest) error {
+	f.mu.Lock()
+	f.signals = append(f.signals, signal)
+	f.operations = append(f.operations, "signal")
+	onSignal := f.onSignal
+	f.mu.Unlock()
+	if onSignal != nil {
+		onSignal()
+	}
+	return nil
+}
+
 func (f *fakeJobClient) FetchJobLogs(ctx context.Context, jobID string) (string, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	return f.logsByJob[jobID], nil
 }
 
+func (f *fakeJobClient) FetchJobLogRange(ctx context.Context, jobID, path string, offset, length int64) (superfacility.LogChunk, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rangeReads++
+	f.rangeReadPaths = append(f.rangeReadPaths, fmt.Sprintf("%s@%d", filepath.Base(path), offset))
+	if f.logReadErr != nil {
+		return superfacility.LogChunk{}, f.logReadErr
+	}
+	data := f.filesByJob[jobID][path]
+	chunk, start := fakeRange(data, offset, length)
+	return superfacility.LogChunk{Data: []byte(chunk), Offset: start, Size: int64(len(data))}, nil
+}
+
+// fakeRange returns the byte range of data that FetchJobLogRange and
+// DownloadFile describe, and its start.
+func fakeRange(data string, offset, length int64) (string, int64) {
+	size := int64(len(data))
+	start := offset
+	if start < 0 {
+		start = size + offset
+		if start < 0 {
+			start = 0
+		}
+	} else if start > size {
+		start = size
+	}
+	end := size
+	if offset >= 0 && length > 0 && start+length < size {
+		end = start + length
+	}
+	return data[start:end], start
+}
+
+func (f *fakeJobClient) appendFile(jobID, path, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.filesByJob == nil {
+		f.filesByJob = make(map[string]map[string]string)
+	}
+	if f.filesByJob[jobID] == nil {
+		f.filesByJob[jobID] = make(map[string]string)
+	}
+	f.filesByJob[jobID][path] += data
+}
+
+func (f *fakeJobClient) setLogReadErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logReadErr = err
+}
+
+func (f *fakeJobClient) setStatus(jobID, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.statusByJob == nil {
+		f.statusByJob = make(map[string]string)
+	}
+	f.statusByJob[jobID] = status
+}
+
 func (f *fakeJobClient) StartGlobusTransfer(ctx context.Context, req superfacility.GlobusTransferRequest) (superfacility.GlobusTransfer, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -87,6 +204,66 @@ func (f *fakeJobClient) CheckGlobusTransfer(ctx context.Context, transferID stri
 	return result, nil
 }
 
+func (f *fakeJobClient) RunCommandAndWait(ctx context.Context, system, command string) (superfacility.CommandResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.operations = append(f.operations, "run-command")
+	f.commands = append(f.commands, system+": "+command)
+	for len(f.tasks) > 0 {
+		task := f.tasks[0]
+		if len(f.tasks) > 1 {
+			f.tasks = f.tasks[1:]
+		} else if !task.Done() {
+			break
+		}
+		if task.Done() {
+			return task.CommandResult()
+		}
+	}
+	return superfacility.CommandResult{}, errors.New("command task is still running")
+}
+
+func (f *fakeJobClient) UploadFile(ctx context.Context, path string, content io.Reader, size int64) error {
+	data, err := io.ReadAll(io.LimitReader(content, size))
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.operations = append(f.operations, "upload")
+	if f.remoteFiles == nil {
+		f.remoteFiles = make(map[string]string)
+	}
+	f.remoteFiles[path] = string(data)
+	return nil
+}
+
+func (f *fakeJobClient) DownloadFile(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.operations = append(f.operations, "download")
+	data, ok := f.remoteFiles[path]
+	if !ok {
+		return nil, fmt.Errorf("download %s: no such file", path)
+	}
+	chunk, _ := fakeRange(data, offset, length)
+	return io.NopCloser(strings.NewReader(chunk)), nil
+}
+
+func (f *fakeJobClient) ListDirectory(ctx context.Context, dir string) ([]superfacility.FileEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.operations = append(f.operations, "list")
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	var entries []superfacility.FileEntry
+	for path, data := range f.remoteFiles {
+		if name, ok := strings.CutPrefix(path, prefix); ok && !strings.Contains(name, "/") {
+			entries = append(entries, superfacility.FileEntry{Name: name, Size: int64(len(data)), Perms: "-rw-r--r--"})
+		}
+	}
+	return entries, nil
+}
+
 func TestNewNerscProviderValidatesConfig(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -108,10 +285,14 @@ func TestNewNerscProviderValidatesConfig(t *testing.T) {
 }
 
 func TestCreateGetLogsAndDeletePod(t *testing.T) {
+	t.Setenv("USER", "alice")
+
 	client := &fakeJobClient{
 		submitJobID: "job-1",
 		statusByJob: map[string]string{"job-1": "running"},
-		logsByJob:   map[string]string{"job-1": "hello\n"},
+		filesByJob: map[string]map[string]string{
+			"job-1": {"/global/cscratch1/sd/alice/demo/.vk-nersc/main.out": "hello\n"},
+		},
 	}
 	provider := &NerscProvider{
 		sfClient: client,
@@ -151,6 +332,9 @@ func TestCreateGetLogsAndDeletePod(t *testing.T) {
 		t.Fatalf("logs = %q, want hello newline", string(data))
 	}
 
+	// Force deletion cancels the job without a grace period.
+	noGrace := int64(0)
+	pod.DeletionGracePeriodSeconds = &noGrace
 	if err := provider.DeletePod(context.Background(), pod); err != nil {
 		t.Fatalf("DeletePod returned error: %v", err)
 	}
@@ -162,108 +346,271 @@ func TestCreateGetLogsAndDeletePod(t *testing.T) {
 	}
 }
 
-func TestCreatePodIsIdempotentForTrackedPod(t *testing.T) {
-	client := &fakeJobClient{submitJobID: "job-2"}
-	pod := testPod()
+func TestGetContainerLogsReadsOnlyRequestedContainer(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		filesByJob: map[string]map[string]string{
+			"job-1": {
+				"/global/cscratch1/sd/alice/demo/.vk-nersc/main.out":    "main output\n",
+				"/global/cscratch1/sd/alice/demo/.vk-nersc/sidecar.out": "sidecar output\n",
+				"/global/cscratch1/sd/alice/demo/.vk-nersc/sidecar.err": "sidecar error\n",
+			},
+		},
+	}
 	provider := &NerscProvider{
 		sfClient: client,
 		nodeName: "perlmutter-vk",
-		podMap:   map[string]string{podKey(pod): "job-1"},
+		podMap:   make(map[string]string),
 	}
+	pod := testPod()
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "registry.example.com/sidecar:latest"})
 
 	if err := provider.CreatePod(context.Background(), pod); err != nil {
 		t.Fatalf("CreatePod returned error: %v", err)
 	}
-	if client.submitCount != 0 {
-		t.Fatalf("submitCount = %d, want 0", client.submitCount)
+	if !strings.Contains(client.submitReq.Script, `vk_run_logged 'sidecar' podman-hpc run`) {
+		t.Fatalf("script does not redirect sidecar output:\n%s", client.submitReq.Script)
+	}
+
+	logs, err := provider.GetContainerLogs(context.Background(), pod.Namespace, pod.Name, "sidecar", nil)
+	if err != nil {
+		t.Fatalf("GetContainerLogs returned error: %v", err)
+	}
+	defer logs.Close()
+	data, err := io.ReadAll(logs)
+	if err != nil {
+		t.Fatalf("read logs: %v", err)
+	}
+	if string(data) != "sidecar output\nsidecar error\n" {
+		t.Fatalf("logs = %q, want sidecar output and error", string(data))
+	}
+
+	if _, err := provider.GetContainerLogs(context.Background(), pod.Namespace, pod.Name, "", nil); err == nil || !strings.Contains(err.Error(), "container name must be specified") {
+		t.Fatalf("error = %v, want container name requirement", err)
+	}
+	if _, err := provider.GetContainerLogs(context.Background(), pod.Namespace, pod.Name, "missing", nil); err == nil || !strings.Contains(err.Error(), "is not valid") {
+		t.Fatalf("error = %v, want invalid container", err)
 	}
 }
 
-func TestDeletePodKeepsTrackingWhenCancelFails(t *testing.T) {
-	cancelErr := errors.New("cancel unavailable")
-	client := &fakeJobClient{cancelErr: cancelErr}
-	pod := testPod()
+func TestGetContainerLogsHonorsLogOptions(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{submitJobID: "job-1"}
 	provider := &NerscProvider{
 		sfClient: client,
 		nodeName: "perlmutter-vk",
-		podMap:   map[string]string{podKey(pod): "job-1"},
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
 	}
+	stdout := "/global/cscratch1/sd/alice/demo/.vk-nersc/main.out"
+	stderr := "/global/cscratch1/sd/alice/demo/.vk-nersc/main.err"
+	client.appendFile("job-1", stdout, "2024-01-01T00:00:01Z one\n2024-01-01T00:00:03Z three\n2024-01-01T00:00:05Z five\n")
+	client.appendFile("job-1", stderr, "2024-01-01T00:00:02Z two\n2024-01-01T00:00:04Z four\n")
 
-	err := provider.DeletePod(context.Background(), pod)
-	if !errors.Is(err, cancelErr) {
-		t.Fatalf("DeletePod error = %v, want %v", err, cancelErr)
+	tailLines := int64(2)
+	limitBytes := int64(7)
+	tests := []struct {
+		name string
+		opts *corev1.PodLogOptions
+		want string
+	}{
+		{name: "all", opts: nil, want: "one\ntwo\nthree\nfour\nfive\n"},
+		{name: "tail", opts: &corev1.PodLogOptions{TailLines: &tailLines}, want: "four\nfive\n"},
+		{name: "limit", opts: &corev1.PodLogOptions{LimitBytes: &limitBytes}, want: "one\ntwo"},
+		{
+			name: "since and timestamps",
+			opts: &corev1.PodLogOptions{
+				SinceTime:  &metav1.Time{Time: time.Date(2024, 1, 1, 0, 0, 4, 0, time.UTC)},
+				Timestamps: true,
+			},
+			want: "2024-01-01T00:00:04Z four\n2024-01-01T00:00:05Z five\n",
+		},
 	}
-	if jobID, exists := provider.jobIDForPodKey(podKey(pod)); !exists || jobID != "job-1" {
-		t.Fatalf("tracked job = %q, exists %t; want job-1 true", jobID, exists)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readContainerLogs(t, provider, pod, "main", tt.opts); got != tt.want {
+				t.Fatalf("logs = %q, want %q", got, tt.want)
+			}
+		})
 	}
 }
 
-func TestCreatePodRequiresContainer(t *testing.T) {
+func TestGetContainerLogsFollowsUntilJobFinishes(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+	}
 	provider := &NerscProvider{
-		sfClient: &fakeJobClient{},
-		nodeName: "perlmutter-vk",
-		podMap:   make(map[string]string),
+		sfClient:        client,
+		nodeName:        "perlmutter-vk",
+		logPollInterval: time.Millisecond,
+		podMap:          make(map[string]string),
 	}
-	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "empty", Namespace: "default"}}
+	pod := testPod()
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	stdout := "/global/cscratch1/sd/alice/demo/.vk-nersc/main.out"
+	client.appendFile("job-1", stdout, "2024-01-01T00:00:01Z first\n2024-01-01T00:00:02Z sec")
 
-	err := provider.CreatePod(context.Background(), pod)
-	if err == nil || !strings.Contains(err.Error(), "has no containers") {
-		t.Fatalf("error = %v, want no containers", err)
+	logs, err := provider.GetContainerLogs(context.Background(), pod.Namespace, pod.Name, "main", &corev1.PodLogOptions{Follow: true})
+	if err != nil {
+		t.Fatalf("GetContainerLogs returned error: %v", err)
+	}
+	defer logs.Close()
+
+	buf := make([]byte, len("first\n"))
+	if _, err := io.ReadFull(logs, buf); err != nil {
+		t.Fatalf("read first line: %v", err)
+	}
+	if string(buf) != "first\n" {
+		t.Fatalf("first line = %q, want first", string(buf))
+	}
+
+	client.appendFile("job-1", stdout, "ond\n2024-01-01T00:00:03Z last")
+	client.setStatus("job-1", "completed")
+
+	rest, err := io.ReadAll(logs)
+	if err != nil {
+		t.Fatalf("read remaining logs: %v", err)
+	}
+	if string(rest) != "second\nlast" {
+		t.Fatalf("remaining logs = %q, want second and last", string(rest))
 	}
 }
 
-func TestCreatePodStagesInputBeforeSubmittingJob(t *testing.T) {
+func TestFinishedPodLogsAreServedFromArchive(t *testing.T) {
 	t.Setenv("USER", "alice")
 
 	client := &fakeJobClient{
 		submitJobID: "job-1",
-		transferID:  "input-transfer",
-		transferResults: map[string][]superfacility.GlobusTransferResult{
-			"input-transfer": {{GlobusUUID: "input-transfer", Status: "SUCCEEDED"}},
-		},
+		statusByJob: map[string]string{"job-1": "completed"},
 	}
+	archiveDir := t.TempDir()
 	provider := &NerscProvider{
-		sfClient: client,
-		nodeName: "perlmutter-vk",
-		podMap:   make(map[string]string),
+		sfClient:      client,
+		nodeName:      "perlmutter-vk",
+		logArchiveDir: archiveDir,
+		podMap:        make(map[string]string),
 	}
 	pod := testPod()
-	pod.Annotations[annotationInputSource] = "globus://dtn/global/cfs/cdirs/m1234/input"
-	pod.Annotations[annotationInputVolume] = "data"
-	pod.Spec.Volumes = []corev1.Volume{{Name: "data"}, {Name: "work"}}
-	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/mnt/data"}}
-
 	if err := provider.CreatePod(context.Background(), pod); err != nil {
 		t.Fatalf("CreatePod returned error: %v", err)
 	}
-	if got, want := strings.Join(client.operations, ","), "start-transfer,check-transfer,submit"; got != want {
-		t.Fatalf("operations = %s, want %s", got, want)
+	client.appendFile("job-1", "/global/cscratch1/sd/alice/demo/.vk-nersc/main.out", "2024-01-01T00:00:01Z archived\n")
+
+	if _, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name); err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
 	}
-	if len(client.transferReqs) != 1 {
-		t.Fatalf("transfer request count = %d, want 1", len(client.transferReqs))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		provider.mu.RLock()
+		archived := provider.jobStateMap[podKey(pod)].logsArchived
+		provider.mu.RUnlock()
+		if archived {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("logs were not archived")
+		}
+		time.Sleep(time.Millisecond)
 	}
-	req := client.transferReqs[0]
-	if req.SourceUUID != "dtn" || req.TargetUUID != "perlmutter" {
-		t.Fatalf("endpoints = %s -> %s, want dtn -> perlmutter", req.SourceUUID, req.TargetUUID)
+
+	// A transient error is returned rather than hidden behind the archive.
+	client.setLogReadErr(&superfacility.APIError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"})
+	if _, err := provider.GetContainerLogs(context.Background(), pod.Namespace, pod.Name, "main", nil); !superfacility.IsRateLimited(err) {
+		t.Fatalf("GetContainerLogs error = %v, want the 429", err)
 	}
-	if req.SourceDir != "/global/cfs/cdirs/m1234/input" {
-		t.Fatalf("source dir = %q", req.SourceDir)
+
+	client.setLogReadErr(&superfacility.APIError{StatusCode: http.StatusNotFound, Status: "404 Not Found", Body: "file purged"})
+	if got := readContainerLogs(t, provider, pod, "main", nil); got != "archived\n" {
+		t.Fatalf("logs = %q, want archived", got)
 	}
-	if req.TargetDir != "/global/cscratch1/sd/alice/demo/data" {
-		t.Fatalf("target dir = %q", req.TargetDir)
+
+	if err := provider.DeletePod(context.Background(), pod); err != nil {
+		t.Fatalf("DeletePod returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(archiveDir, "default", "demo")); !os.IsNotExist(err) {
+		t.Fatalf("archive stat error = %v, want not exist after delete", err)
 	}
 }
 
-func TestGetPodStatusStagesOutputAfterJobSucceeds(t *testing.T) {
+func TestFailedLogArchiveIsRetriedWithBackoffOrAbandoned(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	for _, tt := range []struct {
+		name      string
+		err       error
+		abandoned bool
+	}{
+		{"transient", &superfacility.APIError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}, false},
+		{"purged", &superfacility.APIError{StatusCode: http.StatusNotFound, Status: "404 Not Found"}, true},
+		{"too large", fmt.Errorf("read main.out: %w", superfacility.ErrFileTooLarge), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeJobClient{
+				submitJobID: "job-1",
+				statusByJob: map[string]string{"job-1": "completed"},
+			}
+			provider := &NerscProvider{
+				sfClient:      client,
+				nodeName:      "perlmutter-vk",
+				logArchiveDir: t.TempDir(),
+				podMap:        make(map[string]string),
+			}
+			pod := testPod()
+			if err := provider.CreatePod(context.Background(), pod); err != nil {
+				t.Fatalf("CreatePod returned error: %v", err)
+			}
+			client.setLogReadErr(tt.err)
+			state := provider.jobStateForPodKey(podKey(pod))
+
+			for i := 0; i < 3; i++ {
+				if _, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name); err != nil {
+					t.Fatalf("GetPodStatus returned error: %v", err)
+				}
+				deadline := time.Now().Add(5 * time.Second)
+				for {
+					provider.mu.RLock()
+					archiving := state.logsArchiving
+					provider.mu.RUnlock()
+					if !archiving {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatal("log archive did not finish")
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+
+			provider.mu.RLock()
+			defer provider.mu.RUnlock()
+			if state.logsArchived || state.logsArchiveAttempts != 1 || state.logsArchiveAbandoned != tt.abandoned {
+				t.Fatalf("archived = %t, attempts = %d, abandoned = %t, want one attempt and abandoned %t",
+					state.logsArchived, state.logsArchiveAttempts, state.logsArchiveAbandoned, tt.abandoned)
+			}
+			if !tt.abandoned && time.Until(state.logsArchiveRetryAt) < logArchiveRetryDelay/2 {
+				t.Fatalf("retry at %s, want about %s from now", state.logsArchiveRetryAt, logArchiveRetryDelay)
+			}
+		})
+	}
+}
+
+func TestGetPodStatusReportsContainerExitCodesAndMessages(t *testing.T) {
 	t.Setenv("USER", "alice")
 
 	client := &fakeJobClient{
 		submitJobID: "job-1",
-		statusByJob: map[string]string{"job-1": "completed"},
-		transferID:  "output-transfer",
-		transferResults: map[string][]superfacility.GlobusTransferResult{
-			"output-transfer": {{GlobusUUID: "output-transfer", Status: "SUCCEEDED"}},
-		},
+		statusByJob: map[string]string{"job-1": "failed"},
 	}
 	provider := &NerscProvider{
 		sfClient: client,
@@ -271,51 +618,1436 @@ func TestGetPodStatusStagesOutputAfterJobSucceeds(t *testing.T) {
 		podMap:   make(map[string]string),
 	}
 	pod := testPod()
-	pod.Annotations[annotationStageOut] = "true"
-	pod.Annotations[annotationOutputDest] = "globus://dtn/global/cfs/cdirs/m1234/output"
-	pod.Annotations[annotationOutputVolume] = "results"
-	pod.Spec.Volumes = []corev1.Volume{{Name: "data"}, {Name: "results"}}
-	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "results", MountPath: "/mnt/results"}}
-
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "registry.example.com/sidecar:latest"})
 	if err := provider.CreatePod(context.Background(), pod); err != nil {
 		t.Fatalf("CreatePod returned error: %v", err)
 	}
+	jobDir := "/global/cscratch1/sd/alice/demo/.vk-nersc/"
+	client.appendFile("job-1", jobDir+"status.jsonl", `{"name":"main","exitCode":0,"signal":0,"startedAt":"2024-01-01T00:00:00Z","finishedAt":"2024-01-01T00:01:00Z"}
+{"name":"sidecar","exitCode":137,"signal":9,"startedAt":"2024-01-01T00:00:00Z","finishedAt":"2024-01-01T00:02:00Z"}
+{"name":"trunc`)
+	client.appendFile("job-1", jobDir+"main.termination-log", "result=42")
+	client.appendFile("job-1", jobDir+"sidecar.termination-log", "sidecar killed")
+
 	status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
 	if err != nil {
 		t.Fatalf("GetPodStatus returned error: %v", err)
 	}
-	if status.Phase != corev1.PodSucceeded || status.Reason != "StageOutComplete" {
-		t.Fatalf("status = %s/%s, want Succeeded/StageOutComplete", status.Phase, status.Reason)
+	if len(status.ContainerStatuses) != 2 {
+		t.Fatalf("container status count = %d, want 2", len(status.ContainerStatuses))
 	}
-	if len(client.transferReqs) != 1 {
-		t.Fatalf("transfer request count = %d, want 1", len(client.transferReqs))
+	start := metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	want := []corev1.ContainerStateTerminated{
+		{ExitCode: 0, Reason: "Completed", Message: "result=42", StartedAt: start, FinishedAt: metav1.NewTime(start.Add(time.Minute))},
+		{ExitCode: 137, Signal: 9, Reason: "Error", Message: "sidecar killed", StartedAt: start, FinishedAt: metav1.NewTime(start.Add(2 * time.Minute))},
 	}
-	req := client.transferReqs[0]
-	if req.SourceUUID != "perlmutter" || req.TargetUUID != "dtn" {
-		t.Fatalf("endpoints = %s -> %s, want perlmutter -> dtn", req.SourceUUID, req.TargetUUID)
+	for i, containerStatus := range status.ContainerStatuses {
+		terminated := containerStatus.State.Terminated
+		if terminated == nil {
+			t.Fatalf("%s state = %+v, want terminated", containerStatus.Name, containerStatus.State)
+		}
+		if !terminated.StartedAt.Equal(&want[i].StartedAt) || !terminated.FinishedAt.Equal(&want[i].FinishedAt) {
+			t.Fatalf("%s times = %s-%s, want %s-%s", containerStatus.Name, terminated.StartedAt, terminated.FinishedAt, want[i].StartedAt, want[i].FinishedAt)
+		}
+		terminated.StartedAt, terminated.FinishedAt = want[i].StartedAt, want[i].FinishedAt
+		if *terminated != want[i] {
+			t.Fatalf("%s terminated = %+v, want %+v", containerStatus.Name, *terminated, want[i])
+		}
 	}
-	if req.SourceDir != "/global/cscratch1/sd/alice/demo/results" {
-		t.Fatalf("source dir = %q", req.SourceDir)
+}
+
+func TestRunningPodReportsStoppedContainersFromManifest(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
 	}
-	if req.TargetDir != "/global/cfs/cdirs/m1234/output" {
-		t.Fatalf("target dir = %q", req.TargetDir)
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "registry.example.com/sidecar:latest"})
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	client.appendFile("job-1", "/global/cscratch1/sd/alice/demo/.vk-nersc/status.jsonl", `{"name":"sidecar","exitCode":2,"signal":0,"startedAt":"2024-01-01T00:00:00Z","finishedAt":"2024-01-01T00:01:00Z"}`+"\n")
+
+	status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if got := status.ContainerStatuses[0].State.Running; got == nil {
+		t.Fatalf("main state = %+v, want running", status.ContainerStatuses[0].State)
+	}
+	if got := status.ContainerStatuses[1].State.Terminated; got == nil || got.ExitCode != 2 {
+		t.Fatalf("sidecar state = %+v, want terminated with exit code 2", status.ContainerStatuses[1].State)
 	}
 }
 
-func TestCreatePodRequiresStageVolumeWhenStagingWithMultipleVolumes(t *testing.T) {
+func TestRunningPodReadsOnlyNewManifestEntries(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+	}
 	provider := &NerscProvider{
-		sfClient: &fakeJobClient{},
+		sfClient: client,
 		nodeName: "perlmutter-vk",
 		podMap:   make(map[string]string),
 	}
 	pod := testPod()
-	pod.Annotations[annotationInputSource] = "globus://dtn/global/cfs/cdirs/m1234/input"
-	pod.Spec.Volumes = []corev1.Volume{{Name: "data"}, {Name: "work"}}
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "registry.example.com/sidecar:latest"})
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	manifest := "/global/cscratch1/sd/alice/demo/.vk-nersc/status.jsonl"
+	sidecarLine := `{"name":"sidecar","exitCode":2,"signal":0,"startedAt":"2024-01-01T00:00:00Z","finishedAt":"2024-01-01T00:01:00Z"}` + "\n"
+	mainLine := `{"name":"main","exitCode":0,"signal":0,"startedAt":"2024-01-01T00:00:00Z","finishedAt":"2024-01-01T00:02:00Z"}` + "\n"
+	client.appendFile("job-1", manifest, sidecarLine)
 
-	err := provider.CreatePod(context.Background(), pod)
-	if err == nil || !strings.Contains(err.Error(), annotationStageVolume) {
-		t.Fatalf("error = %v, want stage volume requirement", err)
+	poll := func() ([]string, *corev1.PodStatus) {
+		t.Helper()
+		client.mu.Lock()
+		client.rangeReadPaths = nil
+		client.mu.Unlock()
+		status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+		if err != nil {
+			t.Fatalf("GetPodStatus returned error: %v", err)
+		}
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		var reads []string
+		for _, read := range client.rangeReadPaths {
+			if strings.HasPrefix(read, "status.jsonl") || strings.Contains(read, ".termination-log") {
+				reads = append(reads, read)
+			}
+		}
+		return reads, status
+	}
+
+	reads, _ := poll()
+	if want := []string{"status.jsonl@0", "sidecar.termination-log@0"}; !reflect.DeepEqual(reads, want) {
+		t.Fatalf("reads = %q, want %q", reads, want)
+	}
+	tail := fmt.Sprintf("status.jsonl@%d", len(sidecarLine))
+	reads, status := poll()
+	if want := []string{tail}; !reflect.DeepEqual(reads, want) {
+		t.Fatalf("reads = %q, want only the manifest tail %q", reads, want)
+	}
+	if got := status.ContainerStatuses[1].State.Terminated; got == nil || got.ExitCode != 2 {
+		t.Fatalf("sidecar state = %+v, want the cached result", status.ContainerStatuses[1].State)
+	}
+
+	// A line still being written is left for the next poll.
+	client.appendFile("job-1", manifest, mainLine[:20])
+	reads, status = poll()
+	if want := []string{tail}; !reflect.DeepEqual(reads, want) {
+		t.Fatalf("reads = %q, want %q", reads, want)
+	}
+	if status.ContainerStatuses[0].State.Running == nil {
+		t.Fatalf("main state = %+v, want running", status.ContainerStatuses[0].State)
+	}
+	client.appendFile("job-1", manifest, mainLine[20:])
+	reads, status = poll()
+	if want := []string{tail, "main.termination-log@0"}; !reflect.DeepEqual(reads, want) {
+		t.Fatalf("reads = %q, want %q", reads, want)
+	}
+	if got := status.ContainerStatuses[0].State.Terminated; got == nil || got.ExitCode != 0 {
+		t.Fatalf("main state = %+v, want terminated", status.ContainerStatuses[0].State)
+	}
+}
+
+func TestGetPodStatusReportsInitContainers(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+	}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	pod.Spec.InitContainers = []corev1.Container{
+		{Name: "fetch", Image: "registry.example.com/fetch:latest"},
+		{Name: "render", Image: "registry.example.com/render:latest"},
+	}
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	manifest := "/global/cscratch1/sd/alice/demo/.vk-nersc/status.jsonl"
+	client.appendFile("job-1", manifest, `{"name":"fetch","exitCode":0,"signal":0,"startedAt":"2024-01-01T00:00:00Z","finishedAt":"2024-01-01T00:01:00Z"}`+"\n")
+
+	status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if got := status.InitContainerStatuses[0].State.Terminated; got == nil || got.ExitCode != 0 {
+		t.Fatalf("fetch state = %+v, want terminated with exit code 0", status.InitContainerStatuses[0].State)
+	}
+	if got := status.InitContainerStatuses[1].State.Running; got == nil {
+		t.Fatalf("render state = %+v, want running", status.InitContainerStatuses[1].State)
+	}
+	if got := status.ContainerStatuses[0].State.Waiting; got == nil || got.Reason != "PodInitializing" {
+		t.Fatalf("main state = %+v, want waiting with reason PodInitializing", status.ContainerStatuses[0].State)
+	}
+	if got := podCondition(status, corev1.PodInitialized); got == nil || got.Status != corev1.ConditionFalse {
+		t.Fatalf("Initialized condition = %+v, want False", got)
+	}
+
+	client.appendFile("job-1", manifest, `{"name":"render","exitCode":3,"signal":0,"startedAt":"2024-01-01T00:01:00Z","finishedAt":"2024-01-01T00:02:00Z"}`+"\n")
+	client.setStatus("job-1", "failed")
+
+	status, err = provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if status.Phase != corev1.PodFailed {
+		t.Fatalf("phase = %s, want %s", status.Phase, corev1.PodFailed)
+	}
+	if got := status.InitContainerStatuses[1].State.Terminated; got == nil || got.ExitCode != 3 {
+		t.Fatalf("render state = %+v, want terminated with exit code 3", status.InitContainerStatuses[1].State)
+	}
+	if got := status.ContainerStatuses[0].State.Waiting; got == nil {
+		t.Fatalf("main state = %+v, want waiting", status.ContainerStatuses[0].State)
+	}
+	if got := podCondition(status, corev1.PodInitialized); got == nil || got.Status != corev1.ConditionFalse || !strings.Contains(got.Message, "render") {
+		t.Fatalf("Initialized condition = %+v, want False naming render", got)
+	}
+}
+
+func TestGetPodStatusReportsRunningNativeSidecar(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+	}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	always := corev1.ContainerRestartPolicyAlways
+	pod := testPod()
+	pod.Spec.InitContainers = []corev1.Container{
+		{Name: "proxy", Image: "registry.example.com/proxy:latest", RestartPolicy: &always},
+		{Name: "setup", Image: "registry.example.com/setup:latest"},
+	}
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	if !strings.Contains(client.submitReq.Script, "trap vk_stop_sidecars EXIT") {
+		t.Fatalf("script does not stop sidecars:\n%s", client.submitReq.Script)
+	}
+	client.appendFile("job-1", "/global/cscratch1/sd/alice/demo/.vk-nersc/status.jsonl", `{"name":"setup","exitCode":0,"signal":0,"startedAt":"2024-01-01T00:00:00Z","finishedAt":"2024-01-01T00:01:00Z"}`+"\n")
+
+	status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if got := status.InitContainerStatuses[0]; got.State.Running == nil || !got.Ready {
+		t.Fatalf("proxy status = %+v, want running and ready", got)
+	}
+	if got := status.ContainerStatuses[0].State.Running; got == nil {
+		t.Fatalf("main state = %+v, want running", status.ContainerStatuses[0].State)
+	}
+	if got := podCondition(status, corev1.PodInitialized); got == nil || got.Status != corev1.ConditionTrue {
+		t.Fatalf("Initialized condition = %+v, want True", got)
+	}
+}
+
+func TestCreatePodRejectsInvalidSidecarsAnnotation(t *testing.T) {
+	client := &fakeJobClient{submitJobID: "job-1"}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	pod.Annotations = map[string]string{scripts.SidecarsAnnotation: "missing"}
+
+	if err := provider.CreatePod(context.Background(), pod); err == nil {
+		t.Fatal("CreatePod accepted a sidecars annotation naming an unknown container")
+	}
+	if client.submitCount != 0 {
+		t.Fatalf("submitCount = %d, want 0", client.submitCount)
+	}
+}
+
+func TestGetPodStatusReportsRestartingContainer(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+	}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	manifest := "/global/cscratch1/sd/alice/demo/.vk-nersc/status.jsonl"
+	client.appendFile("job-1", manifest, `{"name":"main","exitCode":1,"signal":0,"startedAt":"2024-01-01T00:00:00Z","finishedAt":"2024-01-01T00:01:00Z","restartCount":1,"restarting":true}`+"\n")
+
+	status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	got := status.ContainerStatuses[0]
+	if got.State.Running == nil || got.RestartCount != 2 {
+		t.Fatalf("main status = %+v, want running with restart count 2", got)
+	}
+	if last := got.LastTerminationState.Terminated; last == nil || last.ExitCode != 1 {
+		t.Fatalf("main last state = %+v, want terminated with exit code 1", got.LastTerminationState)
+	}
+
+	client.appendFile("job-1", manifest, `{"name":"main","exitCode":0,"signal":0,"startedAt":"2024-01-01T00:02:00Z","finishedAt":"2024-01-01T00:03:00Z","restartCount":2,"restarting":false}`+"\n")
+	client.setStatus("job-1", "completed")
+
+	status, err = provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	got = status.ContainerStatuses[0]
+	if got.State.Terminated == nil || got.State.Terminated.ExitCode != 0 || got.RestartCount != 2 {
+		t.Fatalf("main status = %+v, want terminated with exit code 0 and restart count 2", got)
+	}
+}
+
+func TestCalledOffRestartKeepsTerminationMessage(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+	}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	jobDir := "/global/cscratch1/sd/alice/demo/.vk-nersc/"
+	run := `"name":"main","exitCode":1,"signal":0,"startedAt":"2024-01-01T00:00:00Z","finishedAt":"2024-01-01T00:01:00Z","restartCount":0`
+	client.appendFile("job-1", jobDir+"main.termination-log", "disk full")
+	client.appendFile("job-1", jobDir+"status.jsonl", "{"+run+`,"restarting":true}`+"\n")
+	if _, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name); err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+
+	// The job is stopped during the back-off, so the run is recorded again
+	// without a restart, and the message is not read a second time.
+	client.appendFile("job-1", jobDir+"status.jsonl", "{"+run+`,"restarting":false}`+"\n")
+	client.mu.Lock()
+	client.rangeReadPaths = nil
+	client.mu.Unlock()
+	status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	client.mu.Lock()
+	reads := client.rangeReadPaths
+	client.mu.Unlock()
+	for _, read := range reads {
+		if strings.HasPrefix(read, "main.termination-log") {
+			t.Fatalf("reads = %q, want the cached termination message", reads)
+		}
+	}
+	got := status.ContainerStatuses[0]
+	if got.State.Terminated == nil || got.State.Terminated.Message != "disk full" || got.RestartCount != 0 {
+		t.Fatalf("main status = %+v, want terminated with the cached message and no restart", got)
+	}
+}
+
+type fakeEventRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (f *fakeEventRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ref := object.(*corev1.ObjectReference)
+	f.events = append(f.events, fmt.Sprintf("%s %s %s %s: %s", ref.Name, ref.FieldPath, eventtype, reason, fmt.Sprintf(messageFmt, args...)))
+}
+
+func TestGetPodStatusReportsProbeResults(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+	}
+	recorder := &fakeEventRecorder{}
+	provider := &NerscProvider{
+		sfClient:      client,
+		nodeName:      "perlmutter-vk",
+		podMap:        make(map[string]string),
+		eventRecorder: recorder,
+	}
+	pod := testPod()
+	exec := corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"check"}}}
+	pod.Spec.Containers[0].StartupProbe = &corev1.Probe{ProbeHandler: exec}
+	pod.Spec.Containers[0].LivenessProbe = &corev1.Probe{ProbeHandler: exec}
+	pod.Spec.Containers[0].ReadinessProbe = &corev1.Probe{ProbeHandler: exec}
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	probes := "/global/cscratch1/sd/alice/demo/.vk-nersc/probes.jsonl"
+	client.appendFile("job-1", probes, `{"name":"main","probe":"start","success":true,"time":"2024-01-01T00:00:00Z"}`+"\n"+
+		`{"name":"main","probe":"startup","success":false,"failures":1,"message":"not yet","time":"2024-01-01T00:00:10Z"}`+"\n")
+
+	status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	got := status.ContainerStatuses[0]
+	if got.Started == nil || *got.Started || got.Ready {
+		t.Fatalf("main status = %+v, want running but not started or ready", got)
+	}
+	if cond := podCondition(status, corev1.PodReady); cond == nil || cond.Status != corev1.ConditionFalse {
+		t.Fatalf("Ready condition = %+v, want False", cond)
+	}
+
+	// The last line is still being written and must wait for the next poll.
+	client.appendFile("job-1", probes, `{"name":"main","probe":"startup","success":true,"time":"2024-01-01T00:00:20Z"}`+"\n"+
+		`{"name":"main","probe":"readiness","success":true,"time":"2024-01-01T00:00:30Z"}`+"\n"+
+		`{"name":"main","probe":"liveness","success":false,"failures":3,"failed":true,"mess`)
+
+	status, err = provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	got = status.ContainerStatuses[0]
+	if got.Started == nil || !*got.Started || !got.Ready {
+		t.Fatalf("main status = %+v, want started and ready", got)
+	}
+	for _, conditionType := range []corev1.PodConditionType{corev1.ContainersReady, corev1.PodReady} {
+		if cond := podCondition(status, conditionType); cond == nil || cond.Status != corev1.ConditionTrue {
+			t.Fatalf("%s condition = %+v, want True", conditionType, cond)
+		}
+	}
+
+	client.appendFile("job-1", probes, `age":"timed out","time":"2024-01-01T00:00:40Z"}`+"\n"+
+		`{"name":"main","probe":"start","success":true,"time":"2024-01-01T00:00:50Z"}`+"\n")
+
+	status, err = provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if got := status.ContainerStatuses[0]; got.Ready || *got.Started {
+		t.Fatalf("main status = %+v, want restarted container not started or ready", got)
+	}
+
+	wantEvents := []string{
+		"demo spec.containers{main} Warning Unhealthy: Startup probe failed: not yet",
+		"demo spec.containers{main} Warning Unhealthy: Liveness probe failed: timed out",
+		"demo spec.containers{main} Normal Killing: Container main failed liveness probe, will be restarted",
+	}
+	if strings.Join(recorder.events, "\n") != strings.Join(wantEvents, "\n") {
+		t.Fatalf("events = %q, want %q", recorder.events, wantEvents)
+	}
+}
+
+type fakeAttach struct {
+	stdout, stderr strings.Builder
+}
+
+func (a *fakeAttach) Stdin() io.Reader              { return nil }
+func (a *fakeAttach) Stdout() io.WriteCloser        { return nopWriteCloser{&a.stdout} }
+func (a *fakeAttach) Stderr() io.WriteCloser        { return nopWriteCloser{&a.stderr} }
+func (a *fakeAttach) TTY() bool                     { return false }
+func (a *fakeAttach) Resize() <-chan vkapi.TermSize { return nil }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestRunInContainerExecsInRunningJob(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+		tasks: []superfacility.Task{
+			{ID: "task-1", Status: "running"},
+			{ID: "task-1", Status: "completed", Result: `{"status":"ok","output":"hello\n\n__vk_exec_exit_code=3\n","error":"warning\n"}`},
+		},
+	}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+
+	attach := &fakeAttach{}
+	err := provider.RunInContainer(context.Background(), pod.Namespace, pod.Name, "", []string{"cat", "/etc/os-release"}, attach)
+	var exitErr utilexec.CodeExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Fatalf("RunInContainer error = %v, want exit code 3", err)
+	}
+	want := "perlmutter: srun --jobid='job-1' --overlap podman-hpc exec 'vk-job-1-main' 'cat' '/etc/os-release'; "
+	if len(client.commands) != 1 || !strings.HasPrefix(client.commands[0], want) {
+		t.Fatalf("commands = %q, want prefix %q", client.commands, want)
+	}
+	if attach.stdout.String() != "hello\n" || attach.stderr.String() != "warning\n" {
+		t.Fatalf("stdout = %q, stderr = %q", attach.stdout.String(), attach.stderr.String())
+	}
+
+	client.setStatus("job-1", "completed")
+	err = provider.RunInContainer(context.Background(), pod.Namespace, pod.Name, "main", []string{"true"}, &fakeAttach{})
+	if err == nil || !strings.Contains(err.Error(), "not running") {
+		t.Fatalf("RunInContainer error = %v, want not running error", err)
+	}
+}
+
+func TestConfiguredMachineRunsJobsAndCommands(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+		tasks: []superfacility.Task{
+			{ID: "task-1", Status: "completed", Result: `{"status":"ok","output":"\n__vk_exec_exit_code=0\n"}`},
+		},
+	}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	WithMachine("muller")(provider)
+	pod := testPod()
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	if client.submitReq.System != "muller" {
+		t.Fatalf("submitted to %q, want muller", client.submitReq.System)
+	}
+	if err := provider.RunInContainer(context.Background(), pod.Namespace, pod.Name, "main", []string{"true"}, &fakeAttach{}); err != nil {
+		t.Fatalf("RunInContainer returned error: %v", err)
+	}
+	if len(client.commands) != 1 || !strings.HasPrefix(client.commands[0], "muller: ") {
+		t.Fatalf("commands = %q, want them run on muller", client.commands)
+	}
+}
+
+func TestGetStatsSummaryReportsJobUsage(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	output := `job-1.batch|cpu=01:30.500,mem=1M,fs/disk=2048|fs/disk=1K\n` +
+		`job-1.0|cpu=1-00:00:00,mem=1.50G,fs/disk=0,gres/gpuutil=75,gres/gpumem=512M|fs/disk=0\n` +
+		`__vk_container_stats__\n` +
+		`vk-job-1-main|5000000000|1048576\n` +
+		`vk-job-2-main|7000000000|2097152\n`
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+		tasks: []superfacility.Task{
+			{ID: "task-1", Status: "completed", Result: `{"status":"ok","output":"` + output + `"}`},
+		},
+	}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+
+	// Scrapes sample only jobs the last status poll found running, and never
+	// query job states themselves.
+	summary, err := provider.GetStatsSummary(context.Background())
+	if err != nil || len(summary.Pods) != 0 || len(client.commands) != 0 || client.statusCalls != 0 {
+		t.Fatalf("summary before a status poll = %+v, %v, commands %q, status calls %d", summary, err, client.commands, client.statusCalls)
+	}
+	if _, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name); err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+
+	summary, err = provider.GetStatsSummary(context.Background())
+	if err != nil {
+		t.Fatalf("GetStatsSummary returned error: %v", err)
+	}
+	if client.statusCalls != 1 {
+		t.Fatalf("status calls = %d, want only the status poll", client.statusCalls)
+	}
+	want := "perlmutter: sstat --noheader --parsable2 --allsteps --format=JobID,TRESUsageInTot,TRESUsageOutTot --jobs='job-1'; "
+	if len(client.commands) != 1 || !strings.HasPrefix(client.commands[0], want) {
+		t.Fatalf("commands = %q, want prefix %q", client.commands, want)
+	}
+	if summary.Node.NodeName != "perlmutter-vk" || len(summary.Pods) != 1 {
+		t.Fatalf("summary = %+v", summary)
+	}
+	podStats := summary.Pods[0]
+	if podStats.PodRef.Name != pod.Name || podStats.PodRef.Namespace != pod.Namespace {
+		t.Fatalf("pod ref = %+v", podStats.PodRef)
+	}
+	if got, want := *podStats.CPU.UsageCoreNanoSeconds, uint64((24*time.Hour + 90500*time.Millisecond).Nanoseconds()); got != want {
+		t.Fatalf("pod CPU = %d, want %d", got, want)
+	}
+	if got, want := *podStats.Memory.WorkingSetBytes, uint64(1<<20+3<<29); got != want {
+		t.Fatalf("pod memory = %d, want %d", got, want)
+	}
+	if len(podStats.Containers) != 1 {
+		t.Fatalf("containers = %+v", podStats.Containers)
+	}
+	container := podStats.Containers[0]
+	if container.Name != "main" || *container.CPU.UsageCoreNanoSeconds != 5000000000 || *container.Memory.WorkingSetBytes != 1048576 {
+		t.Fatalf("container stats = %+v", container)
+	}
+	if len(container.Accelerators) != 1 || container.Accelerators[0].DutyCycle != 75 || container.Accelerators[0].MemoryUsed != 512<<20 {
+		t.Fatalf("accelerators = %+v", container.Accelerators)
+	}
+	if len(container.UserDefinedMetrics) != 2 || container.UserDefinedMetrics[0].Value != 2048 || container.UserDefinedMetrics[1].Value != 1024 {
+		t.Fatalf("user defined metrics = %+v", container.UserDefinedMetrics)
+	}
+
+	families, err := provider.GetMetricsResource(context.Background())
+	if err != nil {
+		t.Fatalf("GetMetricsResource returned error: %v", err)
+	}
+	if len(client.commands) != 1 {
+		t.Fatalf("commands = %q, want the sample to be reused", client.commands)
+	}
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	if got := strings.Join(names, ","); !strings.Contains(got, "container_cpu_usage_seconds_total") || !strings.Contains(got, "pod_memory_working_set_bytes") {
+		t.Fatalf("metric families = %q", names)
+	}
+
+	client.setStatus("job-1", "completed")
+	if _, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name); err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	provider.statsMaxAge = time.Nanosecond
+	for i := 0; i < 2; i++ {
+		summary, err = provider.GetStatsSummary(context.Background())
+		if err != nil || len(summary.Pods) != 0 {
+			t.Fatalf("summary after job completed = %+v, %v", summary, err)
+		}
+	}
+	if client.statusCalls != 2 || len(client.commands) != 1 {
+		t.Fatalf("status calls = %d, commands %q, want no scrape of the finished job", client.statusCalls, client.commands)
+	}
+}
+
+type fakePodAnnotator struct {
+	mu          sync.Mutex
+	annotations map[string]map[string]string
+}
+
+func (f *fakePodAnnotator) AnnotatePod(ctx context.Context, namespace, name string, annotations map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.annotations == nil {
+		f.annotations = make(map[string]map[string]string)
+	}
+	f.annotations[namespace+"/"+name] = annotations
+	return nil
+}
+
+func TestFinishedJobAccountingIsRecordedOnPod(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	sacct := `job-1|COMPLETED|m1234|premium|7200|03:00:00|4|2||billing=4,cpu=4,gres/gpu=8,node=2\n` +
+		`job-1.batch|COMPLETED|m1234||7200|00:10.000|4|1|1024K|cpu=4,mem=0,node=1\n` +
+		`job-1.0|COMPLETED|m1234||7100|02:59:50|4|2|2G|cpu=4,node=2\n`
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "completed"},
+		tasks: []superfacility.Task{
+			{ID: "task-1", Status: "completed", Result: `{"status":"ok","output":"job-1|COMPLETING|m1234|premium|7200|03:00:00|4|2||cpu=4\n"}`},
+			{ID: "task-1", Status: "completed", Result: `{"status":"ok","output":"` + sacct + `"}`},
+		},
+	}
+	annotator := &fakePodAnnotator{}
+	recorder := &fakeEventRecorder{}
+	provider := &NerscProvider{
+		sfClient:      client,
+		nodeName:      "perlmutter-vk",
+		podMap:        make(map[string]string),
+		eventRecorder: recorder,
+		podAnnotator:  annotator,
+	}
+	pod := testPod()
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+
+	waitForAccounting := func(commands int) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			provider.mu.RLock()
+			state := provider.jobStateMap[podKey(pod)]
+			reporting, reported := state.accountingReporting, state.accountingReported
+			provider.mu.RUnlock()
+			client.mu.Lock()
+			ran := len(client.commands)
+			client.mu.Unlock()
+			if ran == commands && !reporting {
+				return reported
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("accounting was not reported")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// sacct may still be finishing the job's record, so the report is retried.
+	if _, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name); err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if waitForAccounting(1) {
+		t.Fatal("accounting was reported while sacct showed the job completing")
+	}
+	if _, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name); err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if !waitForAccounting(2) {
+		t.Fatal("accounting was not reported")
+	}
+	if want := "perlmutter: sacct --noheader --parsable2 --jobs='job-1' --format=JobID,State,Account,QOS,ElapsedRaw,TotalCPU,AllocCPUS,NNodes,MaxRSS,AllocTRES"; client.commands[1] != want {
+		t.Fatalf("command = %q, want %q", client.commands[1], want)
+	}
+
+	annotator.mu.Lock()
+	got := annotator.annotations["default/demo"]
+	annotator.mu.Unlock()
+	want := map[string]string{
+		"nersc.sf/elapsed":             "2h0m0s",
+		"nersc.sf/cpuEfficiency":       "37.5%",
+		"nersc.sf/maxRSS":              "2Gi",
+		"nersc.sf/nodeHours":           "4.0000",
+		"nersc.sf/estimatedNERSCHours": "8.0000",
+		"nersc.sf/chargeAccount":       "m1234",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("annotations = %v, want %v", got, want)
+	}
+	recorder.mu.Lock()
+	events := recorder.events
+	recorder.mu.Unlock()
+	if len(events) != 1 || !strings.Contains(events[0], "Normal JobAccounting: Slurm job job-1 ran for 2h0m0s on 2 node(s) with 37.5% CPU efficiency and 2Gi max RSS, charging an estimated 8.0000 NERSC hours to m1234") {
+		t.Fatalf("events = %q", events)
+	}
+}
+
+func TestChargeFactorsDependOnNodeType(t *testing.T) {
+	factors, err := ParseChargeFactors("premium=3, gpu:preempt=0.25", DefaultChargeFactors)
+	if err != nil {
+		t.Fatalf("ParseChargeFactors returned error: %v", err)
+	}
+	want := ChargeFactors{
+		CPU: map[string]float64{"premium": 3, "preempt": 0.5, "overrun": 0},
+		GPU: map[string]float64{"premium": 3, "preempt": 0.25, "overrun": 0},
+	}
+	if !reflect.DeepEqual(factors, want) {
+		t.Fatalf("factors = %+v, want %+v", factors, want)
+	}
+	if DefaultChargeFactors.GPU["preempt"] != 0.5 {
+		t.Fatal("ParseChargeFactors changed its base")
+	}
+	for _, spec := range []string{"premium", "tpu:premium=1", "premium=-1", "gpu:=2"} {
+		if _, err := ParseChargeFactors(spec, DefaultChargeFactors); err == nil {
+			t.Errorf("ParseChargeFactors(%q) returned nil error", spec)
+		}
+	}
+
+	job := jobAccounting{qos: "preempt", nodes: 1, elapsed: 4 * time.Hour}
+	if got := job.nerscHours(factors); got != 2 {
+		t.Fatalf("CPU nerscHours = %v, want 2", got)
+	}
+	job.gpu = true
+	if got := job.nerscHours(factors); got != 1 {
+		t.Fatalf("GPU nerscHours = %v, want 1", got)
+	}
+	job.qos = "regular"
+	if got := job.nerscHours(factors); got != 4 {
+		t.Fatalf("regular nerscHours = %v, want 4", got)
+	}
+}
+
+func TestInterruptedJobIsRequeuedUntilLimit(t *testing.T) {
+	client := &fakeJobClient{
+		submitJobID: "job-0",
+		statusByJob: map[string]string{},
+	}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	script := client.submitReq.Script
+
+	for i := 1; i <= maxJobRequeues; i++ {
+		client.setStatus(fmt.Sprintf("job-%d", i-1), "node_fail")
+		client.submitJobID = fmt.Sprintf("job-%d", i)
+
+		status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+		if err != nil {
+			t.Fatalf("GetPodStatus returned error: %v", err)
+		}
+		if status.Phase != corev1.PodPending || status.Reason != "Requeued" {
+			t.Fatalf("status = %s/%s, want Pending/Requeued", status.Phase, status.Reason)
+		}
+		if jobID, _ := provider.jobIDForPodKey(podKey(pod)); jobID != client.submitJobID {
+			t.Fatalf("tracked job = %s, want %s", jobID, client.submitJobID)
+		}
+		if client.submitReq.Script != script {
+			t.Fatal("requeued job was submitted with a different script")
+		}
+		if len(status.ContainerStatuses) != 1 || status.ContainerStatuses[0].RestartCount != int32(i) {
+			t.Fatalf("container statuses = %+v, want restart count %d", status.ContainerStatuses, i)
+		}
+		condition := status.Conditions[len(status.Conditions)-1]
+		wantMessage := fmt.Sprintf("requeued %d times; Slurm job job-%d ended with state node_fail and was resubmitted as job job-%d", i, i-1, i)
+		if condition.Type != PodJobRequeued || condition.Status != corev1.ConditionTrue || condition.Message != wantMessage {
+			t.Fatalf("condition = %+v, want JobRequeued with message %q", condition, wantMessage)
+		}
+	}
+
+	client.setStatus(fmt.Sprintf("job-%d", maxJobRequeues), "preempted")
+	status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if status.Phase != corev1.PodFailed || status.Reason != "JobInterrupted" {
+		t.Fatalf("status = %s/%s, want Failed/JobInterrupted", status.Phase, status.Reason)
+	}
+	if status.ContainerStatuses[0].RestartCount != maxJobRequeues {
+		t.Fatalf("restart count = %d, want %d", status.ContainerStatuses[0].RestartCount, maxJobRequeues)
+	}
+	if client.submitCount != maxJobRequeues+1 {
+		t.Fatalf("submitCount = %d, want %d", client.submitCount, maxJobRequeues+1)
+	}
+}
+
+func TestGetPodStatusReportsDeadlineExceeded(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "completed"},
+	}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+
+	status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if status.Phase != corev1.PodSucceeded || status.Reason != "" {
+		t.Fatalf("status = %s/%s, want Succeeded without reason", status.Phase, status.Reason)
+	}
+
+	// A job signalled by a deletion or scancel stops its containers but did
+	// not reach its deadline.
+	provider.mu.Lock()
+	provider.jobStateMap[podKey(pod)].deadlineRead = false
+	provider.mu.Unlock()
+	client.appendFile("job-1", "/global/cscratch1/sd/alice/demo/.vk-nersc/terminating", "2024-01-01T00:20:00Z\n")
+	status, err = provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if status.Phase != corev1.PodSucceeded || status.Reason != "" {
+		t.Fatalf("status after a graceful delete = %s/%s, want Succeeded without reason", status.Phase, status.Reason)
+	}
+
+	// The script stopped its containers after Slurm signalled the time limit.
+	provider.mu.Lock()
+	provider.jobStateMap[podKey(pod)].deadlineRead = false
+	provider.mu.Unlock()
+	client.appendFile("job-1", "/global/cscratch1/sd/alice/demo/.vk-nersc/deadline", "2024-01-01T00:30:00Z\n")
+	status, err = provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if status.Phase != corev1.PodFailed || status.Reason != "DeadlineExceeded" {
+		t.Fatalf("status = %s/%s, want Failed/DeadlineExceeded", status.Phase, status.Reason)
+	}
+
+	client.setStatus("job-1", "timeout")
+	provider.mu.Lock()
+	provider.jobStateMap[podKey(pod)].deadlineRead = false
+	provider.mu.Unlock()
+	client.filesByJob = nil
+	status, err = provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if status.Phase != corev1.PodFailed || status.Reason != "DeadlineExceeded" {
+		t.Fatalf("status = %s/%s, want Failed/DeadlineExceeded", status.Phase, status.Reason)
+	}
+}
+
+func TestCreatePodRejectsHTTPLifecycleHooks(t *testing.T) {
+	client := &fakeJobClient{submitJobID: "job-1"}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{
+		PreStop: &corev1.LifecycleHandler{HTTPGet: &corev1.HTTPGetAction{Path: "/shutdown"}},
+	}
+
+	err := provider.CreatePod(context.Background(), pod)
+	if err == nil || !strings.Contains(err.Error(), "httpGet preStop hooks are not supported") {
+		t.Fatalf("CreatePod error = %v, want httpGet hook validation error", err)
+	}
+	if client.submitCount != 0 {
+		t.Fatalf("submitCount = %d, want 0", client.submitCount)
+	}
+}
+
+func podCondition(status *corev1.PodStatus, conditionType corev1.PodConditionType) *corev1.PodCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func TestCreatePodIsIdempotentForTrackedPod(t *testing.T) {
+	client := &fakeJobClient{submitJobID: "job-2"}
+	pod := testPod()
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   map[string]string{podKey(pod): "job-1"},
+	}
+
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	if client.submitCount != 0 {
+		t.Fatalf("submitCount = %d, want 0", client.submitCount)
+	}
+}
+
+func TestCreatePodRetryResolvesAcceptedSubmitTask(t *testing.T) {
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		submitErr:   &superfacility.PendingSubmitError{TaskID: "task-1", Err: errors.New("submit task task-1: unavailable")},
+	}
+	pod := testPod()
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+
+	if err := provider.CreatePod(context.Background(), pod); err == nil {
+		t.Fatal("CreatePod succeeded while the submit task was unresolved")
+	}
+	client.resolveErr = &superfacility.PendingSubmitError{TaskID: "task-1", Err: errors.New("submit task task-1: unavailable")}
+	if err := provider.CreatePod(context.Background(), pod); err == nil {
+		t.Fatal("CreatePod succeeded while the submit task was unresolved")
+	}
+	client.resolveErr = nil
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+
+	want := []string{"submit", "resolve task-1", "resolve task-1"}
+	if client.submitCount != 1 || !reflect.DeepEqual(client.operations, want) {
+		t.Fatalf("operations = %q after %d submits, want %q", client.operations, client.submitCount, want)
+	}
+	if jobID, _ := provider.jobIDForPodKey(podKey(pod)); jobID != "job-1" || len(provider.submitTasks) != 0 {
+		t.Fatalf("tracked job = %q with submit tasks %v, want job-1 and none", jobID, provider.submitTasks)
+	}
+}
+
+func TestDeletePodCancelsJobOfUnresolvedSubmitTask(t *testing.T) {
+	client := &fakeJobClient{submitJobID: "job-1"}
+	pod := testPod()
+	provider := &NerscProvider{
+		sfClient:    client,
+		nodeName:    "perlmutter-vk",
+		podMap:      make(map[string]string),
+		submitTasks: map[string]string{podKey(pod): "task-1"},
+	}
+
+	if err := provider.DeletePod(context.Background(), pod); err != nil {
+		t.Fatalf("DeletePod returned error: %v", err)
+	}
+	if !reflect.DeepEqual(client.cancelledIDs, []string{"job-1"}) || len(provider.submitTasks) != 0 {
+		t.Fatalf("cancelled jobs = %q with submit tasks %v, want job-1 and none", client.cancelledIDs, provider.submitTasks)
+	}
+}
+
+func TestDeletePodKeepsTrackingWhenCancelFails(t *testing.T) {
+	cancelErr := errors.New("cancel unavailable")
+	client := &fakeJobClient{cancelErr: cancelErr}
+	pod := testPod()
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   map[string]string{podKey(pod): "job-1"},
+	}
+
+	err := provider.DeletePod(context.Background(), pod)
+	if !errors.Is(err, cancelErr) {
+		t.Fatalf("DeletePod error = %v, want %v", err, cancelErr)
+	}
+	if jobID, exists := provider.jobIDForPodKey(podKey(pod)); !exists || jobID != "job-1" {
+		t.Fatalf("tracked job = %q, exists %t; want job-1 true", jobID, exists)
+	}
+}
+
+func TestDeletePodTreatsMissingJobAsCancelled(t *testing.T) {
+	client := &fakeJobClient{cancelErr: fmt.Errorf("cancel failed: %w", &superfacility.APIError{StatusCode: 404, Status: "404 Not Found"})}
+	pod := testPod()
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   map[string]string{podKey(pod): "job-1"},
+	}
+
+	if err := provider.DeletePod(context.Background(), pod); err != nil {
+		t.Fatalf("DeletePod returned error: %v", err)
+	}
+	if _, exists := provider.jobIDForPodKey(podKey(pod)); exists {
+		t.Fatal("pod is still tracked after its job was found to be gone")
+	}
+}
+
+func TestRejectedCredentialsAreReportedOnNode(t *testing.T) {
+	client := &fakeJobClient{
+		statusByJob: map[string]string{"job-1": "running"},
+		statusErr:   fmt.Errorf("status failed: %w", &superfacility.APIError{StatusCode: 401, Status: "401 Unauthorized", Body: "token expired"}),
+	}
+	pod := testPod()
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   map[string]string{podKey(pod): "job-1"},
+	}
+	authCondition := func() corev1.NodeCondition {
+		for _, condition := range provider.NodeConditions(context.Background()) {
+			if condition.Type == "SFAPIUnauthorized" {
+				return condition
+			}
+		}
+		t.Fatal("node has no SFAPIUnauthorized condition")
+		return corev1.NodeCondition{}
+	}
+
+	if _, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name); !superfacility.IsUnauthorized(err) {
+		t.Fatalf("GetPodStatus error = %v, want unauthorized", err)
+	}
+	if condition := authCondition(); condition.Status != corev1.ConditionTrue || !strings.Contains(condition.Message, "token expired") {
+		t.Fatalf("condition = %+v, want credentials rejected", condition)
+	}
+
+	client.mu.Lock()
+	client.statusErr = nil
+	client.mu.Unlock()
+	if _, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name); err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if condition := authCondition(); condition.Status != corev1.ConditionFalse {
+		t.Fatalf("condition = %+v, want credentials accepted", condition)
+	}
+}
+
+func TestCreatePodRequiresContainer(t *testing.T) {
+	provider := &NerscProvider{
+		sfClient: &fakeJobClient{},
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "empty", Namespace: "default"}}
+
+	err := provider.CreatePod(context.Background(), pod)
+	if err == nil || !strings.Contains(err.Error(), "has no containers") {
+		t.Fatalf("error = %v, want no containers", err)
+	}
+}
+
+func TestCreatePodStagesInputBeforeSubmittingJob(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		transferID:  "input-transfer",
+		transferResults: map[string][]superfacility.GlobusTransferResult{
+			"input-transfer": {{GlobusUUID: "input-transfer", Status: "SUCCEEDED"}},
+		},
+	}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	pod.Annotations[annotationInputSource] = "globus://dtn/global/cfs/cdirs/m1234/input"
+	pod.Annotations[annotationInputVolume] = "data"
+	pod.Spec.Volumes = []corev1.Volume{{Name: "data"}, {Name: "work"}}
+	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/mnt/data"}}
+
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	if got, want := strings.Join(client.operations, ","), "start-transfer,check-transfer,submit"; got != want {
+		t.Fatalf("operations = %s, want %s", got, want)
+	}
+	if len(client.transferReqs) != 1 {
+		t.Fatalf("transfer request count = %d, want 1", len(client.transferReqs))
+	}
+	req := client.transferReqs[0]
+	if req.SourceUUID != "dtn" || req.TargetUUID != "perlmutter" {
+		t.Fatalf("endpoints = %s -> %s, want dtn -> perlmutter", req.SourceUUID, req.TargetUUID)
+	}
+	if req.SourceDir != "/global/cfs/cdirs/m1234/input" {
+		t.Fatalf("source dir = %q", req.SourceDir)
+	}
+	if req.TargetDir != "/global/cscratch1/sd/alice/demo/data" {
+		t.Fatalf("target dir = %q", req.TargetDir)
+	}
+}
+
+func TestGetPodStatusStagesOutputAfterJobSucceeds(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "completed"},
+		transferID:  "output-transfer",
+		transferResults: map[string][]superfacility.GlobusTransferResult{
+			"output-transfer": {{GlobusUUID: "output-transfer", Status: "SUCCEEDED"}},
+		},
+	}
+	provider := &NerscProvider{
+		sfClient: client,
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	pod.Annotations[annotationStageOut] = "true"
+	pod.Annotations[annotationOutputDest] = "globus://dtn/global/cfs/cdirs/m1234/output"
+	pod.Annotations[annotationOutputVolume] = "results"
+	pod.Spec.Volumes = []corev1.Volume{{Name: "data"}, {Name: "results"}}
+	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "results", MountPath: "/mnt/results"}}
+
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if status.Phase != corev1.PodSucceeded || status.Reason != "StageOutComplete" {
+		t.Fatalf("status = %s/%s, want Succeeded/StageOutComplete", status.Phase, status.Reason)
+	}
+	if len(client.transferReqs) != 1 {
+		t.Fatalf("transfer request count = %d, want 1", len(client.transferReqs))
+	}
+	req := client.transferReqs[0]
+	if req.SourceUUID != "perlmutter" || req.TargetUUID != "dtn" {
+		t.Fatalf("endpoints = %s -> %s, want perlmutter -> dtn", req.SourceUUID, req.TargetUUID)
+	}
+	if req.SourceDir != "/global/cscratch1/sd/alice/demo/results" {
+		t.Fatalf("source dir = %q", req.SourceDir)
+	}
+	if req.TargetDir != "/global/cfs/cdirs/m1234/output" {
+		t.Fatalf("target dir = %q", req.TargetDir)
+	}
+}
+
+func TestDeletePodSignalsJobAndStagesOutWhenItExitsWithinGracePeriod(t *testing.T) {
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+		transferID:  "output-transfer",
+		transferResults: map[string][]superfacility.GlobusTransferResult{
+			"output-transfer": {{GlobusUUID: "output-transfer", Status: "ACTIVE"}},
+		},
+	}
+	client.onSignal = func() { client.setStatus("job-1", "completed") }
+	provider := &NerscProvider{
+		sfClient:             client,
+		nodeName:             "perlmutter-vk",
+		podMap:               make(map[string]string),
+		shutdownPollInterval: time.Millisecond,
+	}
+	pod := testPod()
+	pod.Annotations[annotationStageOut] = "true"
+	pod.Annotations[annotationOutputDest] = "globus://dtn/global/cfs/cdirs/m1234/output"
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+
+	if err := provider.DeletePod(context.Background(), pod); err != nil {
+		t.Fatalf("DeletePod returned error: %v", err)
+	}
+	provider.stopping.Wait()
+	if len(client.signals) != 1 || client.signals[0].Signal != "TERM" || !client.signals[0].Batch {
+		t.Fatalf("signals = %+v, want one TERM to the batch script", client.signals)
+	}
+	if len(client.cancelledIDs) != 0 {
+		t.Fatalf("cancelledIDs = %+v, want none", client.cancelledIDs)
+	}
+	if len(client.transferReqs) != 1 {
+		t.Fatalf("transfer request count = %d, want 1", len(client.transferReqs))
+	}
+	if _, exists := provider.jobIDForPodKey(podKey(pod)); exists {
+		t.Fatal("pod job remained tracked after successful delete")
+	}
+}
+
+func TestDeletePodCancelsJobAfterGracePeriod(t *testing.T) {
+	client := &fakeJobClient{
+		submitJobID: "job-1",
+		statusByJob: map[string]string{"job-1": "running"},
+	}
+	provider := &NerscProvider{
+		sfClient:             client,
+		nodeName:             "perlmutter-vk",
+		podMap:               make(map[string]string),
+		shutdownPollInterval: time.Millisecond,
+	}
+	pod := testPod()
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	grace := int64(1)
+	pod.DeletionGracePeriodSeconds = &grace
+
+	start := time.Now()
+	if err := provider.DeletePod(context.Background(), pod); err != nil {
+		t.Fatalf("DeletePod returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("DeletePod returned after %s, want it not to wait out the grace period", elapsed)
+	}
+	if _, exists := provider.jobIDForPodKey(podKey(pod)); exists {
+		t.Fatal("pod job remained tracked during its grace period")
+	}
+	client.mu.Lock()
+	cancelled := len(client.cancelledIDs)
+	client.mu.Unlock()
+	if cancelled != 0 {
+		t.Fatalf("job cancelled before its grace period ended")
+	}
+
+	provider.stopping.Wait()
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("job cancelled after %s, want at least the grace period", elapsed)
+	}
+	if len(client.signals) != 1 {
+		t.Fatalf("signal count = %d, want 1", len(client.signals))
+	}
+	if len(client.cancelledIDs) != 1 || client.cancelledIDs[0] != "job-1" {
+		t.Fatalf("cancelledIDs = %+v, want [job-1]", client.cancelledIDs)
+	}
+}
+
+// fakeNERSCAPI serves the parts of NERSC's Superfacility API the provider
+// uses for one job: submission and sacct queries, task polling, login node
+// commands and file downloads.
+type fakeNERSCAPI struct {
+	mu       sync.Mutex
+	state    string
+	files    map[string]string
+	tasks    []string
+	commands []string
+	requests []string
+}
+
+func (f *fakeNERSCAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	write := func(v any) {
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			panic(err)
+		}
+	}
+	newTask := func(result string) {
+		f.tasks = append(f.tasks, result)
+		write(map[string]string{"task_id": strconv.Itoa(len(f.tasks)), "status": "OK"})
+	}
+
+	switch path := strings.TrimPrefix(r.URL.Path, "/api/v1.2/"); {
+	case r.Method == http.MethodPost && path == "compute/jobs/perlmutter":
+		f.state = "RUNNING"
+		newTask(`{"status": "ok", "jobid": 77}`)
+	case r.Method == http.MethodGet && path == "compute/jobs/perlmutter/77":
+		write(map[string]any{"status": "OK", "output": []map[string]string{{"jobid": "77", "state": f.state, "exitcode": "0:0"}}})
+	case r.Method == http.MethodDelete && path == "compute/jobs/perlmutter/77":
+		f.state = "CANCELLED"
+		write(map[string]string{"status": "OK"})
+	case r.Method == http.MethodPost && path == "utilities/command/perlmutter":
+		command := r.FormValue("executable")
+		if output, ok := f.readFile(command); ok {
+			result, _ := json.Marshal(superfacility.CommandResult{Status: "ok", Output: output})
+			newTask(string(result))
+			return
+		}
+		f.commands = append(f.commands, command)
+		if strings.HasPrefix(command, "scancel --signal=TERM") {
+			f.state = "COMPLETED"
+		}
+		newTask(`{"status": "ok", "output": "", "error": null}`)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "tasks/"):
+		id, _ := strconv.Atoi(strings.TrimPrefix(path, "tasks/"))
+		if id < 1 || id > len(f.tasks) {
+			http.NotFound(w, r)
+			return
+		}
+		write(map[string]string{"id": strconv.Itoa(id), "status": "completed", "result": f.tasks[id-1]})
+	default:
+		http.Error(w, "unexpected request", http.StatusNotFound)
+	}
+}
+
+var readFileCommandPattern = regexp.MustCompile(`(?s)^f='([^']*)' o=(-?\d+)\n.*head -c (\d+) \| base64$`)
+
+// readFile answers a command that reads a range of one of the files.
+func (f *fakeNERSCAPI) readFile(command string) (string, bool) {
+	m := readFileCommandPattern.FindStringSubmatch(command)
+	if m == nil {
+		return "", false
+	}
+	data, ok := f.files[m[1]]
+	if !ok {
+		return "missing\n", true
+	}
+	offset, _ := strconv.ParseInt(m[2], 10, 64)
+	count, _ := strconv.ParseInt(m[3], 10, 64)
+	size := int64(len(data))
+	if offset < 0 {
+		offset = max(size+offset, 0)
+	}
+	offset = min(offset, size)
+	end := min(offset+count, size)
+	return fmt.Sprintf("%d %d\n%s\n", offset, size, base64.StdEncoding.EncodeToString([]byte(data[offset:end]))), true
+}
+
+func TestProviderSpeaksNERSCDialect(t *testing.T) {
+	t.Setenv("USER", "alice")
+
+	api := &fakeNERSCAPI{files: map[string]string{
+		"/global/cscratch1/sd/alice/demo/.vk-nersc/main.out":     "hello\n",
+		"/global/cscratch1/sd/alice/demo/.vk-nersc/main.err":     "",
+		"/global/cscratch1/sd/alice/demo/.vk-nersc/status.jsonl": "",
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	provider, err := NewNerscProvider(server.URL+"/api/v1.2", "token", "perlmutter-vk")
+	if err != nil {
+		t.Fatalf("NewNerscProvider returned error: %v", err)
+	}
+	provider.shutdownPollInterval = time.Millisecond
+	pod := testPod()
+
+	if err := provider.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("CreatePod returned error: %v", err)
+	}
+	status, err := provider.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatalf("GetPodStatus returned error: %v", err)
+	}
+	if status.Phase != corev1.PodRunning {
+		t.Fatalf("phase = %s, want Running", status.Phase)
+	}
+
+	logs, err := provider.GetContainerLogs(context.Background(), pod.Namespace, pod.Name, "main", nil)
+	if err != nil {
+		t.Fatalf("GetContainerLogs returned error: %v", err)
+	}
+	data, err := io.ReadAll(logs)
+	logs.Close()
+	if err != nil || string(data) != "hello\n" {
+		t.Fatalf("logs = %q, %v, want hello newline", data, err)
+	}
+
+	if err := provider.DeletePod(context.Background(), pod); err != nil {
+		t.Fatalf("DeletePod returned error: %v", err)
+	}
+	provider.stopping.Wait()
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if want := []string{"scancel --signal=TERM --batch '77'"}; !reflect.DeepEqual(api.commands, want) {
+		t.Fatalf("commands = %q, want %q", api.commands, want)
+	}
+	for _, request := range api.requests {
+		if strings.HasPrefix(request, http.MethodDelete) || strings.Contains(request, "/jobs/77/") {
+			t.Fatalf("request %s bypasses the NERSC API", request)
+		}
+	}
+}
+
+func TestCreatePodRequiresStageVolumeWhenStagingWithMultipleVolumes(t *testing.T) {
+	provider := &NerscProvider{
+		sfClient: &fakeJobClient{},
+		nodeName: "perlmutter-vk",
+		podMap:   make(map[string]string),
+	}
+	pod := testPod()
+	pod.Annotations[annotationInputSource] = "globus://dtn/global/cfs/cdirs/m1234/input"
+	pod.Spec.Volumes = []corev1.Volume{{Name: "data"}, {Name: "work"}}
+
+	err := provider.CreatePod(context.Background(), pod)
+	if err == nil || !strings.Contains(err.Error(), annotationStageVolume) {
+		t.Fatalf("error = %v, want stage volume requirement", err)
+	}
+}
+
+func readContainerLogs(t *testing.T, provider *NerscProvider, pod *corev1.Pod, container string, opts *corev1.PodLogOptions) string {
+	t.Helper()
+	logs, err := provider.GetContainerLogs(context.Background(), pod.Namespace, pod.Name, container, opts)
+	if err != nil {
+		t.Fatalf("GetContainerLogs returned error: %v", err)
+	}
+	defer logs.Close()
+	data, err := io.ReadAll(logs)
+	if err != nil {
+		t.Fatalf("read logs: %v", err)
 	}
+	return string(data)
 }
 
 func testPod() *corev1.Pod {
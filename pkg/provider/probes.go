@@ -0,0 +1,162 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"vk-provider-nersc/pkg/scripts"
+)
+
+const maxProbeLogRead = 64 << 10
+
+// EventRecorder records Kubernetes events. record.EventRecorder from
+// client-go satisfies it.
+type EventRecorder interface {
+	Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{})
+}
+
+// probeStatus is what the probe log says about the current run of a
+// container.
+type probeStatus struct {
+	startupPassed   bool
+	readinessPassed bool
+}
+
+// setProbeStatus sets Started and Ready for a running container from its
+// probes. Without a startup probe a container counts as started, and without
+// a readiness probe a started container counts as ready.
+func (s *podJobState) setProbeStatus(containerStatus *corev1.ContainerStatus) {
+	if containerStatus.State.Running == nil {
+		return
+	}
+	probes := s.probeKinds[containerStatus.Name]
+	s.probeMu.Lock()
+	status := s.probeStatuses[containerStatus.Name]
+	s.probeMu.Unlock()
+	started := !probes[scripts.ProbeStartup] || status.startupPassed
+	containerStatus.Started = &started
+	containerStatus.Ready = started && (!probes[scripts.ProbeReadiness] || status.readinessPassed)
+}
+
+// readProbeLog reads the probe log entries appended since the last poll.
+func (p *NerscProvider) readProbeLog(ctx context.Context, jobID string, state *podJobState) {
+	if len(state.probeKinds) == 0 {
+		return
+	}
+	state.probeMu.Lock()
+	defer state.probeMu.Unlock()
+
+	path := state.containerFile(scripts.ProbeLogFile)
+	chunk, err := p.sfClient.FetchJobLogRange(ctx, jobID, path, state.probeOffset, maxProbeLogRead)
+	if err == nil && chunk.Size < state.probeOffset {
+		// The log was emptied because Slurm requeued the job.
+		state.probeOffset = 0
+		state.probeStatuses = nil
+		chunk, err = p.sfClient.FetchJobLogRange(ctx, jobID, path, 0, maxProbeLogRead)
+	}
+	if err != nil {
+		log.Printf("Failed to read probe log for job %s: %v", jobID, err)
+		return
+	}
+
+	// A line still being written is read on the next poll.
+	data := chunk.Data[:bytes.LastIndexByte(chunk.Data, '\n')+1]
+	state.probeOffset = chunk.Offset + int64(len(data))
+	if state.probeStatuses == nil {
+		state.probeStatuses = make(map[string]probeStatus)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var result scripts.ProbeResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil || result.Name == "" {
+			continue
+		}
+		p.applyProbeResult(state, result)
+	}
+}
+
+func (p *NerscProvider) applyProbeResult(state *podJobState, result scripts.ProbeResult) {
+	status := state.probeStatuses[result.Name]
+	switch result.Probe {
+	case scripts.ProbeContainerStart:
+		status = probeStatus{}
+	case scripts.ProbeStartup:
+		status.startupPassed = result.Success
+	case scripts.ProbeReadiness:
+		if result.Success {
+			status.readinessPassed = true
+		} else if result.Failed {
+			status.readinessPassed = false
+		}
+	}
+	state.probeStatuses[result.Name] = status
+
+	if result.Success {
+		return
+	}
+	message := probeName(result.Probe) + " probe failed"
+	if result.Message != "" {
+		message += ": " + result.Message
+	}
+	p.recordContainerEvent(state, result.Name, corev1.EventTypeWarning, "Unhealthy", message)
+	if result.Failed && result.Probe != scripts.ProbeReadiness {
+		p.recordContainerEvent(state, result.Name, corev1.EventTypeNormal, "Killing",
+			fmt.Sprintf("Container %s failed %s probe, will be restarted", result.Name, result.Probe))
+	}
+}
+
+func probeName(kind string) string {
+	if kind == "" {
+		return kind
+	}
+	return strings.ToUpper(kind[:1]) + kind[1:]
+}
+
+// recordContainerEvent records an event about a container of the pod, if
+// the provider has an event recorder.
+func (p *NerscProvider) recordContainerEvent(state *podJobState, container, eventType, reason, message string) {
+	if p.eventRecorder == nil {
+		return
+	}
+	ref := state.podRef
+	ref.FieldPath = fmt.Sprintf("spec.containers{%s}", container)
+	for _, name := range state.initContainers {
+		if name == container {
+			ref.FieldPath = fmt.Sprintf("spec.initContainers{%s}", container)
+		}
+	}
+	p.eventRecorder.Eventf(&ref, eventType, reason, "%s", message)
+}
+
+// readyConditions reports the ContainersReady and Ready conditions. The
+// pod is ready while it runs and all of its regular containers are ready.
+func readyConditions(phase corev1.PodPhase, containerStatuses []corev1.ContainerStatus) []corev1.PodCondition {
+	condition := corev1.PodCondition{Status: corev1.ConditionTrue}
+	var notReady []string
+	for _, containerStatus := range containerStatuses {
+		if !containerStatus.Ready {
+			notReady = append(notReady, containerStatus.Name)
+		}
+	}
+	switch {
+	case phase == corev1.PodSucceeded:
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "PodCompleted"
+	case phase != corev1.PodRunning || len(notReady) > 0:
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "ContainersNotReady"
+		condition.Message = fmt.Sprintf("containers with unready status: [%s]", strings.Join(notReady, " "))
+	}
+	containersReady, ready := condition, condition
+	containersReady.Type = corev1.ContainersReady
+	ready.Type = corev1.PodReady
+	return []corev1.PodCondition{containersReady, ready}
+}
@@ -0,0 +1,101 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// maxJobRequeues bounds how many times a pod is resubmitted after its job
+// was interrupted by Slurm rather than failing on its own.
+const maxJobRequeues = 3
+
+// PodJobRequeued is the pod condition that reports that the provider
+// resubmitted the pod's job after Slurm interrupted it.
+const PodJobRequeued corev1.PodConditionType = "nersc.sf/JobRequeued"
+
+// jobInterrupted reports whether Slurm ended the job without requeueing it.
+func jobInterrupted(status string) bool {
+	switch strings.ToLower(status) {
+	case "preempted", "node_fail", "boot_fail":
+		return true
+	default:
+		return false
+	}
+}
+
+// requeueJob resubmits an interrupted job and reports the pod as pending.
+func (p *NerscProvider) requeueJob(ctx context.Context, key, jobID, jobStatus string) corev1.PodStatus {
+	state := p.jobStateForPodKey(key)
+	p.mu.RLock()
+	requeues := 0
+	if state != nil {
+		requeues = state.requeues
+	}
+	p.mu.RUnlock()
+
+	if state == nil || state.submitReq.Script == "" || requeues >= maxJobRequeues {
+		status := p.podStatusForJob(ctx, key, jobID, corev1.PodFailed)
+		status.Reason = "JobInterrupted"
+		status.Message = fmt.Sprintf("Slurm job %s ended with state %s after %d requeues", jobID, jobStatus, requeues)
+		return status
+	}
+
+	newJobID, err := p.submitJob(ctx, key, state.submitReq)
+	if err != nil {
+		log.Printf("Failed to requeue pod %s after job %s ended with state %s: %v", key, jobID, jobStatus, err)
+		return corev1.PodStatus{
+			Phase:   corev1.PodPending,
+			Reason:  "Requeueing",
+			Message: fmt.Sprintf("Slurm job %s ended with state %s and could not be resubmitted: %v", jobID, jobStatus, err),
+		}
+	}
+
+	p.mu.Lock()
+	if p.podMap[key] != jobID || p.jobStateMap[key] != state {
+		// The pod was deleted or already requeued by a concurrent poll.
+		p.mu.Unlock()
+		if cancelErr := p.cancelJob(ctx, newJobID); cancelErr != nil {
+			log.Printf("Failed to cancel duplicate requeued job %s for pod %s: %v", newJobID, key, cancelErr)
+		}
+		return corev1.PodStatus{Phase: corev1.PodPending, Reason: "Requeued"}
+	}
+	p.podMap[key] = newJobID
+	state.requeues++
+	state.lastRequeue = fmt.Sprintf("Slurm job %s ended with state %s and was resubmitted as job %s", jobID, jobStatus, newJobID)
+	state.results = nil
+	state.usage, state.lastUsage = nil, nil
+	state.probeMu.Lock()
+	state.probeOffset = 0
+	state.probeStatuses = nil
+	state.probeMu.Unlock()
+	p.mu.Unlock()
+
+	log.Printf("Pod %s requeued as job %s after job %s ended with state %s", key, newJobID, jobID, jobStatus)
+	status := p.podStatusForJob(ctx, key, newJobID, corev1.PodPending)
+	status.Reason = "Requeued"
+	status.Message = fmt.Sprintf("Slurm job %s ended with state %s and was resubmitted as job %s", jobID, jobStatus, newJobID)
+	return status
+}
+
+// setRequeues counts the pod's requeues as restarts of every container.
+func setRequeues(status *corev1.PodStatus, requeues int, lastRequeue string) {
+	if requeues == 0 {
+		return
+	}
+	for i := range status.InitContainerStatuses {
+		status.InitContainerStatuses[i].RestartCount += int32(requeues)
+	}
+	for i := range status.ContainerStatuses {
+		status.ContainerStatuses[i].RestartCount += int32(requeues)
+	}
+	status.Conditions = append(status.Conditions, corev1.PodCondition{
+		Type:    PodJobRequeued,
+		Status:  corev1.ConditionTrue,
+		Reason:  "Requeued",
+		Message: fmt.Sprintf("requeued %d times; %s", requeues, lastRequeue),
+	})
+}
@@ -0,0 +1,129 @@
+package provider
+
+import (
+	"context"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"vk-provider-nersc/pkg/superfacility"
+)
+
+const (
+	defaultShutdownPollInterval = 2 * time.Second
+	// shutdownCancelTimeout bounds cancelling a job that did not exit within
+	// its grace period.
+	shutdownCancelTimeout = time.Minute
+)
+
+// deletionGracePeriod returns how long a deleted pod is given to shut down.
+func deletionGracePeriod(pod *corev1.Pod) time.Duration {
+	seconds := int64(corev1.DefaultTerminationGracePeriodSeconds)
+	if pod.DeletionGracePeriodSeconds != nil {
+		seconds = *pod.DeletionGracePeriodSeconds
+	} else if pod.Spec.TerminationGracePeriodSeconds != nil {
+		seconds = *pod.Spec.TerminationGracePeriodSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// stopJobGracefully sends SIGTERM to a running job and reports whether it did.
+func (p *NerscProvider) stopJobGracefully(ctx context.Context, key, jobID string, grace time.Duration) bool {
+	if grace <= 0 {
+		return false
+	}
+	status, err := p.sfClient.GetJobStatus(ctx, jobID)
+	if err != nil {
+		log.Printf("Failed to get status for job %s of deleted pod %s: %v", jobID, key, err)
+		return false
+	}
+	if mapJobStatusToPodPhase(status) != corev1.PodRunning {
+		return false
+	}
+
+	if err := p.sfClient.SignalJob(ctx, jobID, superfacility.JobSignalRequest{Signal: "TERM", Batch: true}); err != nil {
+		log.Printf("Failed to signal job %s for pod %s: %v", jobID, key, err)
+		return false
+	}
+	log.Printf("Signalled job %s for pod %s, giving it %s to exit", jobID, key, grace)
+
+	stageOut := p.pendingStageOut(key)
+	p.stopping.Add(1)
+	go func() {
+		defer p.stopping.Done()
+		p.awaitJobExit(key, jobID, grace, stageOut)
+	}()
+	return true
+}
+
+// awaitJobExit cancels a signalled job that is still running after grace.
+func (p *NerscProvider) awaitJobExit(key, jobID string, grace time.Duration, stageOut *superfacility.GlobusTransferRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace+shutdownCancelTimeout)
+	defer cancel()
+
+	pollInterval := p.shutdownPollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultShutdownPollInterval
+	}
+	deadline := time.NewTimer(grace)
+	defer deadline.Stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline.C:
+			log.Printf("Job %s for deleted pod %s did not exit within %s, cancelling it", jobID, key, grace)
+			if err := p.cancelJob(ctx, jobID); err != nil {
+				log.Printf("Failed to cancel job %s for deleted pod %s: %v", jobID, key, err)
+			}
+			return
+		case <-ticker.C:
+		}
+
+		status, err := p.sfClient.GetJobStatus(ctx, jobID)
+		if err != nil {
+			log.Printf("Failed to get status for job %s of deleted pod %s: %v", jobID, key, err)
+			continue
+		}
+		switch mapJobStatusToPodPhase(status) {
+		case corev1.PodSucceeded:
+			log.Printf("Job %s for deleted pod %s exited within its grace period", jobID, key)
+			p.stageOutDeletedPod(ctx, key, stageOut)
+			return
+		case corev1.PodFailed:
+			log.Printf("Job %s for deleted pod %s exited within its grace period", jobID, key)
+			return
+		}
+	}
+}
+
+// pendingStageOut returns the output transfer a pod still has to start, if
+// any.
+func (p *NerscProvider) pendingStageOut(key string) *superfacility.GlobusTransferRequest {
+	staging := p.stagingForPodKey(key)
+	if staging == nil || staging.outputRequest == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if staging.outputStatus != transferNotStarted {
+		return nil
+	}
+	req := *staging.outputRequest
+	return &req
+}
+
+// stageOutDeletedPod starts the output transfer of a cleanly exited pod.
+func (p *NerscProvider) stageOutDeletedPod(ctx context.Context, key string, req *superfacility.GlobusTransferRequest) {
+	if req == nil {
+		return
+	}
+	transfer, err := p.sfClient.StartGlobusTransfer(ctx, *req)
+	p.noteAPIResult(err)
+	if err != nil {
+		log.Printf("Failed to start output transfer of deleted pod %s: %v", key, err)
+		return
+	}
+	log.Printf("Deleted pod %s output stage-out started as Globus transfer %s", key, transfer.TransferID())
+}
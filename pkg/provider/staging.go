@@ -161,14 +161,15 @@ func (p *NerscProvider) startAndWaitForTransfer(ctx context.Context, req superfa
 
 	for {
 		result, err := p.sfClient.CheckGlobusTransfer(waitCtx, transferID)
-		if err != nil {
+		p.noteAPIResult(err)
+		if err != nil && !transientAPIError(err) {
 			return transferID, err
 		}
-		done, failed := result.IsComplete()
-		if done && failed {
+		if err != nil {
+			log.Printf("Failed to check Globus transfer %s, retrying: %v", transferID, err)
+		} else if done, failed := result.IsComplete(); done && failed {
 			return transferID, fmt.Errorf("globus transfer %s failed: %s", transferID, result.Summary())
-		}
-		if done {
+		} else if done {
 			return transferID, nil
 		}
 
@@ -196,6 +197,11 @@ func (p *NerscProvider) reconcileStageOut(ctx context.Context, key string) corev
 	if status == transferNotStarted {
 		p.setStageOutStatus(key, transferStarting, "", "")
 		transfer, err := p.sfClient.StartGlobusTransfer(ctx, req)
+		p.noteAPIResult(err)
+		if transientAPIError(err) {
+			p.setStageOutStatus(key, transferNotStarted, "", "")
+			return podStatus(corev1.PodRunning, "StageOutStarting", fmt.Sprintf("Waiting to start output transfer: %v", err))
+		}
 		if err != nil {
 			msg := fmt.Sprintf("start output transfer: %v", err)
 			p.setStageOutStatus(key, transferFailed, "", msg)
@@ -207,6 +213,10 @@ func (p *NerscProvider) reconcileStageOut(ctx context.Context, key string) corev
 	}
 
 	result, err := p.sfClient.CheckGlobusTransfer(ctx, transferID)
+	p.noteAPIResult(err)
+	if transientAPIError(err) {
+		return podStatus(corev1.PodRunning, "StageOutRunning", fmt.Sprintf("Output transfer %s is still running; its status could not be checked: %v", transferID, err))
+	}
 	if err != nil {
 		msg := fmt.Sprintf("check output transfer %s: %v", transferID, err)
 		p.setStageOutStatus(key, transferFailed, transferID, msg)
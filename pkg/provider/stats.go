@@ -0,0 +1,475 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api/statsv1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"vk-provider-nersc/pkg/scripts"
+)
+
+// defaultStatsMaxAge is how long a usage sample is reused. Each sample runs
+// a command through the Superfacility API, so jobs are not sampled on every
+// metrics scrape.
+const defaultStatsMaxAge = 30 * time.Second
+
+// usageSample is one sample of a running job's resource usage. CPU, memory
+// and disk I/O cover every step of the job, as reported by sstat. GPU usage
+// is only known when Slurm gathers it. Containers holds podman-hpc stats by
+// container name, when they could be read.
+type usageSample struct {
+	time       time.Time
+	cpu        time.Duration
+	memory     uint64
+	diskRead   uint64
+	diskWrite  uint64
+	gpuUtil    *uint64
+	gpuMemory  *uint64
+	containers map[string]containerUsage
+}
+
+type containerUsage struct {
+	cpu    time.Duration
+	memory uint64
+}
+
+// GetStatsSummary reports the resource usage of running pods in the kubelet
+// summary format, for kubectl top and the metrics-server.
+func (p *NerscProvider) GetStatsSummary(ctx context.Context) (*statsv1alpha1.Summary, error) {
+	p.sampleUsage(ctx)
+
+	summary := &statsv1alpha1.Summary{
+		Node: statsv1alpha1.NodeStats{
+			NodeName:  p.nodeName,
+			StartTime: metav1.NewTime(p.startTime),
+		},
+	}
+	var nodeCPU, nodeNanoCores, nodeMemory uint64
+	var nodeTime time.Time
+	for _, pod := range p.podUsages() {
+		podStats := pod.stats()
+		summary.Pods = append(summary.Pods, podStats)
+		nodeCPU += *podStats.CPU.UsageCoreNanoSeconds
+		if podStats.CPU.UsageNanoCores != nil {
+			nodeNanoCores += *podStats.CPU.UsageNanoCores
+		}
+		nodeMemory += *podStats.Memory.WorkingSetBytes
+		if pod.usage.time.After(nodeTime) {
+			nodeTime = pod.usage.time
+		}
+	}
+	if len(summary.Pods) > 0 {
+		summary.Node.CPU = &statsv1alpha1.CPUStats{
+			Time:                 metav1.NewTime(nodeTime),
+			UsageNanoCores:       &nodeNanoCores,
+			UsageCoreNanoSeconds: &nodeCPU,
+		}
+		summary.Node.Memory = &statsv1alpha1.MemoryStats{
+			Time:            metav1.NewTime(nodeTime),
+			UsageBytes:      &nodeMemory,
+			WorkingSetBytes: &nodeMemory,
+		}
+	}
+	return summary, nil
+}
+
+// GetMetricsResource reports the same usage as GetStatsSummary in the
+// format of the kubelet's /metrics/resource endpoint, which the
+// metrics-server reads.
+func (p *NerscProvider) GetMetricsResource(ctx context.Context) ([]*dto.MetricFamily, error) {
+	summary, err := p.GetStatsSummary(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	families := map[string]*dto.MetricFamily{}
+	add := func(name, help string, metricType dto.MetricType, value float64, at time.Time, labels ...string) {
+		family, ok := families[name]
+		if !ok {
+			family = &dto.MetricFamily{Name: &name, Help: &help, Type: &metricType}
+			families[name] = family
+		}
+		metric := &dto.Metric{TimestampMs: int64Ptr(at.UnixMilli())}
+		for i := 0; i+1 < len(labels); i += 2 {
+			metric.Label = append(metric.Label, &dto.LabelPair{Name: &labels[i], Value: &labels[i+1]})
+		}
+		if metricType == dto.MetricType_COUNTER {
+			metric.Counter = &dto.Counter{Value: &value}
+		} else {
+			metric.Gauge = &dto.Gauge{Value: &value}
+		}
+		family.Metric = append(family.Metric, metric)
+	}
+
+	if cpu := summary.Node.CPU; cpu != nil {
+		add("node_cpu_usage_seconds_total", "Cumulative cpu time consumed by the node in core-seconds", dto.MetricType_COUNTER, nanosToSeconds(*cpu.UsageCoreNanoSeconds), cpu.Time.Time)
+		add("node_memory_working_set_bytes", "Current working set of the node in bytes", dto.MetricType_GAUGE, float64(*summary.Node.Memory.WorkingSetBytes), summary.Node.Memory.Time.Time)
+	}
+	for _, pod := range summary.Pods {
+		add("pod_cpu_usage_seconds_total", "Cumulative cpu time consumed by the pod in core-seconds", dto.MetricType_COUNTER, nanosToSeconds(*pod.CPU.UsageCoreNanoSeconds), pod.CPU.Time.Time,
+			"namespace", pod.PodRef.Namespace, "pod", pod.PodRef.Name)
+		add("pod_memory_working_set_bytes", "Current working set of the pod in bytes", dto.MetricType_GAUGE, float64(*pod.Memory.WorkingSetBytes), pod.Memory.Time.Time,
+			"namespace", pod.PodRef.Namespace, "pod", pod.PodRef.Name)
+		for _, container := range pod.Containers {
+			if container.CPU == nil {
+				continue
+			}
+			labels := []string{"container", container.Name, "namespace", pod.PodRef.Namespace, "pod", pod.PodRef.Name}
+			add("container_cpu_usage_seconds_total", "Cumulative cpu time consumed by the container in core-seconds", dto.MetricType_COUNTER, nanosToSeconds(*container.CPU.UsageCoreNanoSeconds), container.CPU.Time.Time, labels...)
+			add("container_memory_working_set_bytes", "Current working set of the container in bytes", dto.MetricType_GAUGE, float64(*container.Memory.WorkingSetBytes), container.Memory.Time.Time, labels...)
+			add("container_start_time_seconds", "Start time of the container since unix epoch in seconds", dto.MetricType_GAUGE, float64(container.StartTime.Unix()), container.CPU.Time.Time, labels...)
+		}
+	}
+	add("scrape_error", "1 if there was an error while getting container metrics, 0 otherwise", dto.MetricType_GAUGE, 0, time.Now())
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		out = append(out, families[name])
+	}
+	return out, nil
+}
+
+// sampleUsage samples every job that the last status poll found running
+// and whose last sample is older than the provider's stats max age. Jobs are
+// sampled concurrently, and a call made while another is sampling uses the
+// existing samples.
+func (p *NerscProvider) sampleUsage(ctx context.Context) {
+	if !p.statsMu.TryLock() {
+		return
+	}
+	defer p.statsMu.Unlock()
+
+	maxAge := p.statsMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultStatsMaxAge
+	}
+	var wg sync.WaitGroup
+	for key, jobID := range p.podJobsSnapshot() {
+		state := p.jobStateForPodKey(key)
+		if state == nil {
+			continue
+		}
+		p.mu.Lock()
+		if state.polledJobID != jobID || state.polledPhase != corev1.PodRunning {
+			state.usage, state.lastUsage = nil, nil
+			p.mu.Unlock()
+			continue
+		}
+		last := state.usage
+		p.mu.Unlock()
+		if last != nil && time.Since(last.time) < maxAge {
+			continue
+		}
+
+		wg.Add(1)
+		go func(key, jobID string, state *podJobState) {
+			defer wg.Done()
+			sample, err := p.sampleJobUsage(ctx, jobID)
+			if err != nil {
+				log.Printf("Failed to sample resource usage of job %s for pod %s: %v", jobID, key, err)
+				return
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if state.usageStart.IsZero() {
+				state.usageStart = sample.time
+			}
+			state.lastUsage, state.usage = state.usage, sample
+		}(key, jobID, state)
+	}
+	wg.Wait()
+}
+
+// sampleJobUsage runs a StatsCommand for the job.
+func (p *NerscProvider) sampleJobUsage(ctx context.Context, jobID string) (*usageSample, error) {
+	result, err := p.sfClient.RunCommandAndWait(ctx, p.machine(), scripts.StatsCommand(jobID))
+	if err != nil {
+		return nil, err
+	}
+	sstat, containers := scripts.SplitStatsOutput(result.Output)
+	sample, err := parseSstat(sstat)
+	if err != nil {
+		return nil, err
+	}
+	sample.containers = parseContainerStats(containers, jobID)
+	return sample, nil
+}
+
+// parseSstat sums the usage of every step in sstat output with the
+// JobID, TRESUsageInTot and TRESUsageOutTot fields.
+func parseSstat(output string) (*usageSample, error) {
+	sample := &usageSample{time: time.Now()}
+	steps := 0
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), "|")
+		if len(fields) < 3 {
+			continue
+		}
+		steps++
+		in, out := parseTRES(fields[1]), parseTRES(fields[2])
+		if cpu, err := parseSlurmDuration(in["cpu"]); err == nil {
+			sample.cpu += cpu
+		}
+		sample.memory += parseSlurmSize(in["mem"])
+		sample.diskRead += parseSlurmSize(in["fs/disk"])
+		sample.diskWrite += parseSlurmSize(out["fs/disk"])
+		if value, ok := in["gres/gpuutil"]; ok {
+			util, err := strconv.ParseUint(value, 10, 64)
+			if err == nil && (sample.gpuUtil == nil || util > *sample.gpuUtil) {
+				sample.gpuUtil = &util
+			}
+		}
+		if value, ok := in["gres/gpumem"]; ok {
+			memory := parseSlurmSize(value)
+			if sample.gpuMemory != nil {
+				memory += *sample.gpuMemory
+			}
+			sample.gpuMemory = &memory
+		}
+	}
+	if steps == 0 {
+		return nil, fmt.Errorf("sstat reported no job steps")
+	}
+	return sample, nil
+}
+
+// parseTRES parses a TRES list such as "cpu=00:01:02,mem=1.50M,fs/disk=0".
+func parseTRES(value string) map[string]string {
+	tres := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		if name, amount, ok := strings.Cut(item, "="); ok {
+			tres[name] = amount
+		}
+	}
+	return tres
+}
+
+// parseSlurmDuration parses a Slurm duration, [days-][hours:]minutes:seconds
+// with optional fractional seconds.
+func parseSlurmDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	var days int64
+	if d, rest, ok := strings.Cut(value, "-"); ok {
+		n, err := strconv.ParseInt(d, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		days, value = n, rest
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	seconds, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	total := time.Duration(seconds * float64(time.Second))
+	units := []time.Duration{time.Minute, time.Hour}
+	for i := 0; i < len(parts)-1; i++ {
+		n, err := strconv.ParseInt(parts[len(parts)-2-i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		total += time.Duration(n) * units[i]
+	}
+	return total + time.Duration(days)*24*time.Hour, nil
+}
+
+// parseSlurmSize parses a size such as "1.50M", using binary units like
+// Slurm. A value without a unit is in bytes. Invalid values count as zero.
+func parseSlurmSize(value string) uint64 {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	multiplier := 1.0
+	if i := strings.IndexAny(value, "KMGTP"); i == len(value)-1 {
+		multiplier = float64(uint64(1) << (10 * (strings.IndexByte("KMGTP", value[i]) + 1)))
+		value = value[:i]
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return uint64(n * multiplier)
+}
+
+// parseContainerStats parses the podman-hpc stats lines of a StatsCommand,
+// keeping the containers of the job.
+func parseContainerStats(output, jobID string) map[string]containerUsage {
+	prefix := scripts.ContainerName(jobID, "")
+	usage := make(map[string]containerUsage)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), "|")
+		if len(fields) != 3 || !strings.HasPrefix(fields[0], prefix) {
+			continue
+		}
+		cpu, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		memory, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		usage[strings.TrimPrefix(fields[0], prefix)] = containerUsage{cpu: time.Duration(cpu), memory: memory}
+	}
+	return usage
+}
+
+// podUsage is a snapshot of a pod's latest usage samples.
+type podUsage struct {
+	ref        corev1.ObjectReference
+	containers []string
+	start      time.Time
+	usage      *usageSample
+	last       *usageSample
+}
+
+func (p *NerscProvider) podUsages() []podUsage {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var pods []podUsage
+	for _, state := range p.jobStateMap {
+		if state.usage == nil {
+			continue
+		}
+		containers := append([]string{}, state.containers...)
+		for _, name := range state.initContainers {
+			if state.sidecars[name] {
+				containers = append(containers, name)
+			}
+		}
+		pods = append(pods, podUsage{
+			ref:        state.podRef,
+			containers: containers,
+			start:      state.usageStart,
+			usage:      state.usage,
+			last:       state.lastUsage,
+		})
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].ref.Namespace+"/"+pods[i].ref.Name < pods[j].ref.Namespace+"/"+pods[j].ref.Name
+	})
+	return pods
+}
+
+// stats reports the pod's usage. Containers are reported from podman-hpc
+// stats. If those are missing, the only container of a single container
+// pod is reported with the job's usage. Usage that Slurm cannot attribute
+// to a container, GPU utilization and disk I/O, is reported on the first
+// container.
+func (u podUsage) stats() statsv1alpha1.PodStats {
+	now := metav1.NewTime(u.usage.time)
+	start := metav1.NewTime(u.start)
+	podStats := statsv1alpha1.PodStats{
+		PodRef: statsv1alpha1.PodReference{
+			Name:      u.ref.Name,
+			Namespace: u.ref.Namespace,
+			UID:       string(u.ref.UID),
+		},
+		StartTime: start,
+		CPU:       cpuStats(now, u.usage.cpu, u.last, func(s *usageSample) (time.Duration, bool) { return s.cpu, true }),
+		Memory:    memoryStats(now, u.usage.memory),
+	}
+
+	for i, name := range u.containers {
+		containerStats := statsv1alpha1.ContainerStats{Name: name, StartTime: start}
+		usage, ok := u.usage.containers[name]
+		if !ok && len(u.usage.containers) == 0 && len(u.containers) == 1 {
+			usage, ok = containerUsage{cpu: u.usage.cpu, memory: u.usage.memory}, true
+		}
+		if ok {
+			containerStats.CPU = cpuStats(now, usage.cpu, u.last, func(s *usageSample) (time.Duration, bool) {
+				if len(u.usage.containers) == 0 {
+					return s.cpu, len(s.containers) == 0
+				}
+				previous, ok := s.containers[name]
+				return previous.cpu, ok
+			})
+			containerStats.Memory = memoryStats(now, usage.memory)
+		}
+		if i == 0 {
+			containerStats.UserDefinedMetrics = []statsv1alpha1.UserDefinedMetric{
+				diskMetric("job_disk_read_bytes", now, u.usage.diskRead),
+				diskMetric("job_disk_write_bytes", now, u.usage.diskWrite),
+			}
+			if u.usage.gpuUtil != nil {
+				accelerator := statsv1alpha1.AcceleratorStats{Make: "nvidia", DutyCycle: *u.usage.gpuUtil}
+				if u.usage.gpuMemory != nil {
+					accelerator.MemoryUsed = *u.usage.gpuMemory
+				}
+				containerStats.Accelerators = []statsv1alpha1.AcceleratorStats{accelerator}
+			}
+		}
+		podStats.Containers = append(podStats.Containers, containerStats)
+	}
+	return podStats
+}
+
+// cpuStats reports cumulative CPU time and, given the previous sample, the
+// usage rate in nanocores.
+func cpuStats(now metav1.Time, cpu time.Duration, last *usageSample, previousCPU func(*usageSample) (time.Duration, bool)) *statsv1alpha1.CPUStats {
+	total := uint64(cpu)
+	stats := &statsv1alpha1.CPUStats{Time: now, UsageCoreNanoSeconds: &total}
+	if last == nil {
+		return stats
+	}
+	previous, ok := previousCPU(last)
+	elapsed := now.Sub(last.time)
+	if ok && elapsed > 0 && cpu >= previous {
+		rate := uint64(float64(cpu-previous) / elapsed.Seconds())
+		stats.UsageNanoCores = &rate
+	}
+	return stats
+}
+
+func memoryStats(now metav1.Time, memory uint64) *statsv1alpha1.MemoryStats {
+	return &statsv1alpha1.MemoryStats{
+		Time:            now,
+		UsageBytes:      &memory,
+		WorkingSetBytes: &memory,
+		RSSBytes:        &memory,
+	}
+}
+
+func diskMetric(name string, now metav1.Time, bytes uint64) statsv1alpha1.UserDefinedMetric {
+	return statsv1alpha1.UserDefinedMetric{
+		UserDefinedMetricDescriptor: statsv1alpha1.UserDefinedMetricDescriptor{
+			Name:  name,
+			Type:  statsv1alpha1.MetricCumulative,
+			Units: "bytes",
+		},
+		Time:  now,
+		Value: float64(bytes),
+	}
+}
+
+func nanosToSeconds(nanos uint64) float64 {
+	return float64(nanos) / float64(time.Second)
+}
+
+func int64Ptr(value int64) *int64 {
+	return &value
+}
@@ -0,0 +1,311 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"vk-provider-nersc/pkg/scripts"
+)
+
+const (
+	// maxTerminationMessageBytes matches the kubelet's per-container limit.
+	maxTerminationMessageBytes = 4096
+	maxStatusManifestBytes     = 64 << 10
+)
+
+// containerResult is the latest manifest entry for a container.
+type containerResult struct {
+	terminated   corev1.ContainerStateTerminated
+	restartCount int32
+	restarting   bool
+}
+
+// running reports whether the container was restarted after the run
+// recorded in the result and may still be running.
+func (r containerResult) running(finished bool) bool {
+	return r.restarting && !finished
+}
+
+// apply reports the result in containerStatus. A container that is being
+// restarted is shown as running, with the failed run as its last state.
+func (r containerResult) apply(containerStatus *corev1.ContainerStatus, finished bool) {
+	terminated := r.terminated
+	containerStatus.RestartCount = r.restartCount
+	if !r.running(finished) {
+		containerStatus.State.Terminated = &terminated
+		return
+	}
+	containerStatus.RestartCount++
+	containerStatus.LastTerminationState.Terminated = &terminated
+	containerStatus.State.Running = &corev1.ContainerStateRunning{}
+}
+
+// setContainerStatuses reports a status for every init and regular container
+// in the pod, along with the Initialized condition. While the job runs,
+// containers that have already stopped are reported from the job's status
+// manifest. Once the job has finished, every result is cached. Requeues of
+// the job count as restarts of every container.
+func (p *NerscProvider) setContainerStatuses(ctx context.Context, key, jobID string, status *corev1.PodStatus) {
+	state := p.jobStateForPodKey(key)
+	if state == nil {
+		return
+	}
+
+	phase := status.Phase
+	finished := phase == corev1.PodSucceeded || phase == corev1.PodFailed
+	var results map[string]containerResult
+	if finished || phase == corev1.PodRunning {
+		results = p.containerResults(ctx, jobID, state, finished)
+	}
+	if phase == corev1.PodRunning {
+		p.readProbeLog(ctx, jobID, state)
+	}
+
+	// Init containers run one at a time, so the first one without a result is
+	// the one currently running and the rest have not started.
+	initialized := phase != corev1.PodPending
+	for _, name := range state.initContainers {
+		containerStatus := corev1.ContainerStatus{
+			Name:  name,
+			Image: state.images[name],
+		}
+		if state.sidecars[name] {
+			// Native sidecars keep running alongside the later containers.
+			setSidecarState(&containerStatus, results, name, phase, jobID)
+			state.setProbeStatus(&containerStatus)
+		} else if result, ok := results[name]; ok {
+			result.apply(&containerStatus, finished)
+			initialized = initialized && !result.running(finished) && result.terminated.ExitCode == 0
+		} else if initialized && finished {
+			terminated := unknownTerminatedState()
+			containerStatus.State.Terminated = &terminated
+			initialized = false
+		} else if initialized && phase == corev1.PodRunning {
+			containerStatus.State.Running = &corev1.ContainerStateRunning{}
+			initialized = false
+		} else {
+			containerStatus.State.Waiting = waitingState(phase, jobID)
+			initialized = false
+		}
+		status.InitContainerStatuses = append(status.InitContainerStatuses, containerStatus)
+	}
+
+	for _, name := range state.containers {
+		containerStatus := corev1.ContainerStatus{
+			Name:  name,
+			Image: state.images[name],
+		}
+		if result, ok := results[name]; ok {
+			result.apply(&containerStatus, finished)
+		} else if !initialized {
+			containerStatus.State.Waiting = waitingState(phase, jobID)
+		} else if finished {
+			terminated := unknownTerminatedState()
+			containerStatus.State.Terminated = &terminated
+		} else {
+			containerStatus.State.Running = &corev1.ContainerStateRunning{}
+		}
+		state.setProbeStatus(&containerStatus)
+		status.ContainerStatuses = append(status.ContainerStatuses, containerStatus)
+	}
+
+	condition := corev1.PodCondition{
+		Type:   corev1.PodInitialized,
+		Status: corev1.ConditionTrue,
+	}
+	if len(state.initContainers) > 0 && !initialized {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "ContainersNotInitialized"
+		condition.Message = "containers with incomplete status: " + strings.Join(incompleteInitContainers(state, results), ", ")
+	}
+	status.Conditions = append(status.Conditions, condition)
+	status.Conditions = append(status.Conditions, readyConditions(phase, status.ContainerStatuses)...)
+
+	p.mu.RLock()
+	requeues, lastRequeue := state.requeues, state.lastRequeue
+	p.mu.RUnlock()
+	setRequeues(status, requeues, lastRequeue)
+}
+
+func setSidecarState(containerStatus *corev1.ContainerStatus, results map[string]containerResult, name string, phase corev1.PodPhase, jobID string) {
+	switch result, ok := results[name]; {
+	case ok:
+		result.apply(containerStatus, phase != corev1.PodRunning)
+	case phase == corev1.PodRunning:
+		started := true
+		containerStatus.Started = &started
+		containerStatus.Ready = true
+		containerStatus.State.Running = &corev1.ContainerStateRunning{}
+	case phase == corev1.PodPending:
+		containerStatus.State.Waiting = waitingState(phase, jobID)
+	default:
+		unknown := unknownTerminatedState()
+		containerStatus.State.Terminated = &unknown
+	}
+}
+
+func waitingState(phase corev1.PodPhase, jobID string) *corev1.ContainerStateWaiting {
+	if phase == corev1.PodPending {
+		return &corev1.ContainerStateWaiting{
+			Reason:  "JobPending",
+			Message: fmt.Sprintf("Slurm job %s has not started", jobID),
+		}
+	}
+	return &corev1.ContainerStateWaiting{Reason: "PodInitializing"}
+}
+
+func incompleteInitContainers(state *podJobState, results map[string]containerResult) []string {
+	var names []string
+	for _, name := range state.initContainers {
+		if state.sidecars[name] {
+			continue
+		}
+		if result, ok := results[name]; !ok || result.restarting || result.terminated.ExitCode != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// containerResults reads the status manifest and termination messages for
+// the containers that have stopped. Only the manifest's complete lines past
+// the last read are fetched, and results are cached on the job state, so a
+// termination message is read once per manifest entry. Once the job has
+// finished and the whole manifest was read, the results are final.
+func (p *NerscProvider) containerResults(ctx context.Context, jobID string, state *podJobState, finished bool) map[string]containerResult {
+	p.mu.RLock()
+	cached, offset, final := state.results, state.manifestOffset, state.resultsFinal
+	if state.resultsJobID != jobID {
+		// The results are from the job before a requeue.
+		cached, offset, final = nil, 0, false
+	}
+	p.mu.RUnlock()
+	if final {
+		return cached
+	}
+
+	chunk, err := p.sfClient.FetchJobLogRange(ctx, jobID, state.containerFile(scripts.StatusManifestFile), offset, maxStatusManifestBytes)
+	if err != nil {
+		log.Printf("Failed to read status manifest for job %s: %v", jobID, err)
+		return cached
+	}
+	if chunk.Offset != offset {
+		// The manifest is shorter than what was read, so it was recreated.
+		log.Printf("Status manifest for job %s was truncated, reading it again", jobID)
+		p.mu.Lock()
+		if state.resultsJobID == jobID && state.manifestOffset == offset {
+			state.results, state.manifestOffset = nil, 0
+		}
+		p.mu.Unlock()
+		return nil
+	}
+	data := chunk.Data
+	if !finished {
+		// The last line may still be being written.
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+	}
+
+	results := make(map[string]containerResult, len(cached))
+	for name, result := range cached {
+		results[name] = result
+	}
+	for _, result := range parseStatusManifest(string(data)) {
+		message, ok := cachedTerminationMessage(cached, result)
+		if !ok {
+			message, err = p.readJobFile(ctx, jobID, state.containerFile(scripts.ContainerTerminationMessageFile(result.Name)), maxTerminationMessageBytes)
+			if err != nil {
+				log.Printf("Failed to read termination message for container %s of job %s: %v", result.Name, jobID, err)
+			}
+		}
+		results[result.Name] = containerResult{
+			terminated:   terminatedStateFromResult(result, message),
+			restartCount: result.RestartCount,
+			restarting:   result.Restarting,
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if state.resultsJobID == jobID && state.manifestOffset != offset {
+		// A concurrent poll already read further.
+		return results
+	}
+	state.results = results
+	state.resultsJobID = jobID
+	state.manifestOffset = offset + int64(len(data))
+	state.resultsFinal = finished && state.manifestOffset >= chunk.Size
+	return results
+}
+
+// cachedTerminationMessage returns the termination message cached for the
+// run that result records again, such as when a restart is called off.
+func cachedTerminationMessage(cached map[string]containerResult, result scripts.ContainerResult) (string, bool) {
+	previous, ok := cached[result.Name]
+	if !ok || previous.terminated.ExitCode != result.ExitCode ||
+		!previous.terminated.StartedAt.Time.Equal(result.StartedAt) || !previous.terminated.FinishedAt.Time.Equal(result.FinishedAt) {
+		return "", false
+	}
+	return previous.terminated.Message, true
+}
+
+// parseStatusManifest decodes one ContainerResult per line. Malformed lines,
+// such as one cut short when the job was killed, are skipped. A container
+// that appears more than once keeps its last result.
+func parseStatusManifest(manifest string) []scripts.ContainerResult {
+	var results []scripts.ContainerResult
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(strings.NewReader(manifest))
+	for scanner.Scan() {
+		var result scripts.ContainerResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil || result.Name == "" {
+			continue
+		}
+		if i, ok := index[result.Name]; ok {
+			results[i] = result
+			continue
+		}
+		index[result.Name] = len(results)
+		results = append(results, result)
+	}
+	return results
+}
+
+func terminatedStateFromResult(result scripts.ContainerResult, message string) corev1.ContainerStateTerminated {
+	terminated := corev1.ContainerStateTerminated{
+		ExitCode:   result.ExitCode,
+		Signal:     result.Signal,
+		Reason:     "Completed",
+		Message:    message,
+		StartedAt:  metav1.NewTime(result.StartedAt),
+		FinishedAt: metav1.NewTime(result.FinishedAt),
+	}
+	if result.ExitCode != 0 {
+		terminated.Reason = "Error"
+	}
+	return terminated
+}
+
+// unknownTerminatedState is the state of a container with no result.
+func unknownTerminatedState() corev1.ContainerStateTerminated {
+	return corev1.ContainerStateTerminated{
+		ExitCode: 137,
+		Reason:   "ContainerStatusUnknown",
+		Message:  "The container could not be located when the pod was terminated",
+	}
+}
+
+func (p *NerscProvider) readJobFile(ctx context.Context, jobID, path string, limit int64) (string, error) {
+	chunk, err := p.sfClient.FetchJobLogRange(ctx, jobID, path, 0, limit)
+	if err != nil {
+		return "", err
+	}
+	return string(chunk.Data), nil
+}
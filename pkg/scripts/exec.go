@@ -0,0 +1,41 @@
+package scripts
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// execExitCodeMarker starts the line that ExecCommand appends to the output
+// with the command's exit code.
+const execExitCodeMarker = "__vk_exec_exit_code="
+
+// ContainerName returns the podman-hpc name of a container of the job, as
+// set by the job script.
+func ContainerName(jobID, container string) string {
+	return "vk-" + jobID + "-" + container
+}
+
+// ExecCommand returns the login node command that runs cmd in a container
+// of a running job, in a job step that overlaps the job's own. The exit code
+// of cmd is appended to its output on a line of its own, since the
+// Superfacility API does not report it; ParseExecOutput removes it again.
+func ExecCommand(jobID, container string, cmd []string) string {
+	return fmt.Sprintf(`srun --jobid=%s --overlap podman-hpc exec %s %s; printf '\n%s%%d\n' "$?"`,
+		shellQuote(jobID), shellQuote(ContainerName(jobID, container)), strings.Join(shellQuoteAll(cmd), " "), execExitCodeMarker)
+}
+
+// ParseExecOutput splits the output of an ExecCommand into the command's own
+// output and its exit code. ok is false if the exit code is missing, for
+// example because the command was killed.
+func ParseExecOutput(output string) (string, int, bool) {
+	i := strings.LastIndex(output, "\n"+execExitCodeMarker)
+	if i < 0 {
+		return output, 0, false
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(output[i+1+len(execExitCodeMarker):]))
+	if err != nil {
+		return output, 0, false
+	}
+	return output[:i], code, true
+}
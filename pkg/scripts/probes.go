@@ -0,0 +1,195 @@
+package scripts
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Probe kinds recorded in the probe log. ProbeContainerStart marks a new run
+// of a container, after which earlier probe results no longer apply.
+const (
+	ProbeStartup        = "startup"
+	ProbeLiveness       = "liveness"
+	ProbeReadiness      = "readiness"
+	ProbeContainerStart = "start"
+)
+
+// ProbeLogFile is the file, relative to the job directory, that receives one
+// JSON ProbeResult line for every probe failure and every probe that starts
+// passing.
+const ProbeLogFile = "probes.jsonl"
+
+// ProbeResult is one entry of the probe log. Failures counts consecutive
+// failures, and Failed is set once they reach the probe's failureThreshold.
+// A failed startup or liveness probe stops the container.
+type ProbeResult struct {
+	Name     string    `json:"name"`
+	Probe    string    `json:"probe"`
+	Success  bool      `json:"success"`
+	Failures int32     `json:"failures"`
+	Failed   bool      `json:"failed"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+// HasExecProbe reports whether the job script runs probe. Only exec probes
+// are run; jobs have no pod network for HTTP, TCP and gRPC probes, so those
+// are ignored.
+func HasExecProbe(probe *corev1.Probe) bool {
+	return probe != nil && probe.Exec != nil && len(probe.Exec.Command) > 0
+}
+
+type execProbe struct {
+	kind  string
+	probe *corev1.Probe
+}
+
+// containerProbes returns the container's exec probes in the order the
+// script starts them.
+func containerProbes(c corev1.Container) []execProbe {
+	var probes []execProbe
+	for _, probe := range []execProbe{
+		{ProbeStartup, c.StartupProbe},
+		{ProbeLiveness, c.LivenessProbe},
+		{ProbeReadiness, c.ReadinessProbe},
+	} {
+		if HasExecProbe(probe.probe) {
+			probes = append(probes, probe)
+		}
+	}
+	return probes
+}
+
+func hasProbes(pod *corev1.Pod) bool {
+	for _, c := range allContainers(pod) {
+		if len(containerProbes(c)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// probeCommands defines vk_probe_command, which runs the probe of the given
+// container:kind within the given timeout.
+func probeCommands(pod *corev1.Pod) string {
+	sb := &strings.Builder{}
+	sb.WriteString("vk_probe_command() {\n  case \"$1\" in\n")
+	for _, c := range allContainers(pod) {
+		for _, probe := range containerProbes(c) {
+			args := []string{"timeout", `"$2"`, "podman-hpc", "exec", `"$VK_CONTAINER_PREFIX"-` + shellQuote(c.Name)}
+			fmt.Fprintf(sb, "    %s) %s ;;\n", shellQuote(c.Name+":"+probe.kind), strings.Join(append(args, shellQuoteAll(probe.probe.Exec.Command)...), " "))
+		}
+	}
+	sb.WriteString("    *) return 1 ;;\n  esac\n}")
+	return sb.String()
+}
+
+// probesStart starts a background loop for each of the container's exec
+// probes. run identifies the container's current run so loops left over from
+// an earlier run stop. Liveness and readiness probes wait for the startup
+// probe, if there is one, to pass.
+func probesStart(c corev1.Container, run string) string {
+	probes := containerProbes(c)
+	if len(probes) == 0 {
+		return ""
+	}
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "vk_probe_reset %s %s\n", shellQuote(c.Name), run)
+	gated := HasExecProbe(c.StartupProbe)
+	for _, probe := range probes {
+		p := probe.probe
+		fmt.Fprintf(sb, "vk_probe %s %s %s %d %d %d %d %d %t &\n", shellQuote(c.Name), probe.kind, run,
+			p.InitialDelaySeconds, defaultInt32(p.PeriodSeconds, 10), defaultInt32(p.TimeoutSeconds, 1),
+			defaultInt32(p.SuccessThreshold, 1), defaultInt32(p.FailureThreshold, 3), gated && probe.kind != ProbeStartup)
+	}
+	return sb.String()
+}
+
+func defaultInt32(value, fallback int32) int32 {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// probeFunctions are the shell helpers that run probes. They are only added
+// to scripts of pods with exec probes.
+//
+// vk_probe_reset starts a new run of a container's probes. vk_probe_current
+// reports whether the run is still the container's latest and the container
+// still exists.
+//
+// vk_probe runs one probe every period once the container exists and any
+// startup probe has passed. It records each failure and each change to
+// passing in the probe log. When failures reach the failure threshold, a
+// startup or liveness probe stops the container, which the restart loop then
+// restarts according to the pod's restartPolicy. A startup probe that passes
+// writes the container's startup marker and stops.
+//
+// vk_probe_record appends a ProbeResult line to the probe log, with the
+// probe output flattened to one line and escaped for JSON.
+const probeFunctions = `vk_probe_reset() {
+  rm -f -- "$JOB_DIR/$1.startup"
+  printf '%s\n' "$2" >"$JOB_DIR/$1.probe-run"
+  vk_probe_record "$1" ` + ProbeContainerStart + ` true 0 false ""
+}
+vk_probe_current() {
+  [ "$(cat "$JOB_DIR/$1.probe-run" 2>/dev/null)" = "$2" ] &&
+    podman-hpc container exists "$VK_CONTAINER_PREFIX-$1" >/dev/null 2>&1
+}
+vk_probe_record() {
+  local message
+  message=$(printf '%s' "$6" | head -c 1024 | tr '\n\t' '  ' | tr -d '\000-\037' | sed 's/\\/\\\\/g; s/"/\\"/g') || true
+  printf '{"name":"%s","probe":"%s","success":%s,"failures":%d,"failed":%s,"message":"%s","time":"%s"}\n' \
+    "$1" "$2" "$3" "$4" "$5" "$message" "$(vk_now)" >>"$JOB_DIR/` + ProbeLogFile + `"
+}
+vk_probe() {
+  local name="$1" probe="$2" run="$3" delay="$4" period="$5" timeout="$6" success_threshold="$7" failure_threshold="$8" gated="$9"
+  local successes=0 failures=0 passing=false out rc
+  vk_started "$name" || return 0
+  if [ "$gated" = true ]; then
+    until [ "$(cat "$JOB_DIR/$name.startup" 2>/dev/null)" = "$run" ]; do
+      vk_probe_current "$name" "$run" || return 0
+      sleep 1
+    done
+  fi
+  sleep "$delay"
+  while vk_probe_current "$name" "$run" && ! vk_terminating; do
+    rc=0
+    out=$(vk_probe_command "$name:$probe" "$timeout" 2>&1) || rc=$?
+    vk_probe_current "$name" "$run" || return 0
+    if [ "$rc" -eq 0 ]; then
+      failures=0
+      successes=$((successes + 1))
+      if [ "$passing" = false ] && [ "$successes" -ge "$success_threshold" ]; then
+        passing=true
+        vk_probe_record "$name" "$probe" true 0 false ""
+        if [ "$probe" = ` + ProbeStartup + ` ]; then
+          printf '%s\n' "$run" >"$JOB_DIR/$name.startup"
+          return 0
+        fi
+      fi
+    else
+      successes=0
+      failures=$((failures + 1))
+      if [ "$rc" -eq 124 ]; then
+        out="command timed out after ${timeout}s"
+      fi
+      if [ "$failures" -lt "$failure_threshold" ]; then
+        vk_probe_record "$name" "$probe" false "$failures" false "$out"
+      else
+        passing=false
+        vk_probe_record "$name" "$probe" false "$failures" true "$out"
+        if [ "$probe" != ` + ProbeReadiness + ` ]; then
+          echo "$probe probe of container $name failed, stopping it" >&2
+          vk_stop_container "$name"
+          return 0
+        fi
+      fi
+    fi
+    sleep "$period"
+  done
+}`
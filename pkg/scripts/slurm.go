@@ -2,71 +2,619 @@ package scripts
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 )
 
-func PodToSlurmPodmanWithVolumes(pod *corev1.Pod, volPaths map[string]string) string {
+// InitContainerFailedExitCode is the Slurm job exit code used when an init
+// container fails and the pod's regular containers are never started.
+const InitContainerFailedExitCode = 90
+
+func PodToSlurmPodmanWithVolumes(pod *corev1.Pod, volPaths map[string]string, jobDir string) string {
 	c := pod.Spec.Containers[0]
-	setup := buildVolumeSetup(c.VolumeMounts, volPaths)
-	runCommand := containerRunCommand(c, volPaths, false)
+	return fmt.Sprintf(`%s
+%s%s
+rc=0
+%s
+exit "$rc"
+`, scriptHeader(pod, volPaths, jobDir), initContainersRun(pod, volPaths, false),
+		terminationMessageSetup(c), containerRun(pod, c, "srun "+containerRunCommand(c, volPaths, false)))
+}
 
-	return fmt.Sprintf(`#!/bin/bash
-#SBATCH --job-name=%s
-#SBATCH --nodes=1
-#SBATCH --cpus-per-task=1
-#SBATCH --mem=4GB
-#SBATCH --time=00:30:00
-#SBATCH --partition=regular
-#SBATCH --output=%s.out
-set -euo pipefail
+// PodToSlurmPodmanMultiWithVolumes runs every container of the pod in a
+// shared podman-hpc pod. Sidecars, either native sidecars or containers named
+// in SidecarsAnnotation, are stopped once the other regular containers have
+// exited, and only those containers determine the job's exit status.
+func PodToSlurmPodmanMultiWithVolumes(pod *corev1.Pod, volPaths map[string]string, jobDir string) string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, `%s
+POD_ID=$(podman-hpc pod create --name %s)
+`, scriptHeader(pod, volPaths, jobDir), shellQuote(pod.Name+"-pod"))
 
-module load podman-hpc
-%s
-srun %s
-`, pod.Name, pod.Name, setup, runCommand)
+	if hasSidecars(pod) {
+		fmt.Fprint(sb, `sidecar_names=()
+sidecar_pids=()
+trap vk_stop_sidecars EXIT
+`)
+	}
+	fmt.Fprint(sb, initContainersRun(pod, volPaths, true))
+	fmt.Fprintln(sb, "pids=()")
+
+	for _, c := range pod.Spec.Containers {
+		fmt.Fprint(sb, backgroundContainerRun(pod, c, volPaths))
+	}
+	fmt.Fprint(sb, `status=0
+for pid in "${pids[@]}"; do
+  rc=0
+  vk_wait "$pid" || rc=$?
+  if [ "$status" -eq 0 ]; then
+    status=$rc
+  fi
+done
+exit "$status"
+`)
+	return sb.String()
 }
 
-func PodToSlurmPodmanMultiWithVolumes(pod *corev1.Pod, volPaths map[string]string) string {
+// scriptHeader returns the Slurm directives and the setup shared by every job
+// script.
+func scriptHeader(pod *corev1.Pod, volPaths map[string]string, jobDir string) string {
 	sb := &strings.Builder{}
 	fmt.Fprintf(sb, `#!/bin/bash
 #SBATCH --job-name=%s
 #SBATCH --nodes=1
 #SBATCH --cpus-per-task=1
 #SBATCH --mem=4GB
-#SBATCH --time=00:30:00
+#SBATCH --time=%s
 #SBATCH --partition=regular
-#SBATCH --output=%s.out
+#SBATCH --requeue
+`, pod.Name, slurmTimeLimit(pod))
+	grace := terminationGracePeriodSeconds(pod)
+	if grace > 0 {
+		fmt.Fprintf(sb, "#SBATCH --signal=B:TERM@%d\n", grace)
+	}
+	names := make([]string, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	for _, c := range allContainers(pod) {
+		names = append(names, shellQuote(c.Name))
+	}
+	fmt.Fprintf(sb, `#SBATCH --output=%s.out
+#SBATCH --error=%s.err
 set -euo pipefail
 
 module load podman-hpc
+JOB_DIR=%s
+VK_CONTAINER_PREFIX="vk-${SLURM_JOB_ID:-$$}"
+VK_CONTAINERS=(%s)
+VK_STOP_GRACE=%d
+VK_JOB_END=${SLURM_JOB_END_TIME:-$(($(date +%%s) + %d))}
+mkdir -p -- "$JOB_DIR"
+rm -f -- "$JOB_DIR"/`+TerminatingFile+` "$JOB_DIR"/`+DeadlineFile+`
+: >"$JOB_DIR"/`+StatusManifestFile+`
 %s
-POD_ID=$(podman-hpc pod create --name %s)
-pids=()
-`, pod.Name, pod.Name, buildVolumeSetupForPod(pod, volPaths), shellQuote(pod.Name+"-pod"))
+%s
+%s
+%strap vk_terminate TERM
+%s`, pod.Name, pod.Name, shellQuote(jobDir), strings.Join(names, " "), grace, int64(timeLimit(pod)/time.Second), logFilesSetup(pod), scriptFunctions, preStopHooks(pod), probeSetup(pod), buildVolumeSetupForPod(pod, volPaths))
+	return sb.String()
+}
 
-	for _, c := range pod.Spec.Containers {
-		fmt.Fprintf(sb, "%s &\n", containerRunCommand(c, volPaths, true))
-		fmt.Fprintln(sb, `pids+=("$!")`)
+// probeSetup empties the probe log left by an earlier run of the job and
+// defines the probe helpers, for pods with exec probes.
+func probeSetup(pod *corev1.Pod) string {
+	if !hasProbes(pod) {
+		return ""
 	}
-	fmt.Fprint(sb, `status=0
-for pid in "${pids[@]}"; do
-  if ! wait "$pid"; then
-    status=1
+	return fmt.Sprintf(": >\"$JOB_DIR\"/%s\n%s\n%s\n", ProbeLogFile, probeFunctions, probeCommands(pod))
+}
+
+// DefaultTimeLimit is the Slurm time limit of pods without
+// activeDeadlineSeconds.
+const DefaultTimeLimit = 30 * time.Minute
+
+func timeLimit(pod *corev1.Pod) time.Duration {
+	if pod.Spec.ActiveDeadlineSeconds != nil && *pod.Spec.ActiveDeadlineSeconds > 0 {
+		return time.Duration(*pod.Spec.ActiveDeadlineSeconds) * time.Second
+	}
+	return DefaultTimeLimit
+}
+
+func slurmTimeLimit(pod *corev1.Pod) string {
+	return formatSlurmTime(timeLimit(pod))
+}
+
+// formatSlurmTime formats d as a Slurm time limit, days-hours:minutes:seconds.
+func formatSlurmTime(d time.Duration) string {
+	seconds := int64(d / time.Second)
+	days := seconds / 86400
+	clock := fmt.Sprintf("%02d:%02d:%02d", seconds%86400/3600, seconds%3600/60, seconds%60)
+	if days > 0 {
+		return fmt.Sprintf("%d-%s", days, clock)
+	}
+	return clock
+}
+
+// backgroundContainerRun starts a container in the background, recording its
+// pid in pids, or in sidecar_pids for sidecars.
+func backgroundContainerRun(pod *corev1.Pod, c corev1.Container, volPaths map[string]string) string {
+	track := `pids+=("$!")`
+	if isSidecar(pod, c) {
+		track = fmt.Sprintf("sidecar_names+=(%s)\nsidecar_pids+=(\"$!\")", shellQuote(c.Name))
+	}
+	return fmt.Sprintf(`%s
+(
+  rc=0
+%s
+  exit "$rc"
+) &
+%s
+`, terminationMessageSetup(c), indent(containerRun(pod, c, containerRunCommand(c, volPaths, true)), "  "), track)
+}
+
+// scriptFunctions are shell helpers shared by every generated job script.
+const scriptFunctions = `vk_timestamp() {
+  awk '{ print strftime("%Y-%m-%dT%H:%M:%SZ", systime(), 1) " " $0; fflush() }'
+}
+vk_run_logged() {
+  local name="$1"
+  shift
+  { { "$@" 2>&1 1>&3 3>&- | vk_timestamp >>"$JOB_DIR/$name.err"; } 3>&1 | vk_timestamp >>"$JOB_DIR/$name.out"; } &
+  vk_wait "$!"
+}
+vk_wait() {
+  local pid="$1" rc
+  while :; do
+    rc=0
+    wait "$pid" || rc=$?
+    if [ "$rc" -le 128 ] || ! kill -0 "$pid" 2>/dev/null; then
+      return "$rc"
+    fi
+  done
+}
+vk_started() {
+  local container="$VK_CONTAINER_PREFIX-$1" attempt
+  for attempt in $(seq 1 120); do
+    if podman-hpc container exists "$container" >/dev/null 2>&1; then
+      return 0
+    fi
+    sleep 0.5
+  done
+  return 1
+}
+vk_post_start() {
+  local name="$1"
+  shift
+  vk_started "$name" || return 0
+  if ! "$@" >/dev/null 2>&1; then
+    echo "postStart hook of container $name failed, stopping it" >&2
+    podman-hpc stop --time "$VK_STOP_GRACE" "$VK_CONTAINER_PREFIX-$name" >/dev/null 2>&1 || true
   fi
-done
-exit "$status"
-`)
+}
+vk_grace_left() {
+  local left="$VK_STOP_GRACE"
+  if [ -n "${VK_STOP_DEADLINE:-}" ]; then
+    left=$((VK_STOP_DEADLINE - SECONDS))
+  fi
+  if [ "$left" -lt 0 ]; then
+    left=0
+  fi
+  echo "$left"
+}
+vk_pre_stop() {
+  local name="$1" budget
+  shift
+  podman-hpc container exists "$VK_CONTAINER_PREFIX-$name" >/dev/null 2>&1 || return 0
+  budget=$(($(vk_grace_left) - 2))
+  if [ "$budget" -lt 1 ]; then
+    budget=1
+  fi
+  timeout "$budget" "$@" >/dev/null 2>&1 || echo "preStop hook of container $name failed" >&2
+}
+vk_stop_container() {
+  vk_pre_stop_hook "$1"
+  podman-hpc stop --time "$(vk_grace_left)" "$VK_CONTAINER_PREFIX-$1" >/dev/null 2>&1 || true
+}
+vk_terminating() {
+  [ -e "$JOB_DIR/` + TerminatingFile + `" ]
+}
+vk_at_deadline() {
+  [ "$(date +%s)" -ge $((VK_JOB_END - VK_STOP_GRACE - 60)) ]
+}
+vk_terminate() {
+  local name pid stoppers=()
+  trap - TERM
+  if vk_at_deadline; then
+    vk_now >"$JOB_DIR/` + DeadlineFile + `"
+  fi
+  VK_STOP_DEADLINE=$((SECONDS + VK_STOP_GRACE))
+  vk_now >"$JOB_DIR/` + TerminatingFile + `"
+  for name in "${VK_CONTAINERS[@]}"; do
+    vk_stop_container "$name" &
+    stoppers+=("$!")
+  done
+  for pid in "${stoppers[@]}"; do
+    wait "$pid" || true
+  done
+}
+vk_now() {
+  date -u +%Y-%m-%dT%H:%M:%SZ
+}
+vk_finish_container() {
+  local name="$1" rc="$2" policy="$3" started="$4" restarts="${5:-0}" restarting="${6:-false}" finished="${7:-$(vk_now)}" signal=0
+  local message="$JOB_DIR/$name.termination-log"
+  if [ "$policy" = FallbackToLogsOnError ] && [ "$rc" -ne 0 ] && [ ! -s "$message" ]; then
+    sort -m -s -k1,1 "$JOB_DIR/$name.out" "$JOB_DIR/$name.err" | tail -n 80 | cut -d' ' -f2- | tail -c 2048 >"$message" || true
+  fi
+  if [ "$rc" -gt 128 ]; then
+    signal=$((rc - 128))
+  fi
+  printf '{"name":"%s","exitCode":%d,"signal":%d,"startedAt":"%s","finishedAt":"%s","restartCount":%d,"restarting":%s}\n' \
+    "$name" "$rc" "$signal" "$started" "$finished" "$restarts" "$restarting" >>"$JOB_DIR/` + StatusManifestFile + `"
+}
+vk_backoff() {
+  local delay=300 waited=0
+  if [ "$1" -lt 5 ]; then
+    delay=$((10 << $1))
+  fi
+  while [ "$waited" -lt "$delay" ] && ! vk_terminating; do
+    sleep 1
+    waited=$((waited + 1))
+  done
+  ! vk_terminating
+}
+vk_stop_sidecar() {
+  local name="$1" pid="$2" attempt
+  vk_pre_stop_hook "$name"
+  for attempt in 1 2 3 4 5; do
+    kill -0 "$pid" 2>/dev/null || return 0
+    podman-hpc stop --time "$(vk_grace_left)" "$VK_CONTAINER_PREFIX-$name" >/dev/null 2>&1 || sleep 1
+  done
+  kill -TERM "$pid" 2>/dev/null || true
+}
+vk_stop_sidecars() {
+  local i pid stoppers=()
+  VK_STOP_DEADLINE="${VK_STOP_DEADLINE:-$((SECONDS + VK_STOP_GRACE))}"
+  for i in "${!sidecar_pids[@]}"; do
+    vk_stop_sidecar "${sidecar_names[$i]}" "${sidecar_pids[$i]}" &
+    stoppers+=("$!")
+  done
+  for pid in "${stoppers[@]}" "${sidecar_pids[@]}"; do
+    wait "$pid" 2>/dev/null || true
+  done
+}`
+
+// ContainerStdoutFile returns the name of the file, relative to the job
+// directory, that receives the container's standard output.
+func ContainerStdoutFile(containerName string) string {
+	return containerName + ".out"
+}
+
+// ContainerStderrFile returns the name of the file, relative to the job
+// directory, that receives the container's standard error.
+func ContainerStderrFile(containerName string) string {
+	return containerName + ".err"
+}
+
+// ContainerTerminationMessageFile returns the name of the file, relative to
+// the job directory, that is mounted at the container's terminationMessagePath.
+func ContainerTerminationMessageFile(containerName string) string {
+	return containerName + ".termination-log"
+}
+
+// TerminatingFile is the file, relative to the job directory, that the job
+// script creates when it starts stopping its containers, either because the
+// job reached its time limit or because it was signalled or cancelled.
+const TerminatingFile = "terminating"
+
+// DeadlineFile is the file, relative to the job directory, that the job
+// script creates when it is sent SIGTERM close to its time limit.
+const DeadlineFile = "deadline"
+
+// StatusManifestFile is the file, relative to the job directory, that
+// receives one JSON ContainerResult line for every container that stops.
+const StatusManifestFile = "status.jsonl"
+
+// ContainerResult is one entry of the status manifest. Signal is set when
+// the container's exit code indicates it was killed by a signal.
+// RestartCount is the number of times the container had been restarted
+// before this run, and Restarting is set when it is about to be restarted.
+type ContainerResult struct {
+	Name         string    `json:"name"`
+	ExitCode     int32     `json:"exitCode"`
+	Signal       int32     `json:"signal"`
+	StartedAt    time.Time `json:"startedAt"`
+	FinishedAt   time.Time `json:"finishedAt"`
+	RestartCount int32     `json:"restartCount"`
+	Restarting   bool      `json:"restarting"`
+}
+
+// containerRun runs a container command with its output captured and its
+// result recorded, leaving the exit code in $rc. Unless restartPolicy is
+// Never a failing command is restarted, up to the pod's back-off limit.
+func containerRun(pod *corev1.Pod, c corev1.Container, command string) string {
+	name := shellQuote(c.Name)
+	policy := shellQuote(string(terminationMessagePolicy(c)))
+	postStart := postStartHook(c)
+	if !restartsOnFailure(pod, c) {
+		return fmt.Sprintf(`started=$(vk_now)
+%s%svk_run_logged %s %s || rc=$?
+vk_finish_container %s "$rc" %s "$started"`, postStart, probesStart(c, "0"), name, command, name, policy)
+	}
+	return fmt.Sprintf(`restarts=0
+while :; do
+  rc=0
+  started=$(vk_now)
+%s%s  vk_run_logged %s %s || rc=$?
+  if [ "$rc" -ne 0 ] && [ "$restarts" -lt %d ] && ! vk_terminating; then
+    finished=$(vk_now)
+    vk_finish_container %s "$rc" %s "$started" "$restarts" true "$finished"
+    if ! vk_backoff "$restarts"; then
+      vk_finish_container %s "$rc" %s "$started" "$restarts" false "$finished"
+      break
+    fi
+    restarts=$((restarts + 1))
+    %s
+    continue
+  fi
+  vk_finish_container %s "$rc" %s "$started" "$restarts"
+  break
+done`, indent(postStart, "  "), indent(probesStart(c, `"$restarts"`), "  "), name, command, BackoffLimit(pod), name, policy, name, policy, terminationMessageSetup(c), name, policy)
+}
+
+// ValidateLifecycleHooks rejects lifecycle hooks the job script cannot run.
+// HTTP and TCP hooks need the pod network, which jobs do not have.
+func ValidateLifecycleHooks(pod *corev1.Pod) error {
+	for _, c := range allContainers(pod) {
+		if c.Lifecycle == nil {
+			continue
+		}
+		if err := validateLifecycleHook(c.Name, "postStart", c.Lifecycle.PostStart); err != nil {
+			return err
+		}
+		if err := validateLifecycleHook(c.Name, "preStop", c.Lifecycle.PreStop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateLifecycleHook(container, hook string, handler *corev1.LifecycleHandler) error {
+	switch {
+	case handler == nil:
+		return nil
+	case handler.HTTPGet != nil:
+		return fmt.Errorf("container %s: httpGet %s hooks are not supported because jobs have no pod network; use an exec hook", container, hook)
+	case handler.TCPSocket != nil:
+		return fmt.Errorf("container %s: tcpSocket %s hooks are not supported because jobs have no pod network; use an exec hook", container, hook)
+	default:
+		return nil
+	}
+}
+
+// hookCommand returns the shell words that run a lifecycle hook handler in
+// the container, or "" when the handler has nothing to run.
+func hookCommand(c corev1.Container, handler *corev1.LifecycleHandler) string {
+	switch {
+	case handler == nil:
+		return ""
+	case handler.Exec != nil && len(handler.Exec.Command) > 0:
+		args := []string{"podman-hpc", "exec", `"$VK_CONTAINER_PREFIX"-` + shellQuote(c.Name)}
+		return strings.Join(append(args, shellQuoteAll(handler.Exec.Command)...), " ")
+	case handler.Sleep != nil:
+		return fmt.Sprintf("sleep %d", handler.Sleep.Seconds)
+	default:
+		return ""
+	}
+}
+
+// postStartHook starts the container's postStart hook in the background.
+func postStartHook(c corev1.Container) string {
+	if c.Lifecycle == nil {
+		return ""
+	}
+	command := hookCommand(c, c.Lifecycle.PostStart)
+	if command == "" {
+		return ""
+	}
+	return fmt.Sprintf("vk_post_start %s %s &\n", shellQuote(c.Name), command)
+}
+
+// preStopHooks defines vk_pre_stop_hook, which runs the preStop hook of the
+// named container, if it has one.
+func preStopHooks(pod *corev1.Pod) string {
+	sb := &strings.Builder{}
+	sb.WriteString("vk_pre_stop_hook() {\n  case \"$1\" in\n")
+	for _, c := range allContainers(pod) {
+		if c.Lifecycle == nil {
+			continue
+		}
+		if command := hookCommand(c, c.Lifecycle.PreStop); command != "" {
+			fmt.Fprintf(sb, "    %s) vk_pre_stop %s %s ;;\n", shellQuote(c.Name), shellQuote(c.Name), command)
+		}
+	}
+	sb.WriteString("    *) ;;\n  esac\n}")
+	return sb.String()
+}
+
+// BackoffLimitAnnotation sets how many times a failing container is
+// restarted within the job, like a Job's backoffLimit.
+const BackoffLimitAnnotation = "nersc.sf/backoffLimit"
+
+// DefaultBackoffLimit matches the default backoffLimit of a Kubernetes Job.
+const DefaultBackoffLimit = 6
+
+// BackoffLimit returns the restart limit set by BackoffLimitAnnotation, or
+// DefaultBackoffLimit if the annotation is missing or invalid.
+func BackoffLimit(pod *corev1.Pod) int {
+	value := strings.TrimSpace(pod.Annotations[BackoffLimitAnnotation])
+	if value == "" {
+		return DefaultBackoffLimit
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return DefaultBackoffLimit
+	}
+	return limit
+}
+
+// restartsOnFailure reports whether a failing container is restarted. Both
+// OnFailure and Always restart failing containers only, so a batch job that
+// succeeds is not run again. Sidecars are never restarted because the script
+// stops them on purpose.
+func restartsOnFailure(pod *corev1.Pod, c corev1.Container) bool {
+	return pod.Spec.RestartPolicy != corev1.RestartPolicyNever && !isSidecar(pod, c)
+}
+
+// initContainersRun runs each init container to completion in order and
+// aborts the job with InitContainerFailedExitCode if one fails. Native
+// sidecars are started in the background instead and keep running alongside
+// the later init containers and the regular containers; they are only
+// supported in a pod.
+func initContainersRun(pod *corev1.Pod, volPaths map[string]string, inPod bool) string {
+	sb := &strings.Builder{}
+	for _, c := range pod.Spec.InitContainers {
+		if inPod && isNativeSidecar(c) {
+			fmt.Fprint(sb, backgroundContainerRun(pod, c, volPaths))
+			continue
+		}
+		command := containerRunCommand(c, volPaths, inPod)
+		if !inPod {
+			command = "srun " + command
+		}
+		fmt.Fprintf(sb, `%s
+rc=0
+%s
+if [ "$rc" -ne 0 ]; then
+  echo "init container %s failed with exit code $rc" >&2
+  exit %d
+fi
+`, terminationMessageSetup(c), containerRun(pod, c, command), c.Name, InitContainerFailedExitCode)
+	}
 	return sb.String()
 }
 
+// SidecarsAnnotation lists, comma separated, regular containers that run as
+// sidecars: they are stopped when the pod's other containers exit and do not
+// affect its exit status.
+const SidecarsAnnotation = "nersc.sf/sidecars"
+
+// Sidecars returns the names of the pod's native sidecars, init containers
+// with restartPolicy Always, followed by the containers named in
+// SidecarsAnnotation. It fails if the annotation names an unknown container
+// or leaves the pod without a regular container that is not a sidecar.
+func Sidecars(pod *corev1.Pod) ([]string, error) {
+	var names []string
+	for _, c := range pod.Spec.InitContainers {
+		if isNativeSidecar(c) {
+			names = append(names, c.Name)
+		}
+	}
+
+	annotated := annotatedSidecars(pod)
+	mains := 0
+	for _, c := range pod.Spec.Containers {
+		if annotated[c.Name] {
+			names = append(names, c.Name)
+			delete(annotated, c.Name)
+		} else {
+			mains++
+		}
+	}
+	for name := range annotated {
+		return nil, fmt.Errorf("%s: container %s is not a regular container of the pod", SidecarsAnnotation, name)
+	}
+	if mains == 0 {
+		return nil, fmt.Errorf("%s: at least one regular container must not be a sidecar", SidecarsAnnotation)
+	}
+	return names, nil
+}
+
+func annotatedSidecars(pod *corev1.Pod) map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range strings.Split(pod.Annotations[SidecarsAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+func isNativeSidecar(c corev1.Container) bool {
+	return c.RestartPolicy != nil && *c.RestartPolicy == corev1.ContainerRestartPolicyAlways
+}
+
+func isSidecar(pod *corev1.Pod, c corev1.Container) bool {
+	return isNativeSidecar(c) || annotatedSidecars(pod)[c.Name]
+}
+
+func hasSidecars(pod *corev1.Pod) bool {
+	for _, c := range pod.Spec.InitContainers {
+		if isNativeSidecar(c) {
+			return true
+		}
+	}
+	return len(annotatedSidecars(pod)) > 0
+}
+
+func allContainers(pod *corev1.Pod) []corev1.Container {
+	return append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+}
+
+func terminationGracePeriodSeconds(pod *corev1.Pod) int64 {
+	if pod.Spec.TerminationGracePeriodSeconds == nil {
+		return corev1.DefaultTerminationGracePeriodSeconds
+	}
+	return *pod.Spec.TerminationGracePeriodSeconds
+}
+
+func indent(text, prefix string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// logFilesSetup empties the log files left by an earlier run of the job,
+// since containers append to them so that output survives restarts.
+func logFilesSetup(pod *corev1.Pod) string {
+	var lines []string
+	for _, c := range allContainers(pod) {
+		lines = append(lines, fmt.Sprintf(`: >"$JOB_DIR"/%s >"$JOB_DIR"/%s`, shellQuote(ContainerStdoutFile(c.Name)), shellQuote(ContainerStderrFile(c.Name))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func terminationMessageSetup(c corev1.Container) string {
+	return fmt.Sprintf(`: >"$JOB_DIR"/%s`, shellQuote(ContainerTerminationMessageFile(c.Name)))
+}
+
+func terminationMessagePath(c corev1.Container) string {
+	if c.TerminationMessagePath == "" {
+		return corev1.TerminationMessagePathDefault
+	}
+	return c.TerminationMessagePath
+}
+
+func terminationMessagePolicy(c corev1.Container) corev1.TerminationMessagePolicy {
+	if c.TerminationMessagePolicy == "" {
+		return corev1.TerminationMessageReadFile
+	}
+	return c.TerminationMessagePolicy
+}
+
 func containerRunCommand(c corev1.Container, volPaths map[string]string, inPod bool) string {
 	args := []string{"podman-hpc", "run", "--rm"}
 	if inPod {
 		args = append(args, "--pod", `"$POD_ID"`)
 	}
+	args = append(args, "--name", `"$VK_CONTAINER_PREFIX"-`+shellQuote(c.Name))
 	args = append(args, buildVolumeArgs(c.VolumeMounts, volPaths)...)
+	args = append(args, "--volume", `"$JOB_DIR"/`+shellQuote(ContainerTerminationMessageFile(c.Name)+":"+terminationMessagePath(c)+":rw"))
 	args = append(args, shellQuote(c.Image))
 	args = append(args, shellQuoteAll(c.Command)...)
 	args = append(args, shellQuoteAll(c.Args)...)
@@ -90,7 +638,7 @@ func buildVolumeArgs(mounts []corev1.VolumeMount, volPaths map[string]string) []
 func buildVolumeSetupForPod(pod *corev1.Pod, volPaths map[string]string) string {
 	seen := make(map[string]struct{})
 	var lines []string
-	for _, c := range pod.Spec.Containers {
+	for _, c := range allContainers(pod) {
 		for _, line := range buildVolumeSetupLines(c.VolumeMounts, volPaths, seen) {
 			lines = append(lines, line)
 		}
@@ -98,10 +646,6 @@ func buildVolumeSetupForPod(pod *corev1.Pod, volPaths map[string]string) string
 	return strings.Join(lines, "\n")
 }
 
-func buildVolumeSetup(mounts []corev1.VolumeMount, volPaths map[string]string) string {
-	return strings.Join(buildVolumeSetupLines(mounts, volPaths, make(map[string]struct{})), "\n")
-}
-
 func buildVolumeSetupLines(mounts []corev1.VolumeMount, volPaths map[string]string, seen map[string]struct{}) []string {
 	var lines []string
 	for _, m := range mounts {
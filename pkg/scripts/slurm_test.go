@@ -27,7 +27,7 @@ func TestSingleContainerScriptQuotesArgumentsAndCreatesVolumeDirs(t *testing.T)
 	}
 	script := PodToSlurmPodmanWithVolumes(pod, map[string]string{
 		"data": "/scratch/demo/data path",
-	})
+	}, "/scratch/demo/.vk-nersc")
 
 	wantFragments := []string{
 		"set -euo pipefail",
@@ -53,12 +53,12 @@ func TestMultiContainerScriptWaitsForEveryContainer(t *testing.T) {
 			},
 		},
 	}
-	script := PodToSlurmPodmanMultiWithVolumes(pod, nil)
+	script := PodToSlurmPodmanMultiWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
 
 	wantFragments := []string{
 		`--pod "$POD_ID"`,
 		`pids+=("$!")`,
-		`if ! wait "$pid"; then`,
+		`wait "$pid" || rc=$?`,
 		`exit "$status"`,
 	}
 	for _, fragment := range wantFragments {
@@ -70,3 +70,408 @@ func TestMultiContainerScriptWaitsForEveryContainer(t *testing.T) {
 		t.Fatalf("pid capture count = %d, want 2", got)
 	}
 }
+
+func TestMultiContainerScriptSeparatesContainerLogs(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "one", Image: "image-one"},
+				{Name: "two", Image: "image-two"},
+			},
+		},
+	}
+	script := PodToSlurmPodmanMultiWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+
+	wantFragments := []string{
+		"#SBATCH --output=demo.out",
+		"#SBATCH --error=demo.err",
+		"JOB_DIR='/scratch/demo/.vk-nersc'",
+		`mkdir -p -- "$JOB_DIR"`,
+		"vk_timestamp() {",
+		`vk_timestamp >>"$JOB_DIR/$name.err"; } 3>&1 | vk_timestamp >>"$JOB_DIR/$name.out"`,
+		`vk_run_logged 'one' podman-hpc run --rm --pod "$POD_ID"`,
+		`vk_run_logged 'two' podman-hpc run --rm --pod "$POD_ID"`,
+	}
+	for _, fragment := range wantFragments {
+		if !strings.Contains(script, fragment) {
+			t.Fatalf("script missing %q:\n%s", fragment, script)
+		}
+	}
+}
+
+func TestMultiContainerScriptExitsWithFirstFailingContainerCode(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "one", Image: "image-one"},
+				{Name: "two", Image: "image-two"},
+			},
+		},
+	}
+	script := PodToSlurmPodmanMultiWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+
+	wantFragments := []string{
+		`: >"$JOB_DIR"/status.jsonl`,
+		`signal=$((rc - 128))`,
+		`"name":"%s","exitCode":%d,"signal":%d,"startedAt":"%s","finishedAt":"%s"`,
+		"  if [ \"$status\" -eq 0 ]; then\n    status=$rc\n  fi",
+	}
+	for _, fragment := range wantFragments {
+		if !strings.Contains(script, fragment) {
+			t.Fatalf("script missing %q:\n%s", fragment, script)
+		}
+	}
+}
+
+func TestScriptCapturesTerminationMessageAndExitCode(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:                     "main",
+					Image:                    "image-main",
+					TerminationMessagePath:   "/tmp/result",
+					TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+				},
+			},
+		},
+	}
+	script := PodToSlurmPodmanWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+
+	wantFragments := []string{
+		`: >"$JOB_DIR"/'main.termination-log'`,
+		`--volume "$JOB_DIR"/'main.termination-log:/tmp/result:rw'`,
+		`vk_finish_container 'main' "$rc" 'FallbackToLogsOnError'`,
+		`vk_finish_container 'main' "$rc" 'FallbackToLogsOnError' "$started"`,
+		`>>"$JOB_DIR/status.jsonl"`,
+		`exit "$rc"`,
+	}
+	for _, fragment := range wantFragments {
+		if !strings.Contains(script, fragment) {
+			t.Fatalf("script missing %q:\n%s", fragment, script)
+		}
+	}
+
+	pod.Spec.Containers[0].TerminationMessagePath = ""
+	pod.Spec.Containers[0].TerminationMessagePolicy = ""
+	script = PodToSlurmPodmanWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+	for _, fragment := range []string{
+		`'main.termination-log:/dev/termination-log:rw'`,
+		`vk_finish_container 'main' "$rc" 'File'`,
+	} {
+		if !strings.Contains(script, fragment) {
+			t.Fatalf("script missing %q:\n%s", fragment, script)
+		}
+	}
+}
+
+func TestScriptRunsInitContainersInOrderBeforeMainContainers(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Name: "fetch", Image: "image-fetch"},
+				{Name: "render", Image: "image-render"},
+			},
+			Containers: []corev1.Container{
+				{Name: "main", Image: "image-main"},
+			},
+		},
+	}
+
+	script := PodToSlurmPodmanWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+	fetch := strings.Index(script, `vk_run_logged 'fetch' srun podman-hpc run --rm`)
+	render := strings.Index(script, `vk_run_logged 'render' srun podman-hpc run --rm`)
+	main := strings.Index(script, `vk_run_logged 'main' srun podman-hpc run --rm`)
+	if fetch < 0 || render < fetch || main < render {
+		t.Fatalf("init containers not run in order before main container:\n%s", script)
+	}
+	if !strings.Contains(script, "echo \"init container render failed with exit code $rc\" >&2\n  exit 90\n") {
+		t.Fatalf("script does not abort when an init container fails:\n%s", script)
+	}
+
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "image-sidecar"})
+	script = PodToSlurmPodmanMultiWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+	fetch = strings.Index(script, `vk_run_logged 'fetch' podman-hpc run --rm --pod "$POD_ID"`)
+	pids := strings.Index(script, "pids=()")
+	if fetch < 0 || pids < fetch || strings.Contains(script, "srun") {
+		t.Fatalf("init containers not run in the pod before main containers:\n%s", script)
+	}
+}
+
+func TestMultiContainerScriptStopsSidecarsWhenMainContainersExit(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+	grace := int64(5)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "demo",
+			Annotations: map[string]string{SidecarsAnnotation: "shipper"},
+		},
+		Spec: corev1.PodSpec{
+			TerminationGracePeriodSeconds: &grace,
+			InitContainers: []corev1.Container{
+				{Name: "proxy", Image: "image-proxy", RestartPolicy: &always},
+				{Name: "setup", Image: "image-setup"},
+			},
+			Containers: []corev1.Container{
+				{Name: "main", Image: "image-main"},
+				{Name: "shipper", Image: "image-shipper"},
+			},
+		},
+	}
+	script := PodToSlurmPodmanMultiWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+
+	wantFragments := []string{
+		"VK_STOP_GRACE=5\n",
+		"trap vk_stop_sidecars EXIT\n",
+		`--name "$VK_CONTAINER_PREFIX"-'proxy'`,
+		`podman-hpc stop --time "$VK_STOP_GRACE" "$VK_CONTAINER_PREFIX-$name"`,
+		"sidecar_names+=('proxy')\nsidecar_pids+=(\"$!\")",
+		"sidecar_names+=('shipper')\nsidecar_pids+=(\"$!\")",
+	}
+	for _, fragment := range wantFragments {
+		if !strings.Contains(script, fragment) {
+			t.Fatalf("script missing %q:\n%s", fragment, script)
+		}
+	}
+	if got := strings.Count(script, `pids+=("$!")`+"\n"); got != 3 {
+		t.Fatalf("pid capture count = %d, want 1 regular and 2 sidecars", got)
+	}
+	proxy := strings.Index(script, "vk_run_logged 'proxy'")
+	setup := strings.Index(script, "vk_run_logged 'setup'")
+	if proxy < 0 || setup < proxy {
+		t.Fatalf("native sidecar not started before later init containers:\n%s", script)
+	}
+	if strings.Contains(script, "init container proxy failed") {
+		t.Fatalf("native sidecar run as a blocking init container:\n%s", script)
+	}
+}
+
+func TestSidecarsValidatesAnnotation(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{SidecarsAnnotation: " shipper "}},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "proxy", RestartPolicy: &always}},
+			Containers:     []corev1.Container{{Name: "main"}, {Name: "shipper"}},
+		},
+	}
+	names, err := Sidecars(pod)
+	if err != nil {
+		t.Fatalf("Sidecars returned error: %v", err)
+	}
+	if strings.Join(names, ",") != "proxy,shipper" {
+		t.Fatalf("Sidecars = %v, want [proxy shipper]", names)
+	}
+
+	pod.Annotations[SidecarsAnnotation] = "main,shipper"
+	if _, err := Sidecars(pod); err == nil {
+		t.Fatal("Sidecars accepted a pod whose regular containers are all sidecars")
+	}
+	pod.Annotations[SidecarsAnnotation] = "proxy"
+	if _, err := Sidecars(pod); err == nil {
+		t.Fatal("Sidecars accepted an annotation naming an init container")
+	}
+}
+
+func TestScriptRestartsFailingContainersUpToBackoffLimit(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "demo",
+			Annotations: map[string]string{BackoffLimitAnnotation: "2"},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyOnFailure,
+			Containers:    []corev1.Container{{Name: "main", Image: "image-main"}},
+		},
+	}
+	script := PodToSlurmPodmanWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+
+	wantFragments := []string{
+		"#SBATCH --requeue\n",
+		`: >"$JOB_DIR"/'main.out' >"$JOB_DIR"/'main.err'`,
+		`if [ "$rc" -ne 0 ] && [ "$restarts" -lt 2 ] && ! vk_terminating; then`,
+		`vk_finish_container 'main' "$rc" 'File' "$started" "$restarts" true "$finished"`,
+		`if ! vk_backoff "$restarts"; then`,
+		`vk_finish_container 'main' "$rc" 'File' "$started" "$restarts" false "$finished"`,
+		`"restartCount":%d,"restarting":%s`,
+	}
+	for _, fragment := range wantFragments {
+		if !strings.Contains(script, fragment) {
+			t.Fatalf("script missing %q:\n%s", fragment, script)
+		}
+	}
+
+	pod.Spec.RestartPolicy = corev1.RestartPolicyNever
+	script = PodToSlurmPodmanWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+	if strings.Contains(script, `vk_backoff "$restarts"`) {
+		t.Fatalf("script restarts containers with restartPolicy Never:\n%s", script)
+	}
+
+	pod.Spec.RestartPolicy = corev1.RestartPolicyAlways
+	pod.Annotations[BackoffLimitAnnotation] = "invalid"
+	script = PodToSlurmPodmanWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+	if !strings.Contains(script, `[ "$restarts" -lt 6 ]`) {
+		t.Fatalf("script does not fall back to the default backoff limit:\n%s", script)
+	}
+}
+
+func TestScriptMapsDeadlineAndGracePeriodOntoSlurm(t *testing.T) {
+	deadline := int64(90061)
+	grace := int64(45)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo"},
+		Spec: corev1.PodSpec{
+			ActiveDeadlineSeconds:         &deadline,
+			TerminationGracePeriodSeconds: &grace,
+			Containers:                    []corev1.Container{{Name: "main", Image: "image-main"}},
+		},
+	}
+	script := PodToSlurmPodmanWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+
+	wantFragments := []string{
+		"#SBATCH --time=1-01:01:01\n",
+		"#SBATCH --signal=B:TERM@45\n",
+		"VK_CONTAINERS=('main')\n",
+		"VK_STOP_GRACE=45\n",
+		"VK_JOB_END=${SLURM_JOB_END_TIME:-$(($(date +%s) + 90061))}\n",
+		"trap vk_terminate TERM\n",
+		`rm -f -- "$JOB_DIR"/terminating "$JOB_DIR"/deadline`,
+		`vk_now >"$JOB_DIR/terminating"`,
+		// Only a SIGTERM close to the time limit marks the deadline.
+		"[ \"$(date +%s)\" -ge $((VK_JOB_END - VK_STOP_GRACE - 60)) ]\n",
+		"  if vk_at_deadline; then\n    vk_now >\"$JOB_DIR/deadline\"\n  fi\n",
+		// The preStop hook and the stop share the grace period.
+		"VK_STOP_DEADLINE=$((SECONDS + VK_STOP_GRACE))\n",
+		"budget=$(($(vk_grace_left) - 2))\n",
+		`timeout "$budget" "$@"`,
+		`podman-hpc stop --time "$(vk_grace_left)" "$VK_CONTAINER_PREFIX-$1"`,
+	}
+	for _, fragment := range wantFragments {
+		if !strings.Contains(script, fragment) {
+			t.Fatalf("script missing %q:\n%s", fragment, script)
+		}
+	}
+
+	pod.Spec.ActiveDeadlineSeconds = nil
+	grace = 0
+	script = PodToSlurmPodmanWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+	if !strings.Contains(script, "#SBATCH --time=00:30:00\n") {
+		t.Fatalf("script does not use the default time limit:\n%s", script)
+	}
+	if strings.Contains(script, "--signal=") {
+		t.Fatalf("script asks for a signal without a grace period:\n%s", script)
+	}
+}
+
+func TestScriptRunsExecLifecycleHooks(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo"},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{
+				{
+					Name:  "main",
+					Image: "image-main",
+					Lifecycle: &corev1.Lifecycle{
+						PostStart: &corev1.LifecycleHandler{Exec: &corev1.ExecAction{Command: []string{"register", "--name", "it's me"}}},
+						PreStop:   &corev1.LifecycleHandler{Sleep: &corev1.SleepAction{Seconds: 5}},
+					},
+				},
+			},
+		},
+	}
+	if err := ValidateLifecycleHooks(pod); err != nil {
+		t.Fatalf("ValidateLifecycleHooks returned error: %v", err)
+	}
+	script := PodToSlurmPodmanWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+
+	wantFragments := []string{
+		`vk_post_start 'main' podman-hpc exec "$VK_CONTAINER_PREFIX"-'main' 'register' '--name' 'it'"'"'s me' &` + "\nvk_run_logged 'main'",
+		"    'main') vk_pre_stop 'main' sleep 5 ;;\n",
+		"vk_stop_container() {\n  vk_pre_stop_hook \"$1\"\n",
+	}
+	for _, fragment := range wantFragments {
+		if !strings.Contains(script, fragment) {
+			t.Fatalf("script missing %q:\n%s", fragment, script)
+		}
+	}
+
+	pod.Spec.Containers[0].Lifecycle.PostStart = &corev1.LifecycleHandler{TCPSocket: &corev1.TCPSocketAction{}}
+	if err := ValidateLifecycleHooks(pod); err == nil || !strings.Contains(err.Error(), "tcpSocket postStart") {
+		t.Fatalf("ValidateLifecycleHooks error = %v, want tcpSocket postStart error", err)
+	}
+}
+
+func TestScriptRunsExecProbes(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo"},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyOnFailure,
+			Containers: []corev1.Container{
+				{
+					Name:  "main",
+					Image: "image-main",
+					StartupProbe: &corev1.Probe{
+						ProbeHandler:     corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"test", "-e", "/tmp/ready"}}},
+						PeriodSeconds:    2,
+						FailureThreshold: 30,
+					},
+					LivenessProbe: &corev1.Probe{
+						ProbeHandler:        corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"check", "--live"}}},
+						InitialDelaySeconds: 5,
+						TimeoutSeconds:      3,
+					},
+					ReadinessProbe: &corev1.Probe{
+						ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{Path: "/healthz"}},
+					},
+				},
+			},
+		},
+	}
+	script := PodToSlurmPodmanWithVolumes(pod, nil, "/scratch/demo/.vk-nersc")
+
+	wantFragments := []string{
+		`: >"$JOB_DIR"/probes.jsonl`,
+		`    'main:startup') timeout "$2" podman-hpc exec "$VK_CONTAINER_PREFIX"-'main' 'test' '-e' '/tmp/ready' ;;`,
+		`    'main:liveness') timeout "$2" podman-hpc exec "$VK_CONTAINER_PREFIX"-'main' 'check' '--live' ;;`,
+		"  vk_probe_reset 'main' \"$restarts\"\n" +
+			"  vk_probe 'main' startup \"$restarts\" 0 2 1 1 30 false &\n" +
+			"  vk_probe 'main' liveness \"$restarts\" 5 10 3 1 3 true &\n" +
+			"  vk_run_logged 'main'",
+		`if [ "$probe" != readiness ]; then`,
+	}
+	for _, fragment := range wantFragments {
+		if !strings.Contains(script, fragment) {
+			t.Fatalf("script missing %q:\n%s", fragment, script)
+		}
+	}
+	if strings.Contains(script, "readiness \"$restarts\"") {
+		t.Fatalf("script runs the httpGet readiness probe:\n%s", script)
+	}
+
+	pod.Spec.Containers[0].StartupProbe = nil
+	pod.Spec.Containers[0].LivenessProbe = nil
+	if script := PodToSlurmPodmanWithVolumes(pod, nil, "/scratch/demo/.vk-nersc"); strings.Contains(script, "vk_probe") {
+		t.Fatalf("script without exec probes defines probe helpers:\n%s", script)
+	}
+}
+
+func TestParseExecOutputRemovesExitCode(t *testing.T) {
+	command := ExecCommand("123", "main", []string{"sh", "-c", "echo 'hi'"})
+	want := `srun --jobid='123' --overlap podman-hpc exec 'vk-123-main' 'sh' '-c' 'echo '"'"'hi'"'"''; printf '\n__vk_exec_exit_code=%d\n' "$?"`
+	if command != want {
+		t.Fatalf("ExecCommand = %s, want %s", command, want)
+	}
+
+	output, code, ok := ParseExecOutput("no newline\n__vk_exec_exit_code=7\n")
+	if !ok || code != 7 || output != "no newline" {
+		t.Fatalf("ParseExecOutput = %q, %d, %t", output, code, ok)
+	}
+	if _, _, ok := ParseExecOutput("killed\n"); ok {
+		t.Fatal("ParseExecOutput found an exit code in output without one")
+	}
+}
@@ -0,0 +1,36 @@
+package scripts
+
+import (
+	"fmt"
+	"strings"
+)
+
+// containerStatsMarker separates the sstat output of StatsCommand from the
+// podman-hpc stats output.
+const containerStatsMarker = "__vk_container_stats__"
+
+// StatsCommand returns the login node command that samples the resource
+// usage of a running job: sstat for every step of the job, followed by
+// podman-hpc stats for its containers, one "name|cpu nanoseconds|memory
+// bytes" line each. SplitStatsOutput separates the two.
+func StatsCommand(jobID string) string {
+	return fmt.Sprintf(`sstat --noheader --parsable2 --allsteps --format=JobID,TRESUsageInTot,TRESUsageOutTot --jobs=%s; echo %s; srun --jobid=%s --overlap podman-hpc stats --no-stream --format '{{.Name}}|{{.CPUNano}}|{{.ContainerStats.MemUsage}}'`,
+		shellQuote(jobID), containerStatsMarker, shellQuote(jobID))
+}
+
+// SplitStatsOutput splits the output of a StatsCommand into the sstat and
+// podman-hpc stats parts.
+func SplitStatsOutput(output string) (string, string) {
+	sstat, containers, _ := strings.Cut(output, containerStatsMarker+"\n")
+	return sstat, containers
+}
+
+// AccountingFields are the sacct fields AccountingCommand reports, in order.
+var AccountingFields = []string{"JobID", "State", "Account", "QOS", "ElapsedRaw", "TotalCPU", "AllocCPUS", "NNodes", "MaxRSS", "AllocTRES"}
+
+// AccountingCommand returns the login node command that reports the Slurm
+// accounting of a job and each of its steps, one line of AccountingFields
+// separated by "|" each.
+func AccountingCommand(jobID string) string {
+	return fmt.Sprintf("sacct --noheader --parsable2 --jobs=%s --format=%s", shellQuote(jobID), strings.Join(AccountingFields, ","))
+}
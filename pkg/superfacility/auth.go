@@ -0,0 +1,380 @@
+package superfacility
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTokenURL is the token endpoint of NERSC's OpenID Connect server,
+// which issues Superfacility API access tokens.
+const DefaultTokenURL = "https://oidc.nersc.gov/c2id/token"
+
+const (
+	clientAssertionType     = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	clientAssertionLifetime = 5 * time.Minute
+	// tokenRefreshMargin is how long before expiry an access token is
+	// replaced, so requests never carry a token that expires in flight.
+	tokenRefreshMargin = time.Minute
+	// defaultTokenLifetime is assumed for tokens whose expiry is unknown.
+	defaultTokenLifetime = 5 * time.Minute
+	// minTokenLifetime is assumed for tokens that look expired or about to
+	// expire on arrival, which means this host's clock is ahead of the
+	// token server's.
+	minTokenLifetime = 30 * time.Second
+)
+
+// Authenticator supplies the bearer token for Superfacility API requests.
+type Authenticator interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is an Authenticator for a fixed access token.
+type StaticToken string
+
+func (t StaticToken) Token(ctx context.Context) (string, error) {
+	return string(t), nil
+}
+
+// ClientCredentials is an Authenticator that obtains access tokens with the
+// OAuth2 client credentials grant, authenticating the client with a JWT
+// signed by its private key (RFC 7523). Tokens are cached and refreshed
+// shortly before they expire.
+type ClientCredentials struct {
+	clientID string
+	tokenURL string
+	key      crypto.Signer
+	keyID    string
+	http     *http.Client
+	now      func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+// NewClientCredentials returns a ClientCredentials for the client ID and
+// private key NERSC issued for a Superfacility API client. The key may be a
+// PEM encoded RSA or P-256 ECDSA key, or a JWK. An empty tokenURL means
+// DefaultTokenURL.
+func NewClientCredentials(tokenURL, clientID string, privateKey []byte) (*ClientCredentials, error) {
+	clientID = strings.TrimSpace(clientID)
+	if clientID == "" {
+		return nil, fmt.Errorf("client ID is required")
+	}
+	tokenURL = strings.TrimSpace(tokenURL)
+	if tokenURL == "" {
+		tokenURL = DefaultTokenURL
+	}
+	key, keyID, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientCredentials{
+		clientID: clientID,
+		tokenURL: tokenURL,
+		key:      key,
+		keyID:    keyID,
+		http:     &http.Client{Timeout: 30 * time.Second},
+		now:      time.Now,
+	}, nil
+}
+
+// SetHTTPClient sends token requests through client, such as one returned
+// by NewHTTPClient.
+func (c *ClientCredentials) SetHTTPClient(client *http.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.http = client
+}
+
+// Token returns the cached access token, first requesting a new one if it
+// is missing or about to expire.
+func (c *ClientCredentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && c.now().Before(c.refreshAt) {
+		return c.token, nil
+	}
+
+	token, lifetime, err := c.requestToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	margin := tokenRefreshMargin
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	c.token = token
+	c.refreshAt = c.now().Add(lifetime - margin)
+	return token, nil
+}
+
+func (c *ClientCredentials) requestToken(ctx context.Context) (string, time.Duration, error) {
+	assertion, err := c.clientAssertion()
+	if err != nil {
+		return "", 0, err
+	}
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {c.clientID},
+		"client_assertion_type": {clientAssertionType},
+		"client_assertion":      {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("create token request for %s: %w", c.tokenURL, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("request access token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("request access token: %w", newAPIError(resp))
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", 0, fmt.Errorf("decode access token response: %w", err)
+	}
+	if result.AccessToken == "" {
+		return "", 0, fmt.Errorf("access token response did not include access_token")
+	}
+	lifetime := time.Duration(result.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = tokenLifetime(result.AccessToken, c.now())
+	}
+	return result.AccessToken, lifetime, nil
+}
+
+// clientAssertion returns a JWT identifying the client to the token
+// endpoint.
+func (c *ClientCredentials) clientAssertion() (string, error) {
+	alg := "RS256"
+	if _, ok := c.key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if c.keyID != "" {
+		header["kid"] = c.keyID
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("generate client assertion ID: %w", err)
+	}
+	now := c.now()
+	claims := map[string]interface{}{
+		"iss": c.clientID,
+		"sub": c.clientID,
+		"aud": c.tokenURL,
+		"iat": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+		"jti": hex.EncodeToString(jti),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch key := c.key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return "", fmt.Errorf("sign client assertion: %w", err)
+		}
+		// JWS uses the fixed size concatenation of r and s, not ASN.1.
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	default:
+		signature, err = c.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			return "", fmt.Errorf("sign client assertion: %w", err)
+		}
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// tokenLifetime reads the expiry of a JWT access token without verifying
+// it. Tokens that are not JWTs are assumed to last defaultTokenLifetime, and
+// tokens that expire sooner than minTokenLifetime to last that long.
+func tokenLifetime(token string, now time.Time) time.Duration {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return defaultTokenLifetime
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return defaultTokenLifetime
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return defaultTokenLifetime
+	}
+	lifetime := time.Unix(claims.Exp, 0).Sub(now)
+	if lifetime < minTokenLifetime {
+		log.Printf("SF API access token expires in %s by this host's clock, which may be ahead of the token server's; caching it for %s", lifetime.Round(time.Second), minTokenLifetime)
+		return minTokenLifetime
+	}
+	return lifetime
+}
+
+// parsePrivateKey parses a PEM or JWK private key, returning the JWK key ID
+// if there is one.
+func parsePrivateKey(data []byte) (crypto.Signer, string, error) {
+	data = []byte(strings.TrimSpace(string(data)))
+	if len(data) == 0 {
+		return nil, "", fmt.Errorf("private key is required")
+	}
+	if data[0] == '{' {
+		return parseJWK(data)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, "", fmt.Errorf("private key is neither PEM nor JWK")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, "", fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("parse private key: %w", err)
+	}
+	signer, err := checkSigningKey(key)
+	return signer, "", err
+}
+
+func checkSigningKey(key interface{}) (crypto.Signer, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s, only P-256 is supported", key.Curve.Params().Name)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// jwk holds the members of an RSA or EC private JWK.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	D   string `json:"d"`
+	P   string `json:"p"`
+	Q   string `json:"q"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWK parses a private JWK, or the first key of a JWK set.
+func parseJWK(data []byte) (crypto.Signer, string, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, "", fmt.Errorf("parse JWK: %w", err)
+	}
+	var key jwk
+	if len(set.Keys) > 0 {
+		key = set.Keys[0]
+	} else if err := json.Unmarshal(data, &key); err != nil {
+		return nil, "", fmt.Errorf("parse JWK: %w", err)
+	}
+
+	values := make(map[string]*big.Int)
+	for name, value := range map[string]string{"n": key.N, "e": key.E, "d": key.D, "p": key.P, "q": key.Q, "x": key.X, "y": key.Y} {
+		if value == "" {
+			continue
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil {
+			return nil, "", fmt.Errorf("parse JWK member %q: %w", name, err)
+		}
+		values[name] = new(big.Int).SetBytes(raw)
+	}
+	if values["d"] == nil {
+		return nil, "", fmt.Errorf("JWK is not a private key")
+	}
+
+	switch key.Kty {
+	case "RSA":
+		if values["n"] == nil || values["e"] == nil || values["p"] == nil || values["q"] == nil {
+			return nil, "", fmt.Errorf("RSA JWK must include n, e, p and q")
+		}
+		private := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: values["n"], E: int(values["e"].Int64())},
+			D:         values["d"],
+			Primes:    []*big.Int{values["p"], values["q"]},
+		}
+		if err := private.Validate(); err != nil {
+			return nil, "", fmt.Errorf("invalid RSA JWK: %w", err)
+		}
+		private.Precompute()
+		return private, key.Kid, nil
+	case "EC":
+		if key.Crv != "P-256" {
+			return nil, "", fmt.Errorf("unsupported JWK curve %q, only P-256 is supported", key.Crv)
+		}
+		if values["x"] == nil || values["y"] == nil {
+			return nil, "", fmt.Errorf("EC JWK must include x and y")
+		}
+		private := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: values["x"], Y: values["y"]},
+			D:         values["d"],
+		}
+		if !private.Curve.IsOnCurve(private.X, private.Y) {
+			return nil, "", fmt.Errorf("invalid EC JWK: point is not on the curve")
+		}
+		return private, key.Kid, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported JWK key type %q", key.Kty)
+	}
+}
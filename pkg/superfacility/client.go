@@ -8,24 +8,66 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
-const maxErrorBodyBytes = 4096
-
 type Client struct {
 	Endpoint string
 	Token    string
+	// Auth supplies the bearer token of each request in place of Token.
+	Auth Authenticator
+	// Retry controls how failed requests are retried.
+	Retry RetryPolicy
+	// Dialect selects the shapes of the job endpoints, and Machine the
+	// machine whose jobs are managed, or DefaultMachine if empty.
+	Dialect Dialect
+	Machine string
+	// Location is the time zone of the machine's Slurm timestamps, or
+	// DefaultLocation if nil.
+	Location *time.Location
 	http     *http.Client
+
+	timeout   time.Duration
+	timeouts  map[EndpointClass]time.Duration
+	userAgent string
+	hooks     []Hook
+
+	global  *limiter
+	classes map[EndpointClass]*limiter
+
+	// taskPollInterval is the first interval between polls of a task, or
+	// defaultTaskPollInterval if zero.
+	taskPollInterval time.Duration
 }
 
-func New(endpoint, token string) *Client {
-	return &Client{
-		Endpoint: strings.TrimRight(strings.TrimSpace(endpoint), "/"),
-		Token:    strings.TrimSpace(token),
-		http:     &http.Client{Timeout: 30 * time.Second},
-	}
+// New returns a Client for the API at endpoint that authorizes its requests
+// with token, configured by opts.
+func New(endpoint, token string, opts ...ClientOption) *Client {
+	config := newClientConfig(opts)
+	client := &Client{
+		Endpoint:  strings.TrimRight(strings.TrimSpace(endpoint), "/"),
+		Token:     strings.TrimSpace(token),
+		Retry:     DefaultRetryPolicy,
+		Dialect:   DialectNERSC,
+		Machine:   DefaultMachine,
+		http:      &http.Client{Transport: config.roundTripper()},
+		timeout:   config.timeout,
+		timeouts:  config.timeouts,
+		userAgent: config.userAgent,
+		hooks:     config.hooks,
+	}
+	client.SetLimits(DefaultLimits)
+	return client
+}
+
+// NewWithAuthenticator returns a Client that authorizes its requests with
+// auth, such as a ClientCredentials that refreshes expiring tokens.
+func NewWithAuthenticator(endpoint string, auth Authenticator, opts ...ClientOption) *Client {
+	client := New(endpoint, "", opts...)
+	client.Auth = auth
+	return client
 }
 
 type JobSubmissionRequest struct {
@@ -35,8 +77,18 @@ type JobSubmissionRequest struct {
 	Queue   string `json:"queue,omitempty"`
 }
 
+// JobSubmissionResponse is the response to a job submission. The API either
+// reports the job ID directly or the ID of the task that submits the job.
 type JobSubmissionResponse struct {
-	JobID string `json:"jobid"`
+	JobID  string `json:"jobid"`
+	TaskID string `json:"task_id"`
+}
+
+// LogChunk is a byte range read from a job log file.
+type LogChunk struct {
+	Data   []byte
+	Offset int64
+	Size   int64
 }
 
 type GlobusTransferRequest struct {
@@ -121,94 +173,161 @@ func (r GlobusTransferResult) IsComplete() (bool, bool) {
 }
 
 func (c *Client) SubmitJob(ctx context.Context, req JobSubmissionRequest) (string, error) {
-	body, err := json.Marshal(req)
+	out, err := c.startSubmit(ctx, req)
 	if err != nil {
-		return "", fmt.Errorf("marshal job submission: %w", err)
+		return "", err
+	}
+	if out.JobID != "" {
+		return out.JobID, nil
 	}
+	if out.TaskID == "" {
+		return "", fmt.Errorf("submit response missing jobid")
+	}
+	return c.ResolveSubmitTask(ctx, out.TaskID)
+}
 
-	httpReq, err := c.newRequest(ctx, http.MethodPost, "jobs", bytes.NewReader(body))
+// ResolveSubmitTask returns the job submitted by a submit task. If the task
+// cannot be waited for, the error is a *PendingSubmitError and the task
+// should be resolved again rather than the job submitted again.
+func (c *Client) ResolveSubmitTask(ctx context.Context, taskID string) (string, error) {
+	task, err := c.waitForTask(ctx, ClassSubmit, taskID)
+	if err != nil {
+		return "", &PendingSubmitError{TaskID: taskID, Err: fmt.Errorf("submit task %s: %w", taskID, err)}
+	}
+	result, err := jobTaskResult("submit", taskID, task)
 	if err != nil {
 		return "", err
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
+	if result.JobID == "" {
+		return "", fmt.Errorf("submit task %s result missing jobid", taskID)
+	}
+	return string(result.JobID), nil
+}
+
+// startSubmit sends a job submission. Its response is closed before any
+// task is polled, so that it does not count against the limits meanwhile.
+func (c *Client) startSubmit(ctx context.Context, req JobSubmissionRequest) (JobSubmissionResponse, error) {
+	httpReq, err := c.newSubmitRequest(ctx, req)
+	if err != nil {
+		return JobSubmissionResponse{}, err
+	}
 
-	resp, err := c.http.Do(httpReq)
+	resp, err := c.do("SubmitJob", ClassSubmit, httpReq)
 	if err != nil {
-		return "", fmt.Errorf("submit job request: %w", err)
+		return JobSubmissionResponse{}, fmt.Errorf("submit job request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return "", fmt.Errorf("submit failed: %s", responseError(resp))
+		return JobSubmissionResponse{}, fmt.Errorf("submit failed: %w", newAPIError(resp))
 	}
 
 	var out JobSubmissionResponse
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return "", fmt.Errorf("decode submit response: %w", err)
-	}
-	if out.JobID == "" {
-		return "", fmt.Errorf("submit response missing jobid")
+		return JobSubmissionResponse{}, fmt.Errorf("decode submit response: %w", err)
 	}
-	return out.JobID, nil
+	return out, nil
 }
 
+// GetJobStatus returns the Slurm state of a job.
 func (c *Client) GetJobStatus(ctx context.Context, jobID string) (string, error) {
-	req, err := c.newRequest(ctx, http.MethodGet, fmt.Sprintf("jobs/%s", url.PathEscape(jobID)), nil)
+	info, err := c.GetJob(ctx, jobID)
 	if err != nil {
 		return "", err
 	}
+	return info.State, nil
+}
+
+func (c *Client) CancelJob(ctx context.Context, jobID string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, c.jobPath(jobID), nil)
+	if err != nil {
+		return err
+	}
 
-	resp, err := c.http.Do(req)
+	resp, err := c.do("CancelJob", ClassSubmit, req)
 	if err != nil {
-		return "", fmt.Errorf("get job status request: %w", err)
+		return fmt.Errorf("cancel job request: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("status failed: %s", responseError(resp))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		apiErr := newAPIError(resp)
+		resp.Body.Close()
+		return fmt.Errorf("cancel failed: %w", apiErr)
 	}
 
+	// The API may cancel the job asynchronously, in a task. The response is
+	// closed before the task is polled.
 	var out struct {
-		Status string `json:"status"`
+		TaskID string `json:"task_id"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return "", fmt.Errorf("decode status response: %w", err)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("read cancel response: %w", err)
+	}
+	if len(bytes.TrimSpace(body)) == 0 || json.Unmarshal(body, &out) != nil || out.TaskID == "" {
+		return nil
 	}
-	return out.Status, nil
+	_, err = c.resolveJobTask(ctx, "cancel", out.TaskID)
+	return err
 }
 
-func (c *Client) CancelJob(ctx context.Context, jobID string) error {
-	req, err := c.newRequest(ctx, http.MethodDelete, fmt.Sprintf("jobs/%s", url.PathEscape(jobID)), nil)
+// JobSignalRequest asks Slurm to signal a running job, like scancel --signal.
+// With Batch set only the batch shell is signalled, like scancel --batch.
+type JobSignalRequest struct {
+	Signal string `json:"signal"`
+	Batch  bool   `json:"batch"`
+}
+
+// SignalJob sends a signal to a running job's batch script without
+// cancelling the job. The NERSC API has no signal endpoint, so there the
+// signal is sent by scancel run on a login node.
+func (c *Client) SignalJob(ctx context.Context, jobID string, signal JobSignalRequest) error {
+	if c.Dialect != DialectCompat {
+		return c.signalJobCommand(ctx, jobID, signal)
+	}
+	body, err := json.Marshal(signal)
+	if err != nil {
+		return fmt.Errorf("marshal job signal: %w", err)
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, fmt.Sprintf("jobs/%s/signal", url.PathEscape(jobID)), bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.http.Do(req)
+	resp, err := c.do("SignalJob", ClassSubmit, req)
 	if err != nil {
-		return fmt.Errorf("cancel job request: %w", err)
+		return fmt.Errorf("signal job request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("cancel failed: %s", responseError(resp))
+		return fmt.Errorf("signal failed: %w", newAPIError(resp))
 	}
 	return nil
 }
 
+// FetchJobLogs reads a job's standard output. With the NERSC API the file
+// Slurm writes it to is looked up with scontrol and read with commands.
 func (c *Client) FetchJobLogs(ctx context.Context, jobID string) (string, error) {
+	if c.Dialect != DialectCompat {
+		return c.fetchJobStdout(ctx, jobID)
+	}
 	req, err := c.newRequest(ctx, http.MethodGet, fmt.Sprintf("jobs/%s/logs", url.PathEscape(jobID)), nil)
 	if err != nil {
 		return "", err
 	}
 
-	resp, err := c.http.Do(req)
+	resp, err := c.do("FetchJobLogs", ClassLogs, req)
 	if err != nil {
 		return "", fmt.Errorf("fetch job logs request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("logs failed: %s", responseError(resp))
+		return "", fmt.Errorf("logs failed: %w", newAPIError(resp))
 	}
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -217,6 +336,66 @@ func (c *Client) FetchJobLogs(ctx context.Context, jobID string) (string, error)
 	return string(data), nil
 }
 
+// FetchJobLogRange reads part of a job log file with an HTTP range request.
+// A non-negative offset reads from that byte, up to length bytes when length
+// is positive. A negative offset reads the last -offset bytes of the file.
+// Size is -1 when the server does not report the total file size. With the
+// NERSC API the range is read by commands on a login node.
+func (c *Client) FetchJobLogRange(ctx context.Context, jobID, path string, offset, length int64) (LogChunk, error) {
+	if path == "" {
+		return LogChunk{}, fmt.Errorf("log file path is required")
+	}
+	if c.Dialect != DialectCompat {
+		return c.readFileRange(ctx, path, offset, length)
+	}
+
+	query := url.Values{}
+	query.Set("file", path)
+	req, err := c.newRequest(ctx, http.MethodGet, fmt.Sprintf("jobs/%s/logs?%s", url.PathEscape(jobID), query.Encode()), nil)
+	if err != nil {
+		return LogChunk{}, err
+	}
+	req.Header.Set("Range", byteRange(offset, length))
+
+	resp, err := c.do("FetchJobLogRange", ClassLogs, req)
+	if err != nil {
+		return LogChunk{}, fmt.Errorf("fetch job log range request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return LogChunk{}, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return LogChunk{}, fmt.Errorf("read log range response: %w", err)
+		}
+		return LogChunk{Data: data, Offset: start, Size: size}, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		_, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return LogChunk{}, err
+		}
+		if offset < 0 || (size >= 0 && offset > size) {
+			offset = size
+		}
+		return LogChunk{Offset: offset, Size: size}, nil
+	case http.StatusOK:
+		// The server ignored the range, so apply it to the full body here.
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return LogChunk{}, fmt.Errorf("read log range response: %w", err)
+		}
+		chunk, start := applyRange(data, offset, length)
+		return LogChunk{Data: chunk, Offset: start, Size: int64(len(data))}, nil
+	default:
+		return LogChunk{}, fmt.Errorf("log file %s failed: %w", path, newAPIError(resp))
+	}
+}
+
 func (c *Client) StartGlobusTransfer(ctx context.Context, req GlobusTransferRequest) (GlobusTransfer, error) {
 	if req.SourceUUID == "" {
 		return GlobusTransfer{}, fmt.Errorf("source_uuid is required")
@@ -246,14 +425,14 @@ func (c *Client) StartGlobusTransfer(ctx context.Context, req GlobusTransferRequ
 	}
 	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := c.http.Do(httpReq)
+	resp, err := c.do("StartGlobusTransfer", ClassTransfer, httpReq)
 	if err != nil {
 		return GlobusTransfer{}, fmt.Errorf("start globus transfer request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return GlobusTransfer{}, fmt.Errorf("start globus transfer failed: %s", responseError(resp))
+		return GlobusTransfer{}, fmt.Errorf("start globus transfer failed: %w", newAPIError(resp))
 	}
 
 	var out GlobusTransfer
@@ -276,14 +455,14 @@ func (c *Client) CheckGlobusTransfer(ctx context.Context, globusUUID string) (Gl
 		return GlobusTransferResult{}, err
 	}
 
-	resp, err := c.http.Do(req)
+	resp, err := c.do("CheckGlobusTransfer", ClassTransfer, req)
 	if err != nil {
 		return GlobusTransferResult{}, fmt.Errorf("check globus transfer request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return GlobusTransferResult{}, fmt.Errorf("check globus transfer failed: %s", responseError(resp))
+		return GlobusTransferResult{}, fmt.Errorf("check globus transfer failed: %w", newAPIError(resp))
 	}
 
 	var out GlobusTransferResult
@@ -293,6 +472,132 @@ func (c *Client) CheckGlobusTransfer(ctx context.Context, globusUUID string) (Gl
 	return out, nil
 }
 
+// Task is an asynchronous Superfacility API task, such as a command run on
+// a login node. Result holds the task's JSON encoded result once it is done.
+type Task struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Result string `json:"result"`
+}
+
+// Done reports whether the task has finished, successfully or not.
+func (t Task) Done() bool {
+	switch strings.ToLower(t.Status) {
+	case "completed", "failed", "error":
+		return true
+	default:
+		return false
+	}
+}
+
+// CommandResult is the result of a task started by RunCommand. Output is the
+// command's standard output and Error its standard error or the reason it
+// could not be run.
+type CommandResult struct {
+	Status string `json:"status"`
+	Output string `json:"output"`
+	Error  string `json:"error"`
+}
+
+// CommandResult decodes the result of a finished command task.
+func (t Task) CommandResult() (CommandResult, error) {
+	var out CommandResult
+	if strings.TrimSpace(t.Result) == "" {
+		return out, fmt.Errorf("task %s has no result", t.ID)
+	}
+	if err := json.Unmarshal([]byte(t.Result), &out); err != nil {
+		return out, fmt.Errorf("decode result of task %s: %w", t.ID, err)
+	}
+	return out, nil
+}
+
+// RunCommand runs a shell command on a login node of system and returns the
+// ID of the task that reports its result.
+func (c *Client) RunCommand(ctx context.Context, system, command string) (string, error) {
+	return c.runCommand(ctx, ClassStatus, system, command)
+}
+
+// RunCommandAndWait runs a shell command on a login node of system and
+// waits for its task to finish. The task is polled like WaitForTask.
+func (c *Client) RunCommandAndWait(ctx context.Context, system, command string) (CommandResult, error) {
+	taskID, err := c.runCommand(ctx, ClassStatus, system, command)
+	if err != nil {
+		return CommandResult{}, err
+	}
+	task, err := c.waitForTask(ctx, ClassStatus, taskID)
+	if err != nil {
+		return CommandResult{}, fmt.Errorf("command task %s: %w", taskID, err)
+	}
+	return task.CommandResult()
+}
+
+func (c *Client) runCommand(ctx context.Context, class EndpointClass, system, command string) (string, error) {
+	if command == "" {
+		return "", fmt.Errorf("command is required")
+	}
+	form := url.Values{}
+	form.Set("executable", command)
+
+	req, err := c.newRequest(ctx, http.MethodPost, fmt.Sprintf("utilities/command/%s", url.PathEscape(system)), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.do("RunCommand", class, req)
+	if err != nil {
+		return "", fmt.Errorf("run command request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("run command failed: %w", newAPIError(resp))
+	}
+
+	var out struct {
+		TaskID string `json:"task_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("decode run command response: %w", err)
+	}
+	if out.TaskID == "" {
+		return "", fmt.Errorf("run command response missing task id")
+	}
+	return out.TaskID, nil
+}
+
+// GetTask returns the current state of an asynchronous task.
+func (c *Client) GetTask(ctx context.Context, taskID string) (Task, error) {
+	return c.getTask(ctx, ClassStatus, taskID)
+}
+
+func (c *Client) getTask(ctx context.Context, class EndpointClass, taskID string) (Task, error) {
+	if taskID == "" {
+		return Task{}, fmt.Errorf("task id is required")
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, fmt.Sprintf("tasks/%s", url.PathEscape(taskID)), nil)
+	if err != nil {
+		return Task{}, err
+	}
+
+	resp, err := c.do("GetTask", class, req)
+	if err != nil {
+		return Task{}, fmt.Errorf("get task request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Task{}, fmt.Errorf("get task failed: %w", newAPIError(resp))
+	}
+
+	var out Task
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return Task{}, fmt.Errorf("decode task response: %w", err)
+	}
+	return out, nil
+}
+
 func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
 	if ctx == nil {
 		ctx = context.Background()
@@ -306,20 +611,61 @@ func (c *Client) newRequest(ctx context.Context, method, path string, body io.Re
 	if err != nil {
 		return nil, fmt.Errorf("create %s request for %s: %w", method, endpoint, err)
 	}
-	req.Header.Set("Authorization", "Bearer "+c.Token)
+	token := c.Token
+	if c.Auth != nil {
+		token, err = c.Auth.Token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("authenticate %s request for %s: %w", method, endpoint, err)
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
 	return req, nil
 }
 
-func responseError(resp *http.Response) string {
-	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
-	if err != nil {
-		return fmt.Sprintf("%s (failed to read response body: %v)", resp.Status, err)
+func byteRange(offset, length int64) string {
+	if offset < 0 {
+		return fmt.Sprintf("bytes=%d", offset)
+	}
+	if length > 0 {
+		return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
 	}
-	bodyText := strings.TrimSpace(string(body))
-	if bodyText == "" {
-		return resp.Status
+	return fmt.Sprintf("bytes=%d-", offset)
+}
+
+// parseContentRange parses "bytes start-end/size" and "bytes */size" values.
+func parseContentRange(value string) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(value), "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	rangePart, sizePart, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+
+	size := int64(-1)
+	if sizePart != "*" {
+		parsed, err := strconv.ParseInt(sizePart, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range %q: %w", value, err)
+		}
+		size = parsed
+	}
+	if rangePart == "*" {
+		return 0, size, nil
+	}
+	startPart, _, ok := strings.Cut(rangePart, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	start, err := strconv.ParseInt(startPart, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q: %w", value, err)
 	}
-	return fmt.Sprintf("%s: %s", resp.Status, bodyText)
+	return start, size, nil
 }
 
 func firstNonEmpty(values ...string) string {
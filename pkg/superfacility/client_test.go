@@ -1,13 +1,38 @@
 package superfacility
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestSubmitJobSendsRequestAndDecodesJobID(t *testing.T) {
@@ -63,6 +88,76 @@ func TestGetJobStatusEscapesJobID(t *testing.T) {
 	}
 }
 
+func TestSignalJobPostsSignalForBatchScript(t *testing.T) {
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		if r.Method != http.MethodPost {
+			t.Fatalf("method = %s, want POST", r.Method)
+		}
+		if r.URL.EscapedPath() != "/api/v1.2/jobs/job%2F123/signal" {
+			t.Fatalf("escaped path = %s, want /api/v1.2/jobs/job%%2F123/signal", r.URL.EscapedPath())
+		}
+		var req JobSignalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		if req.Signal != "TERM" || !req.Batch {
+			t.Fatalf("unexpected request body: %+v", req)
+		}
+		return response(http.StatusNoContent, ""), nil
+	})
+
+	if err := client.SignalJob(context.Background(), "job/123", JobSignalRequest{Signal: "TERM", Batch: true}); err != nil {
+		t.Fatalf("SignalJob returned error: %v", err)
+	}
+}
+
+func TestRunCommandAndGetTaskResult(t *testing.T) {
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Path {
+		case "/api/v1.2/utilities/command/perlmutter":
+			if r.Method != http.MethodPost {
+				t.Fatalf("method = %s, want POST", r.Method)
+			}
+			if err := r.ParseForm(); err != nil {
+				t.Fatalf("parse form: %v", err)
+			}
+			if got := r.PostForm.Get("executable"); got != "hostname -s" {
+				t.Fatalf("executable = %q, want hostname -s", got)
+			}
+			return response(http.StatusOK, `{"task_id":"17","status":"ok"}`), nil
+		case "/api/v1.2/tasks/17":
+			return response(http.StatusOK, `{"id":"17","status":"completed","result":"{\"status\": \"ok\", \"output\": \"login01\\n\", \"error\": null}"}`), nil
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+			return nil, nil
+		}
+	})
+
+	taskID, err := client.RunCommand(context.Background(), "perlmutter", "hostname -s")
+	if err != nil {
+		t.Fatalf("RunCommand returned error: %v", err)
+	}
+	task, err := client.GetTask(context.Background(), taskID)
+	if err != nil {
+		t.Fatalf("GetTask returned error: %v", err)
+	}
+	if !task.Done() {
+		t.Fatalf("task %+v is not done", task)
+	}
+	result, err := task.CommandResult()
+	if err != nil {
+		t.Fatalf("CommandResult returned error: %v", err)
+	}
+	if result.Output != "login01\n" || result.Error != "" {
+		t.Fatalf("result = %+v, want output login01", result)
+	}
+
+	result, err = client.RunCommandAndWait(context.Background(), "perlmutter", "hostname -s")
+	if err != nil || result.Output != "login01\n" {
+		t.Fatalf("RunCommandAndWait = %+v, %v, want output login01", result, err)
+	}
+}
+
 func TestClientErrorIncludesStatusAndBody(t *testing.T) {
 	client := newTestClient(func(r *http.Request) (*http.Response, error) {
 		return response(http.StatusUnauthorized, "bad token\n"), nil
@@ -88,6 +183,52 @@ func TestSubmitJobRequiresJobID(t *testing.T) {
 	}
 }
 
+func TestFetchJobLogRangeSendsRangeAndDecodesContentRange(t *testing.T) {
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		if got := r.Header.Get("Range"); got != "bytes=-5" {
+			t.Fatalf("range = %q, want bytes=-5", got)
+		}
+		resp := response(http.StatusPartialContent, "done\n")
+		resp.Header.Set("Content-Range", "bytes 20-24/25")
+		return resp, nil
+	})
+
+	chunk, err := client.FetchJobLogRange(context.Background(), "123", "/scratch/demo/.vk-nersc/main.out", -5, 0)
+	if err != nil {
+		t.Fatalf("FetchJobLogRange returned error: %v", err)
+	}
+	if string(chunk.Data) != "done\n" || chunk.Offset != 20 || chunk.Size != 25 {
+		t.Fatalf("chunk = %q offset %d size %d, want done at 20 of 25", chunk.Data, chunk.Offset, chunk.Size)
+	}
+}
+
+func TestFetchJobLogRangeHandlesUnsatisfiableAndIgnoredRanges(t *testing.T) {
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		if r.Header.Get("Range") == "bytes=25-" {
+			resp := response(http.StatusRequestedRangeNotSatisfiable, "")
+			resp.Header.Set("Content-Range", "bytes */25")
+			return resp, nil
+		}
+		return response(http.StatusOK, "0123456789"), nil
+	})
+
+	chunk, err := client.FetchJobLogRange(context.Background(), "123", "main.out", 25, 0)
+	if err != nil {
+		t.Fatalf("FetchJobLogRange returned error: %v", err)
+	}
+	if len(chunk.Data) != 0 || chunk.Offset != 25 || chunk.Size != 25 {
+		t.Fatalf("chunk = %q offset %d size %d, want empty at 25 of 25", chunk.Data, chunk.Offset, chunk.Size)
+	}
+
+	chunk, err = client.FetchJobLogRange(context.Background(), "123", "main.out", 2, 3)
+	if err != nil {
+		t.Fatalf("FetchJobLogRange returned error: %v", err)
+	}
+	if string(chunk.Data) != "234" || chunk.Offset != 2 || chunk.Size != 10 {
+		t.Fatalf("chunk = %q offset %d size %d, want 234 at 2 of 10", chunk.Data, chunk.Offset, chunk.Size)
+	}
+}
+
 func TestStartGlobusTransferUsesFormEndpoint(t *testing.T) {
 	client := newTestClient(func(r *http.Request) (*http.Response, error) {
 		if r.Method != http.MethodPost {
@@ -162,6 +303,7 @@ func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
 func newTestClient(fn roundTripFunc) *Client {
 	client := New("https://api.nersc.gov/api/v1.2/", " token ")
 	client.http = &http.Client{Transport: fn}
+	client.Dialect = DialectCompat
 	return client
 }
 
@@ -173,3 +315,895 @@ func response(statusCode int, body string) *http.Response {
 		Body:       io.NopCloser(strings.NewReader(body)),
 	}
 }
+
+func TestClientCredentialsSignsAssertionAndRefreshesToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	var tokenURL string
+	issued := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("parse form: %v", err)
+		}
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_assertion_type") != clientAssertionType {
+			t.Fatalf("unexpected token request: %v", r.Form)
+		}
+		parts := strings.Split(r.Form.Get("client_assertion"), ".")
+		if len(parts) != 3 {
+			t.Fatalf("client assertion = %q, want a JWT", r.Form.Get("client_assertion"))
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Fatalf("verify client assertion: %v", err)
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]interface{}
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			t.Fatalf("decode claims: %v", err)
+		}
+		if claims["iss"] != "client-1" || claims["sub"] != "client-1" || claims["aud"] != tokenURL {
+			t.Fatalf("claims = %v", claims)
+		}
+		issued++
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":600}`, issued)
+	}))
+	defer server.Close()
+	tokenURL = server.URL + "/token"
+
+	auth, err := NewClientCredentials(tokenURL, "client-1", pemKey)
+	if err != nil {
+		t.Fatalf("NewClientCredentials returned error: %v", err)
+	}
+	now := time.Now()
+	auth.now = func() time.Time { return now }
+
+	client := NewWithAuthenticator("https://api.nersc.gov/api/v1.2", auth)
+	for i := 0; i < 2; i++ {
+		req, err := client.newRequest(context.Background(), http.MethodGet, "tasks", nil)
+		if err != nil {
+			t.Fatalf("newRequest returned error: %v", err)
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer token-1" {
+			t.Fatalf("authorization header = %q, want the cached token", got)
+		}
+	}
+
+	// The token is replaced a minute before it expires.
+	now = now.Add(9*time.Minute + time.Second)
+	if token, err := auth.Token(context.Background()); err != nil || token != "token-2" {
+		t.Fatalf("Token = %q, %v, want token-2", token, err)
+	}
+}
+
+func TestExpiredLookingTokenIsCachedBriefly(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	now := time.Now()
+	issued := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issued++
+		// The host's clock is two minutes ahead of the token server's.
+		claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, now.Add(-2*time.Minute).Unix())))
+		fmt.Fprintf(w, `{"access_token":"header.%s.signature","token_type":"Bearer"}`, claims)
+	}))
+	defer server.Close()
+
+	auth, err := NewClientCredentials(server.URL, "client-1", pemKey)
+	if err != nil {
+		t.Fatalf("NewClientCredentials returned error: %v", err)
+	}
+	auth.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := auth.Token(context.Background()); err != nil {
+			t.Fatalf("Token returned error: %v", err)
+		}
+	}
+	if issued != 1 {
+		t.Fatalf("issued %d tokens, want the first to be cached", issued)
+	}
+	now = now.Add(minTokenLifetime)
+	if _, err := auth.Token(context.Background()); err != nil || issued != 2 {
+		t.Fatalf("Token = %v after %d issued, want a new token once the minimum lifetime passed", err, issued)
+	}
+}
+
+func TestClientCredentialsAcceptsECJWK(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	encode := func(n *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32)))
+	}
+	jwk := fmt.Sprintf(`{"kty":"EC","kid":"key-1","crv":"P-256","x":%q,"y":%q,"d":%q}`, encode(key.X), encode(key.Y), encode(key.D))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.FormValue("client_assertion"), ".")
+		header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		if string(header) != `{"alg":"ES256","kid":"key-1","typ":"JWT"}` {
+			t.Fatalf("header = %s", header)
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if len(signature) != 64 {
+			t.Fatalf("signature is %d bytes, want 64", len(signature))
+		}
+		r1, s1 := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(&key.PublicKey, digest[:], r1, s1) {
+			t.Fatal("client assertion signature does not verify")
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_client"}`)
+	}))
+	defer server.Close()
+
+	auth, err := NewClientCredentials(server.URL, "client-1", []byte(jwk))
+	if err != nil {
+		t.Fatalf("NewClientCredentials returned error: %v", err)
+	}
+	_, err = auth.Token(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized") || !strings.Contains(err.Error(), "invalid_client") {
+		t.Fatalf("Token error = %v, want the token endpoint's error", err)
+	}
+}
+
+func TestFileAuthenticatorReloadsChangedCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("token-1\n"), 0o600); err != nil {
+		t.Fatalf("write token: %v", err)
+	}
+	auth, err := NewFileAuthenticator(CredentialFiles{TokenFile: path})
+	if err != nil {
+		t.Fatalf("NewFileAuthenticator returned error: %v", err)
+	}
+	if token, _ := auth.Token(context.Background()); token != "token-1" {
+		t.Fatalf("Token = %q, want token-1", token)
+	}
+	if reloaded, err := auth.Reload(); reloaded || err != nil {
+		t.Fatalf("Reload of unchanged file = %t, %v", reloaded, err)
+	}
+
+	if err := os.WriteFile(path, []byte("token-2\n"), 0o600); err != nil {
+		t.Fatalf("write token: %v", err)
+	}
+	if reloaded, err := auth.Reload(); !reloaded || err != nil {
+		t.Fatalf("Reload of changed file = %t, %v", reloaded, err)
+	}
+	if token, _ := auth.Token(context.Background()); token != "token-2" {
+		t.Fatalf("Token = %q, want token-2", token)
+	}
+
+	// An invalid update keeps the credentials in use.
+	if err := os.WriteFile(path, []byte("\n"), 0o600); err != nil {
+		t.Fatalf("write token: %v", err)
+	}
+	if _, err := auth.Reload(); err == nil {
+		t.Fatal("Reload accepted an empty token file")
+	}
+	if token, _ := auth.Token(context.Background()); token != "token-2" {
+		t.Fatalf("Token = %q, want token-2", token)
+	}
+}
+
+func TestRequestsAreRetriedOnGatewayErrors(t *testing.T) {
+	attempts := 0
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+		}
+		if attempts == 2 {
+			return response(http.StatusBadGateway, "bad gateway"), nil
+		}
+		return response(http.StatusOK, `{"status":"running"}`), nil
+	})
+	client.Retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+
+	status, err := client.GetJobStatus(context.Background(), "123")
+	if err != nil || status != "running" || attempts != 3 {
+		t.Fatalf("GetJobStatus = %q, %v after %d attempts, want running after 3", status, err, attempts)
+	}
+}
+
+func TestSubmitJobIsOnlyRetriedWhenNotAccepted(t *testing.T) {
+	var bodies []string
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			resp := response(http.StatusTooManyRequests, "slow down")
+			resp.Header.Set("Retry-After", "0")
+			return resp, nil
+		}
+		return response(http.StatusBadGateway, "bad gateway"), nil
+	})
+	client.Retry = RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+
+	// The 429 is retried with the same body, but the 502 may have come after
+	// the job was submitted, so it is not.
+	_, err := client.SubmitJob(context.Background(), JobSubmissionRequest{Script: "#!/bin/bash", System: "perlmutter"})
+	if err == nil || !strings.Contains(err.Error(), "502 Bad Gateway") {
+		t.Fatalf("SubmitJob error = %v, want 502", err)
+	}
+	if len(bodies) != 2 || bodies[0] != bodies[1] || bodies[0] == "" {
+		t.Fatalf("request bodies = %q, want the same body sent twice", bodies)
+	}
+}
+
+func TestRetryAfterBeyondMaxDelayIsNotWaitedOut(t *testing.T) {
+	attempts := 0
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		resp := response(http.StatusServiceUnavailable, "maintenance")
+		resp.Header.Set("Retry-After", "3600")
+		return resp, nil
+	})
+	client.Retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+
+	if err := client.CancelJob(context.Background(), "123"); err == nil || !strings.Contains(err.Error(), "maintenance") || attempts != 1 {
+		t.Fatalf("CancelJob error = %v after %d attempts, want the 503 after 1", err, attempts)
+	}
+	if delay, ok := parseRetryAfter("Wed, 21 Oct 2015 07:28:10 GMT", time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)); !ok || delay != 10*time.Second {
+		t.Fatalf("parseRetryAfter = %s, %t, want 10s", delay, ok)
+	}
+}
+
+func TestLimiterServesJobControlBeforeStatusPolling(t *testing.T) {
+	l := newLimiter(Limit{MaxInFlight: 1})
+	release, err := l.acquire(context.Background(), ClassStatus.priority())
+	if err != nil {
+		t.Fatalf("acquire returned error: %v", err)
+	}
+
+	order := make(chan EndpointClass, 2)
+	waitFor := func(waiters int) {
+		for {
+			l.mu.Lock()
+			n := len(l.waiters)
+			l.mu.Unlock()
+			if n == waiters {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i, class := range []EndpointClass{ClassStatus, ClassSubmit} {
+		go func(class EndpointClass) {
+			r, err := l.acquire(context.Background(), class.priority())
+			if err != nil {
+				t.Errorf("acquire returned error: %v", err)
+				return
+			}
+			order <- class
+			r()
+		}(class)
+		waitFor(i + 1)
+	}
+
+	release()
+	if first, second := <-order, <-order; first != ClassSubmit || second != ClassStatus {
+		t.Fatalf("order = %s, %s, want submit before status", first, second)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	held, _ := l.acquire(context.Background(), 0)
+	if _, err := l.acquire(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquire with cancelled context = %v", err)
+	}
+	held()
+}
+
+func TestJobControlTaskPollsKeepTheirPriority(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		order = append(order, r.URL.Path)
+		mu.Unlock()
+		return response(http.StatusOK, `{"id":"1","status":"completed","result":"{\"status\": \"ok\"}"}`), nil
+	})
+	client.SetLimits(Limits{Global: Limit{MaxInFlight: 1}})
+	held, err := client.global.acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("acquire returned error: %v", err)
+	}
+	waitFor := func(waiters int) {
+		for {
+			client.global.mu.Lock()
+			n := len(client.global.waiters)
+			client.global.mu.Unlock()
+			if n == waiters {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := client.GetTask(context.Background(), "status"); err != nil {
+			t.Errorf("GetTask returned error: %v", err)
+		}
+	}()
+	waitFor(1)
+	go func() {
+		defer wg.Done()
+		if _, err := client.resolveJobTask(context.Background(), "cancel", "cancel"); err != nil {
+			t.Errorf("resolveJobTask returned error: %v", err)
+		}
+	}()
+	waitFor(2)
+	held()
+	wg.Wait()
+
+	if want := []string{"/api/v1.2/tasks/cancel", "/api/v1.2/tasks/status"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("order = %v, want the cancel task polled before the status poll", order)
+	}
+}
+
+func TestLimitsCapRequestRate(t *testing.T) {
+	limits, err := ParseLimits("global=0:0:0, status=50:1:1", DefaultLimits)
+	if err != nil {
+		t.Fatalf("ParseLimits returned error: %v", err)
+	}
+	if limits.Global != (Limit{}) || limits.Classes[ClassStatus] != (Limit{Rate: 50, Burst: 1, MaxInFlight: 1}) || limits.Classes[ClassLogs] != DefaultLimits.Classes[ClassLogs] {
+		t.Fatalf("limits = %+v", limits)
+	}
+	if _, err := ParseLimits("stats=1:1:1", DefaultLimits); err == nil {
+		t.Fatal("ParseLimits accepted an unknown class")
+	}
+
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"status":"running"}`), nil
+	})
+	client.SetLimits(limits)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetJobStatus(ctx, "123"); err != nil {
+			t.Fatalf("GetJobStatus returned error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Fatalf("3 requests at 50/s took %s", elapsed)
+	}
+}
+
+func TestErrorsReportAPIErrorDetails(t *testing.T) {
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		resp := response(http.StatusNotFound, `{"detail":"Job 123 not found"}`)
+		resp.Header.Set("X-Request-Id", "req-1")
+		return resp, nil
+	})
+
+	err := client.CancelJob(context.Background(), "123")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("CancelJob error = %v, want an APIError", err)
+	}
+	if apiErr.Method != http.MethodDelete || apiErr.Endpoint != "/api/v1.2/jobs/123" || apiErr.RequestID != "req-1" || apiErr.Message != "Job 123 not found" {
+		t.Fatalf("APIError = %+v", apiErr)
+	}
+	if err.Error() != `cancel failed: 404 Not Found: {"detail":"Job 123 not found"}` {
+		t.Fatalf("error = %q", err)
+	}
+	if !IsNotFound(err) || IsUnauthorized(err) || IsRateLimited(err) || IsUnavailable(err) {
+		t.Fatalf("sentinel checks disagree with status 404 for %v", err)
+	}
+	if IsNotFound(errors.New("404 Not Found")) {
+		t.Fatal("IsNotFound matched an error that is not an APIError")
+	}
+}
+
+func TestSubmitJobWaitsForSubmissionTask(t *testing.T) {
+	polls := 0
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Path {
+		case "/api/v1.2/jobs":
+			return response(http.StatusOK, `{"task_id":"42","status":"ok"}`), nil
+		case "/api/v1.2/tasks/42":
+			polls++
+			if polls < 3 {
+				return response(http.StatusOK, `{"id":"42","status":"new","result":null}`), nil
+			}
+			return response(http.StatusOK, `{"id":"42","status":"completed","result":"{\"status\": \"ok\", \"jobid\": 9876}"}`), nil
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+			return nil, nil
+		}
+	})
+	client.taskPollInterval = time.Millisecond
+
+	jobID, err := client.SubmitJob(context.Background(), JobSubmissionRequest{Script: "script", System: "perlmutter"})
+	if err != nil {
+		t.Fatalf("SubmitJob returned error: %v", err)
+	}
+	if jobID != "9876" || polls != 3 {
+		t.Fatalf("job ID = %q after %d polls, want 9876 after 3", jobID, polls)
+	}
+}
+
+func TestUnresolvedSubmitTaskIsReturnedForResolvingLater(t *testing.T) {
+	submits := 0
+	taskUp := false
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Path {
+		case "/api/v1.2/jobs":
+			submits++
+			return response(http.StatusOK, `{"task_id":"42","status":"ok"}`), nil
+		case "/api/v1.2/tasks/42":
+			if !taskUp {
+				return response(http.StatusServiceUnavailable, "maintenance"), nil
+			}
+			return response(http.StatusOK, `{"id":"42","status":"completed","result":"{\"status\": \"ok\", \"jobid\": 9876}"}`), nil
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+			return nil, nil
+		}
+	})
+	client.Retry = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+
+	_, err := client.SubmitJob(context.Background(), JobSubmissionRequest{Script: "script", System: "perlmutter"})
+	var pending *PendingSubmitError
+	if !errors.As(err, &pending) || pending.TaskID != "42" || !IsUnavailable(err) {
+		t.Fatalf("SubmitJob error = %v, want a pending submit of task 42", err)
+	}
+
+	taskUp = true
+	jobID, err := client.ResolveSubmitTask(context.Background(), pending.TaskID)
+	if err != nil || jobID != "9876" || submits != 1 {
+		t.Fatalf("ResolveSubmitTask = %q, %v after %d submits, want 9876 after 1", jobID, err, submits)
+	}
+}
+
+func TestJobTaskFailuresAreErrors(t *testing.T) {
+	results := map[string]string{
+		"/api/v1.2/tasks/1": `{"id":"1","status":"completed","result":"{\"status\": \"error\", \"jobid\": null, \"error\": \"sbatch: error: invalid account\"}"}`,
+		"/api/v1.2/tasks/2": `{"id":"2","status":"completed","result":"{\"status\": \"error\", \"error\": \"scancel: error: Invalid job id specified\"}"}`,
+	}
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Path {
+		case "/api/v1.2/jobs":
+			return response(http.StatusOK, `{"task_id":"1"}`), nil
+		case "/api/v1.2/jobs/123":
+			return response(http.StatusOK, `{"task_id":"2","status":"ok"}`), nil
+		}
+		if body, ok := results[r.URL.Path]; ok {
+			return response(http.StatusOK, body), nil
+		}
+		t.Fatalf("unexpected path %s", r.URL.Path)
+		return nil, nil
+	})
+
+	_, err := client.SubmitJob(context.Background(), JobSubmissionRequest{Script: "script", System: "perlmutter"})
+	if err == nil || !strings.Contains(err.Error(), "invalid account") {
+		t.Fatalf("SubmitJob error = %v, want the task's error", err)
+	}
+	err = client.CancelJob(context.Background(), "123")
+	if !IsNotFound(err) {
+		t.Fatalf("CancelJob error = %v, want not found", err)
+	}
+}
+
+func TestNERSCDialectSubmitsFormToMachine(t *testing.T) {
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Path {
+		case "/api/v1.2/compute/jobs/perlmutter":
+			if err := r.ParseForm(); err != nil {
+				t.Fatalf("parse form: %v", err)
+			}
+			want := "#!/bin/bash\n#SBATCH --account=m1234\n#SBATCH --qos=regular\nhostname\n"
+			if got := r.PostForm.Get("job"); got != want || r.PostForm.Get("isPath") != "false" {
+				t.Fatalf("form = %q, want job %q", r.PostForm, want)
+			}
+			return response(http.StatusOK, `{"task_id":"5","status":"ok"}`), nil
+		case "/api/v1.2/tasks/5":
+			return response(http.StatusOK, `{"id":"5","status":"completed","result":"{\"status\": \"ok\", \"jobid\": \"321\"}"}`), nil
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+			return nil, nil
+		}
+	})
+	client.Dialect = DialectNERSC
+
+	jobID, err := client.SubmitJob(context.Background(), JobSubmissionRequest{
+		Script:  "#!/bin/bash\nhostname\n",
+		System:  "perlmutter",
+		Queue:   "regular",
+		Project: "m1234",
+	})
+	if err != nil || jobID != "321" {
+		t.Fatalf("SubmitJob = %q, %v, want 321", jobID, err)
+	}
+}
+
+func TestNERSCDialectDecodesSacctJob(t *testing.T) {
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/api/v1.2/compute/jobs/perlmutter/404" {
+			return response(http.StatusOK, `{"status":"OK","output":[],"error":null}`), nil
+		}
+		if r.URL.Path != "/api/v1.2/compute/jobs/perlmutter/123" || r.URL.Query().Get("sacct") != "true" {
+			t.Fatalf("unexpected request %s", r.URL)
+		}
+		return response(http.StatusOK, `{"status":"OK","error":null,"output":[
+			{"jobid":"123","jobname":"pod","state":"CANCELLED by 5678","exitcode":"0:15","nodelist":"nid001234","reason":"None","qos":"regular_1","account":"m1234","start":"2024-05-01T10:00:00","end":"Unknown","elapsedraw":"90"},
+			{"jobid":"123.batch","state":"CANCELLED","exitcode":"0:15"}]}`), nil
+	})
+	client.Dialect = DialectNERSC
+
+	info, err := client.GetJob(context.Background(), "123")
+	if err != nil {
+		t.Fatalf("GetJob returned error: %v", err)
+	}
+	if info.JobID != "123" || info.State != "CANCELLED" || info.Signal != 15 || info.NodeList != "nid001234" || info.Reason != "" || info.Elapsed != 90*time.Second {
+		t.Fatalf("job = %+v", info)
+	}
+	// Slurm's timestamps are in Perlmutter's time zone, whatever the
+	// provider's.
+	if want := time.Date(2024, 5, 1, 17, 0, 0, 0, time.UTC); !info.Start.Equal(want) || !info.End.IsZero() {
+		t.Fatalf("start = %s, end = %s, want a start time of %s only", info.Start, info.End, want)
+	}
+	client.Location = time.UTC
+	if info, err := client.GetJob(context.Background(), "123"); err != nil || !info.Start.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("GetJob in UTC = %s, %v, want a start at 10:00 UTC", info.Start, err)
+	}
+	if status, err := client.GetJobStatus(context.Background(), "123"); err != nil || status != "CANCELLED" {
+		t.Fatalf("GetJobStatus = %q, %v, want CANCELLED", status, err)
+	}
+	if _, err := client.GetJob(context.Background(), "404"); !IsNotFound(err) {
+		t.Fatalf("GetJob error = %v, want not found", err)
+	}
+}
+
+func TestNERSCDialectSignalsAndReadsLogsWithUtilities(t *testing.T) {
+	var commands []string
+	var results []string
+	reads := 0
+	files := map[string]string{"/scratch/pod.out": "hello world\n", "/scratch/big.out": strings.Repeat("x", 6<<20)}
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1.2/utilities/command/perlmutter":
+			command := r.FormValue("executable")
+			if output, ok := readCommandOutput(files, command); ok {
+				reads++
+				body, _ := json.Marshal(CommandResult{Status: "ok", Output: output})
+				results = append(results, string(body))
+				return response(http.StatusOK, fmt.Sprintf(`{"task_id":"%d"}`, len(results))), nil
+			}
+			commands = append(commands, command)
+			switch {
+			case strings.HasSuffix(command, "'404'"):
+				results = append(results, `{"status": "error", "output": "", "error": "scancel: error: Kill job error on job id 404: Invalid job id specified"}`)
+			case strings.HasPrefix(command, "scontrol"):
+				results = append(results, `{"status": "ok", "output": "JobId=123 JobName=pod StdOut=/scratch/pod.out StdErr=/scratch/pod.err", "error": null}`)
+			default:
+				results = append(results, `{"status": "ok", "output": "", "error": null}`)
+			}
+			return response(http.StatusOK, fmt.Sprintf(`{"task_id":"%d"}`, len(results))), nil
+		case strings.HasPrefix(r.URL.Path, "/api/v1.2/tasks/"):
+			id := strings.TrimPrefix(r.URL.Path, "/api/v1.2/tasks/")
+			n, _ := strconv.Atoi(id)
+			body, _ := json.Marshal(Task{ID: id, Status: "completed", Result: results[n-1]})
+			return response(http.StatusOK, string(body)), nil
+		default:
+			t.Fatalf("unexpected request %s %s", r.Method, r.URL)
+			return nil, nil
+		}
+	})
+	client.Dialect = DialectNERSC
+	client.taskPollInterval = time.Millisecond
+	ctx := context.Background()
+
+	if err := client.SignalJob(ctx, "123", JobSignalRequest{Signal: "TERM", Batch: true}); err != nil {
+		t.Fatalf("SignalJob returned error: %v", err)
+	}
+	if err := client.SignalJob(ctx, "404", JobSignalRequest{Signal: "USR1"}); !IsNotFound(err) {
+		t.Fatalf("SignalJob error = %v, want not found", err)
+	}
+	if err := client.SignalJob(ctx, "123", JobSignalRequest{Signal: "TERM; true"}); err == nil {
+		t.Fatal("SignalJob accepted an invalid signal")
+	}
+	logs, err := client.FetchJobLogs(ctx, "123")
+	if err != nil || logs != "hello world\n" {
+		t.Fatalf("FetchJobLogs = %q, %v", logs, err)
+	}
+	chunk, err := client.FetchJobLogRange(ctx, "123", "/scratch/pod.out", -6, 0)
+	if err != nil || string(chunk.Data) != "world\n" || chunk.Offset != 6 || chunk.Size != 12 {
+		t.Fatalf("FetchJobLogRange = %+v, %v", chunk, err)
+	}
+	if _, err := client.FetchJobLogRange(ctx, "123", "/scratch/missing.out", 0, 10); !IsNotFound(err) {
+		t.Fatalf("FetchJobLogRange error = %v, want not found", err)
+	}
+
+	// Ranges are read on the login node, a command per MiB, so logs larger
+	// than a download are never read whole.
+	reads = 0
+	chunk, err = client.FetchJobLogRange(ctx, "123", "/scratch/big.out", 1<<20, 0)
+	if err != nil || len(chunk.Data) != 5<<20 || chunk.Offset != 1<<20 || chunk.Size != 6<<20 {
+		t.Fatalf("FetchJobLogRange = %d bytes at %d of %d, %v", len(chunk.Data), chunk.Offset, chunk.Size, err)
+	}
+	if reads != 5 {
+		t.Fatalf("read commands = %d, want 5", reads)
+	}
+	chunk, err = client.FetchJobLogRange(ctx, "123", "/scratch/big.out", 100, 10)
+	if err != nil || string(chunk.Data) != "xxxxxxxxxx" || chunk.Offset != 100 {
+		t.Fatalf("FetchJobLogRange = %+v, %v", chunk, err)
+	}
+
+	want := []string{"scancel --signal=TERM --batch '123'", "scancel --signal=USR1 '404'", "scontrol show job -o '123'"}
+	if !reflect.DeepEqual(commands, want) {
+		t.Fatalf("commands = %q, want %q", commands, want)
+	}
+}
+
+var readCommandPattern = regexp.MustCompile(`(?s)^f='([^']*)' o=(-?\d+)\n.*head -c (\d+) \| base64$`)
+
+// readCommandOutput answers a command of readFileCommand from files as the
+// shell would.
+func readCommandOutput(files map[string]string, command string) (string, bool) {
+	m := readCommandPattern.FindStringSubmatch(command)
+	if m == nil {
+		return "", false
+	}
+	data, ok := files[m[1]]
+	if !ok {
+		return "missing\n", true
+	}
+	offset, _ := strconv.ParseInt(m[2], 10, 64)
+	count, _ := strconv.ParseInt(m[3], 10, 64)
+	chunk, start := applyRange([]byte(data), offset, 0)
+	if int64(len(chunk)) > count {
+		chunk = chunk[:count]
+	}
+	return fmt.Sprintf("%d %d\n%s\n", start, len(data), base64.StdEncoding.EncodeToString(chunk)), true
+}
+
+func TestClientTrustsCABundleAndSetsUserAgent(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("User-Agent"); got != "site-agent/1.0" {
+			t.Errorf("user agent = %q", got)
+		}
+		fmt.Fprint(w, `{"status":"running"}`)
+	}))
+	// The untrusted client's handshake fails by design.
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := LoadCABundle(bundle)
+	if err != nil {
+		t.Fatalf("LoadCABundle returned error: %v", err)
+	}
+
+	untrusted := New(server.URL, "token")
+	untrusted.Dialect = DialectCompat
+	untrusted.Retry = RetryPolicy{MaxAttempts: 1}
+	if _, err := untrusted.GetJobStatus(context.Background(), "123"); err == nil {
+		t.Fatal("GetJobStatus trusted the test server without its CA bundle")
+	}
+	client := New(server.URL, "token", WithRootCAs(pool), WithUserAgent("site-agent/1.0"))
+	client.Dialect = DialectCompat
+	if status, err := client.GetJobStatus(context.Background(), "123"); err != nil || status != "running" {
+		t.Fatalf("GetJobStatus = %q, %v, want running", status, err)
+	}
+}
+
+func TestClassTimeoutBoundsEachAttempt(t *testing.T) {
+	attempts := 0
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("attempt has no deadline")
+		}
+		return response(http.StatusOK, `{"status":"running"}`), nil
+	})
+	client := New("https://api.nersc.gov/api/v1.2", "token", WithTransport(transport), WithClassTimeout(ClassStatus, 20*time.Millisecond))
+	client.Dialect = DialectCompat
+	client.Retry = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	status, err := client.GetJobStatus(context.Background(), "123")
+	if err != nil || status != "running" || attempts != 2 {
+		t.Fatalf("GetJobStatus = %q, %v after %d attempts, want running after 2", status, err, attempts)
+	}
+
+	opts, err := ParseTimeouts("default=1m, logs=0")
+	if err != nil || len(opts) != 2 {
+		t.Fatalf("ParseTimeouts = %d options, %v", len(opts), err)
+	}
+	if _, err := ParseTimeouts("exec=1m"); err == nil {
+		t.Fatal("ParseTimeouts accepted an unknown class")
+	}
+}
+
+func TestHooksObserveEachCall(t *testing.T) {
+	attempts := 0
+	recorder := &CallRecorder{}
+	var logged bytes.Buffer
+	client := New("https://api.nersc.gov/api/v1.2", "secret-token",
+		WithTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			switch r.URL.Path {
+			case "/api/v1.2/jobs":
+				attempts++
+				if attempts == 1 {
+					return response(http.StatusServiceUnavailable, "maintenance"), nil
+				}
+				return response(http.StatusOK, `{"task_id":"7"}`), nil
+			case "/api/v1.2/tasks/7":
+				return response(http.StatusOK, `{"id":"7","status":"completed","result":"{\"status\": \"ok\", \"jobid\": \"55\"}"}`), nil
+			default:
+				return response(http.StatusNotFound, "no such job"), nil
+			}
+		})),
+		WithHooks(recorder, DebugLogger(log.New(&logged, "", 0))),
+	)
+	client.Dialect = DialectCompat
+	client.Retry = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	if _, err := client.SubmitJob(context.Background(), JobSubmissionRequest{Script: "script", System: "perlmutter"}); err != nil {
+		t.Fatalf("SubmitJob returned error: %v", err)
+	}
+	client.GetJobStatus(context.Background(), "404")
+
+	if got, want := strings.Join(recorder.Operations(), ","), "SubmitJob,GetTask,GetJob"; got != want {
+		t.Fatalf("operations = %s, want %s", got, want)
+	}
+	calls := recorder.Calls()
+	submit := calls[0]
+	if submit.StatusCode != http.StatusOK || submit.Retries != 1 || submit.Class != ClassSubmit || submit.BytesSent == 0 || submit.BytesReceived != int64(len(`{"task_id":"7"}`)) {
+		t.Fatalf("submit call = %+v", submit)
+	}
+	if got := submit.Header.Get("Authorization"); got != "REDACTED" {
+		t.Fatalf("recorded authorization header = %q", got)
+	}
+	if calls[2].StatusCode != http.StatusNotFound {
+		t.Fatalf("status call = %+v, want a 404", calls[2])
+	}
+	if strings.Contains(logged.String(), "secret-token") || !strings.Contains(logged.String(), "SF API GetTask: GET") {
+		t.Fatalf("debug log = %q", logged.String())
+	}
+}
+
+func TestMetricsCountCallsByOperationAndCode(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics, err := NewMetrics(reg)
+	if err != nil {
+		t.Fatalf("NewMetrics returned error: %v", err)
+	}
+	metrics.ObserveCall(Call{Operation: "GetJob", StatusCode: http.StatusOK, Duration: time.Second, BytesReceived: 10})
+	metrics.ObserveCall(Call{Operation: "GetJob", StatusCode: http.StatusOK, Retries: 2})
+	metrics.ObserveCall(Call{Operation: "SubmitJob", Err: errors.New("dial tcp: refused")})
+
+	if got := testutil.ToFloat64(metrics.requests.WithLabelValues("GetJob", "200")); got != 2 {
+		t.Fatalf("GetJob 200 requests = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.requests.WithLabelValues("SubmitJob", "error")); got != 1 {
+		t.Fatalf("SubmitJob error requests = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.retries.WithLabelValues("GetJob")); got != 2 {
+		t.Fatalf("GetJob retries = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.bytes.WithLabelValues("GetJob", "received")); got != 10 {
+		t.Fatalf("GetJob bytes received = %v, want 10", got)
+	}
+	if _, err := NewMetrics(reg); err == nil {
+		t.Fatal("NewMetrics registered the same metrics twice")
+	}
+}
+
+func TestUploadFileStreamsMultipartForm(t *testing.T) {
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		if r.Method != http.MethodPut || r.URL.EscapedPath() != "/api/v1.2/utilities/upload/perlmutter/%2Fpscratch%2Fsd%2Fa%2Falice%2Fconfig.yaml" {
+			t.Fatalf("request = %s %s", r.Method, r.URL.EscapedPath())
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Fatalf("parse multipart form: %v", err)
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			t.Fatalf("form file: %v", err)
+		}
+		data, _ := io.ReadAll(file)
+		if header.Filename != "config.yaml" || string(data) != "key: value\n" {
+			t.Fatalf("uploaded %s = %q", header.Filename, data)
+		}
+		return response(http.StatusOK, `{"status":"OK","output":"","error":null}`), nil
+	})
+
+	content := "key: value\n"
+	if err := client.UploadFile(context.Background(), "/pscratch/sd/a/alice/config.yaml", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("UploadFile returned error: %v", err)
+	}
+	err := client.UploadFile(context.Background(), "/tmp/big", strings.NewReader(""), MaxFileSize+1)
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("UploadFile error = %v, want ErrFileTooLarge", err)
+	}
+}
+
+func TestDownloadFileDecodesRangesAndLimits(t *testing.T) {
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		switch r.URL.EscapedPath() {
+		case "/api/v1.2/utilities/download/perlmutter/%2Fjob%2Fstatus.json":
+			// The NERSC API ignores the range and returns the file as JSON.
+			if r.URL.Query().Get("binary") != "true" || r.Header.Get("Range") != "bytes=-4" {
+				t.Fatalf("query = %s, range = %q", r.URL.RawQuery, r.Header.Get("Range"))
+			}
+			resp := response(http.StatusOK, `{"status":"OK","file":"aGVsbG8gd29ybGQ=","is_binary":true,"error":null}`)
+			resp.Header.Set("Content-Type", "application/json")
+			return resp, nil
+		case "/api/v1.2/utilities/download/perlmutter/%2Fjob%2Fmissing":
+			resp := response(http.StatusOK, `{"status":"ERROR","file":null,"error":"No such file or directory"}`)
+			resp.Header.Set("Content-Type", "application/json")
+			return resp, nil
+		case "/api/v1.2/utilities/download/perlmutter/%2Fjob%2Fhuge":
+			return response(http.StatusOK, strings.Repeat("x", MaxFileSize+1)), nil
+		default:
+			t.Fatalf("unexpected path %s", r.URL.EscapedPath())
+			return nil, nil
+		}
+	})
+
+	body, err := client.DownloadFile(context.Background(), "/job/status.json", -4, 0)
+	if err != nil {
+		t.Fatalf("DownloadFile returned error: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "orld" {
+		t.Fatalf("downloaded %q, want orld", data)
+	}
+
+	if _, err := client.DownloadFile(context.Background(), "/job/missing", 0, 0); !IsNotFound(err) {
+		t.Fatalf("DownloadFile error = %v, want not found", err)
+	}
+
+	body, err = client.DownloadFile(context.Background(), "/job/huge", 0, 0)
+	if err != nil {
+		t.Fatalf("DownloadFile returned error: %v", err)
+	}
+	defer body.Close()
+	if _, err := io.Copy(io.Discard, body); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("reading oversized download error = %v, want ErrFileTooLarge", err)
+	}
+}
+
+func TestListDirectoryDecodesEntries(t *testing.T) {
+	client := newTestClient(func(r *http.Request) (*http.Response, error) {
+		if r.URL.EscapedPath() != "/api/v1.2/utilities/ls/perlmutter/%2Fjob" {
+			t.Fatalf("unexpected path %s", r.URL.EscapedPath())
+		}
+		return response(http.StatusOK, `{"status":"OK","error":null,"entries":[
+			{"perms":"drwxr-x---","hardlinks":2,"user":"alice","group":"alice","size":4096,"date":"2024-05-01T10:00:00","name":"out"},
+			{"perms":"-rw-r--r--","hardlinks":1,"user":"alice","group":"alice","size":12,"date":"2024-05-01T10:00:00","name":"status.json"}]}`), nil
+	})
+
+	entries, err := client.ListDirectory(context.Background(), "/job")
+	if err != nil {
+		t.Fatalf("ListDirectory returned error: %v", err)
+	}
+	if len(entries) != 2 || !entries[0].IsDir() || entries[1].IsDir() || entries[1].Name != "status.json" || entries[1].Size != 12 {
+		t.Fatalf("entries = %+v", entries)
+	}
+}
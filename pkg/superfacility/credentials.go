@@ -0,0 +1,161 @@
+package superfacility
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CredentialFiles names the files that hold Superfacility API credentials,
+// such as the keys of a mounted Secret. Set TokenFile for a static access
+// token, or PrivateKeyFile with ClientID or ClientIDFile for client
+// credentials. HTTPClient, if set, sends the token requests of client
+// credentials.
+type CredentialFiles struct {
+	TokenFile      string
+	ClientID       string
+	ClientIDFile   string
+	PrivateKeyFile string
+	TokenURL       string
+	HTTPClient     *http.Client
+}
+
+func (f CredentialFiles) paths() []string {
+	var paths []string
+	for _, path := range []string{f.TokenFile, f.ClientIDFile, f.PrivateKeyFile} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// FileAuthenticator is an Authenticator whose credentials are read from
+// files and swapped when the files change. Requests already sent keep the
+// token they were sent with.
+type FileAuthenticator struct {
+	files CredentialFiles
+
+	reloadMu sync.Mutex
+	contents [][]byte
+
+	mu   sync.RWMutex
+	auth Authenticator
+}
+
+// NewFileAuthenticator reads the credentials in files.
+func NewFileAuthenticator(files CredentialFiles) (*FileAuthenticator, error) {
+	if (files.TokenFile == "") == (files.PrivateKeyFile == "") {
+		return nil, fmt.Errorf("exactly one of a token file and a private key file is required")
+	}
+	a := &FileAuthenticator{files: files}
+	if _, err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *FileAuthenticator) Token(ctx context.Context) (string, error) {
+	a.mu.RLock()
+	auth := a.auth
+	a.mu.RUnlock()
+	return auth.Token(ctx)
+}
+
+// Reload rereads the credential files and, if they changed, replaces the
+// credentials in use. It reports whether they were replaced. Invalid
+// credentials are rejected and the previous ones stay in use.
+func (a *FileAuthenticator) Reload() (bool, error) {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	contents := make([][]byte, 0, len(a.files.paths()))
+	for _, path := range a.files.paths() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return false, fmt.Errorf("read credentials: %w", err)
+		}
+		contents = append(contents, data)
+	}
+	if a.contents != nil && equalContents(a.contents, contents) {
+		return false, nil
+	}
+
+	auth, err := a.load(contents)
+	if err != nil {
+		return false, err
+	}
+	a.mu.Lock()
+	a.auth = auth
+	a.mu.Unlock()
+	a.contents = contents
+	return true, nil
+}
+
+// load builds an Authenticator from the contents of the credential files,
+// which are in the order of CredentialFiles.paths.
+func (a *FileAuthenticator) load(contents [][]byte) (Authenticator, error) {
+	if a.files.TokenFile != "" {
+		token := strings.TrimSpace(string(contents[0]))
+		if token == "" {
+			return nil, fmt.Errorf("token file %s is empty", a.files.TokenFile)
+		}
+		return StaticToken(token), nil
+	}
+
+	clientID := a.files.ClientID
+	key := contents[0]
+	if a.files.ClientIDFile != "" {
+		clientID = string(contents[0])
+		key = contents[1]
+	}
+	auth, err := NewClientCredentials(a.files.TokenURL, clientID, key)
+	if err != nil {
+		return nil, fmt.Errorf("load client credentials: %w", err)
+	}
+	if a.files.HTTPClient != nil {
+		auth.SetHTTPClient(a.files.HTTPClient)
+	}
+	return auth, nil
+}
+
+// Watch reloads the credentials every interval until ctx is done, logging
+// each reload and each failure.
+func (a *FileAuthenticator) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := a.Reload()
+		if err != nil {
+			log.Printf("Failed to reload SF API credentials, keeping the current ones: %v", err)
+			continue
+		}
+		if reloaded {
+			log.Printf("Reloaded SF API credentials from %s", strings.Join(a.files.paths(), ", "))
+		}
+	}
+}
+
+func equalContents(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,441 @@
+package superfacility
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	// The default location must load in images without a zoneinfo
+	// database.
+	_ "time/tzdata"
+)
+
+// DefaultMachine is the machine whose jobs a Client manages unless its
+// Machine is set.
+const DefaultMachine = "perlmutter"
+
+// maxCommandReadBytes bounds the bytes of a file that one command reads,
+// since they reach the API base64 encoded in the command's output.
+const maxCommandReadBytes = 1 << 20
+
+// DefaultTimeZone is the time zone of Perlmutter's Slurm, whose timestamps
+// carry no zone.
+const DefaultTimeZone = "America/Los_Angeles"
+
+// DefaultLocation is the location of DefaultTimeZone.
+var DefaultLocation = mustLoadLocation(DefaultTimeZone)
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// Dialect selects the shapes of the job endpoints a Client speaks.
+type Dialect string
+
+const (
+	// DialectNERSC speaks NERSC's Superfacility API: jobs are submitted to
+	// POST compute/jobs/{machine} and queried with
+	// GET compute/jobs/{machine}/{jobid}?sacct=true.
+	DialectNERSC Dialect = "nersc"
+	// DialectCompat speaks the simplified shapes of earlier versions of the
+	// provider: JSON submissions to POST jobs and a flat status from
+	// GET jobs/{jobid}.
+	DialectCompat Dialect = "compat"
+)
+
+// ParseDialect parses a dialect name. An empty name is DialectNERSC.
+func ParseDialect(name string) (Dialect, error) {
+	switch dialect := Dialect(strings.ToLower(strings.TrimSpace(name))); dialect {
+	case "":
+		return DialectNERSC, nil
+	case DialectNERSC, DialectCompat:
+		return dialect, nil
+	default:
+		return "", fmt.Errorf("unknown Superfacility API dialect %q, want %q or %q", name, DialectNERSC, DialectCompat)
+	}
+}
+
+// JobInfo describes a Slurm job. State is the Slurm state, such as PENDING,
+// RUNNING or CANCELLED. In the compatibility dialect only JobID and State are
+// known.
+type JobInfo struct {
+	JobID     string
+	Name      string
+	State     string
+	Reason    string
+	ExitCode  int
+	Signal    int
+	NodeList  string
+	Partition string
+	QOS       string
+	Account   string
+	User      string
+	Submit    time.Time
+	Start     time.Time
+	End       time.Time
+	Elapsed   time.Duration
+}
+
+// sacctRecord is a job record as reported by GET compute/jobs with
+// sacct=true. The API passes most fields through from sacct as strings.
+type sacctRecord struct {
+	JobID      apiString `json:"jobid"`
+	JobName    apiString `json:"jobname"`
+	State      apiString `json:"state"`
+	Reason     apiString `json:"reason"`
+	ExitCode   apiString `json:"exitcode"`
+	NodeList   apiString `json:"nodelist"`
+	Partition  apiString `json:"partition"`
+	QOS        apiString `json:"qos"`
+	Account    apiString `json:"account"`
+	User       apiString `json:"user"`
+	Submit     apiString `json:"submit"`
+	Start      apiString `json:"start"`
+	End        apiString `json:"end"`
+	ElapsedRaw apiString `json:"elapsedraw"`
+}
+
+func (c *Client) machine() string {
+	if c.Machine != "" {
+		return c.Machine
+	}
+	return DefaultMachine
+}
+
+func (c *Client) location() *time.Location {
+	if c.Location != nil {
+		return c.Location
+	}
+	return DefaultLocation
+}
+
+// jobPath is the path of a job's endpoint.
+func (c *Client) jobPath(jobID string) string {
+	if c.Dialect == DialectCompat {
+		return fmt.Sprintf("jobs/%s", url.PathEscape(jobID))
+	}
+	return fmt.Sprintf("compute/jobs/%s/%s", url.PathEscape(c.machine()), url.PathEscape(jobID))
+}
+
+// newSubmitRequest builds the request that submits req. The NERSC API takes
+// the batch script as a form field and has no fields for the project or
+// queue, so they are added to the script as directives.
+func (c *Client) newSubmitRequest(ctx context.Context, req JobSubmissionRequest) (*http.Request, error) {
+	if c.Dialect == DialectCompat {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return nil, fmt.Errorf("marshal job submission: %w", err)
+		}
+		httpReq, err := c.newRequest(ctx, http.MethodPost, "jobs", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		return httpReq, nil
+	}
+
+	machine := req.System
+	if machine == "" {
+		machine = c.machine()
+	}
+	form := url.Values{}
+	form.Set("job", withSbatchDirectives(req.Script, req.Project, req.Queue))
+	form.Set("isPath", "false")
+	httpReq, err := c.newRequest(ctx, http.MethodPost, fmt.Sprintf("compute/jobs/%s", url.PathEscape(machine)), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return httpReq, nil
+}
+
+// withSbatchDirectives adds account and QOS directives for project and queue
+// after the script's interpreter line. Directives already in the script take
+// precedence, since sbatch uses the first of each.
+func withSbatchDirectives(script, project, queue string) string {
+	var directives []string
+	if project != "" && !strings.Contains(script, "#SBATCH --account=") {
+		directives = append(directives, "#SBATCH --account="+project)
+	}
+	if queue != "" && !strings.Contains(script, "#SBATCH --qos=") {
+		directives = append(directives, "#SBATCH --qos="+queue)
+	}
+	if len(directives) == 0 {
+		return script
+	}
+	if !strings.HasPrefix(script, "#!") {
+		return strings.Join(directives, "\n") + "\n" + script
+	}
+	shebang, rest, _ := strings.Cut(script, "\n")
+	return shebang + "\n" + strings.Join(directives, "\n") + "\n" + rest
+}
+
+// GetJob returns what Slurm reports about a job. A job Slurm does not know
+// is reported as an error for which IsNotFound holds.
+func (c *Client) GetJob(ctx context.Context, jobID string) (JobInfo, error) {
+	path := c.jobPath(jobID)
+	if c.Dialect != DialectCompat {
+		path += "?sacct=true"
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return JobInfo{}, err
+	}
+
+	resp, err := c.do("GetJob", ClassStatus, req)
+	if err != nil {
+		return JobInfo{}, fmt.Errorf("get job status request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return JobInfo{}, fmt.Errorf("status failed: %w", newAPIError(resp))
+	}
+
+	if c.Dialect == DialectCompat {
+		var out struct {
+			Status string `json:"status"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return JobInfo{}, fmt.Errorf("decode status response: %w", err)
+		}
+		return JobInfo{JobID: jobID, State: out.Status}, nil
+	}
+
+	var out struct {
+		Status string        `json:"status"`
+		Output []sacctRecord `json:"output"`
+		Error  string        `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return JobInfo{}, fmt.Errorf("decode status response: %w", err)
+	}
+	if strings.EqualFold(out.Status, "error") {
+		if strings.Contains(strings.ToLower(out.Error), "invalid job id") {
+			return JobInfo{}, fmt.Errorf("status failed: %w", notFoundError(out.Error))
+		}
+		return JobInfo{}, fmt.Errorf("status failed: %s", out.Error)
+	}
+	if len(out.Output) == 0 {
+		return JobInfo{}, fmt.Errorf("status failed: %w", notFoundError(fmt.Sprintf("job %s not found", jobID)))
+	}
+
+	// sacct also reports the job's steps, such as 123.batch, after the job.
+	record := out.Output[0]
+	for _, candidate := range out.Output {
+		if string(candidate.JobID) == jobID {
+			record = candidate
+			break
+		}
+	}
+	return record.jobInfo(c.location()), nil
+}
+
+func (r sacctRecord) jobInfo(loc *time.Location) JobInfo {
+	info := JobInfo{
+		JobID:     string(r.JobID),
+		Name:      string(r.JobName),
+		Reason:    noneToEmpty(string(r.Reason)),
+		NodeList:  noneToEmpty(string(r.NodeList)),
+		Partition: string(r.Partition),
+		QOS:       string(r.QOS),
+		Account:   string(r.Account),
+		User:      string(r.User),
+		Submit:    parseSlurmTime(string(r.Submit), loc),
+		Start:     parseSlurmTime(string(r.Start), loc),
+		End:       parseSlurmTime(string(r.End), loc),
+	}
+	// sacct reports cancelled jobs as "CANCELLED by <uid>".
+	if fields := strings.Fields(string(r.State)); len(fields) > 0 {
+		info.State = fields[0]
+	}
+	code, signal, _ := strings.Cut(string(r.ExitCode), ":")
+	info.ExitCode, _ = strconv.Atoi(code)
+	info.Signal, _ = strconv.Atoi(signal)
+	if seconds, err := strconv.ParseInt(string(r.ElapsedRaw), 10, 64); err == nil {
+		info.Elapsed = time.Duration(seconds) * time.Second
+	}
+	return info
+}
+
+func noneToEmpty(value string) string {
+	switch value {
+	case "None", "None assigned", "(null)":
+		return ""
+	default:
+		return value
+	}
+}
+
+// parseSlurmTime parses a Slurm timestamp in the cluster's time zone, loc.
+// "Unknown" and "None" are the zero time.
+func parseSlurmTime(value string, loc *time.Location) time.Time {
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", value, loc)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// signalJobCommand signals a job with scancel run on a login node, as
+// SignalJob does with the NERSC API.
+func (c *Client) signalJobCommand(ctx context.Context, jobID string, signal JobSignalRequest) error {
+	if !validSignal(signal.Signal) {
+		return fmt.Errorf("invalid signal %q", signal.Signal)
+	}
+	command := "scancel --signal=" + signal.Signal
+	if signal.Batch {
+		command += " --batch"
+	}
+	if _, err := c.runCommandTask(ctx, ClassSubmit, command+" "+shellQuote(jobID)); err != nil {
+		return fmt.Errorf("signal job %s: %w", jobID, err)
+	}
+	return nil
+}
+
+// fetchJobStdout reads the file Slurm writes a job's standard output to, as
+// FetchJobLogs does with the NERSC API.
+func (c *Client) fetchJobStdout(ctx context.Context, jobID string) (string, error) {
+	result, err := c.runCommandTask(ctx, ClassLogs, "scontrol show job -o "+shellQuote(jobID))
+	if err != nil {
+		return "", fmt.Errorf("find logs of job %s: %w", jobID, err)
+	}
+	var path string
+	for _, field := range strings.Fields(result.Output) {
+		if value, ok := strings.CutPrefix(field, "StdOut="); ok {
+			path = value
+		}
+	}
+	if path == "" {
+		return "", fmt.Errorf("find logs of job %s: %w", jobID, notFoundError("scontrol reported no StdOut"))
+	}
+	chunk, err := c.readFileRange(ctx, path, 0, 0)
+	if err != nil {
+		return "", fmt.Errorf("fetch logs of job %s: %w", jobID, err)
+	}
+	return string(chunk.Data), nil
+}
+
+// readFileRange reads a byte range of a file with commands on a login node,
+// as FetchJobLogRange does with the NERSC API. The download utility returns
+// whole files, so each command reads at most maxCommandReadBytes of the
+// range and the rest is read by further commands.
+func (c *Client) readFileRange(ctx context.Context, path string, offset, length int64) (LogChunk, error) {
+	chunk, err := c.readFileCommand(ctx, path, offset, length)
+	if err != nil {
+		return LogChunk{}, err
+	}
+	end := chunk.Size
+	if offset >= 0 && length > 0 && chunk.Offset+length < end {
+		end = chunk.Offset + length
+	}
+	for next := chunk.Offset + int64(len(chunk.Data)); next < end; next = chunk.Offset + int64(len(chunk.Data)) {
+		more, err := c.readFileCommand(ctx, path, next, end-next)
+		if err != nil {
+			return LogChunk{}, err
+		}
+		if len(more.Data) == 0 {
+			// The file was truncated since the range was sized.
+			break
+		}
+		chunk.Data = append(chunk.Data, more.Data...)
+	}
+	return chunk, nil
+}
+
+// readFileCommand reads up to maxCommandReadBytes of a byte range of a file
+// with one command. The command prints where the range starts and the size
+// of the file, followed by the bytes in base64.
+func (c *Client) readFileCommand(ctx context.Context, path string, offset, length int64) (LogChunk, error) {
+	count := length
+	if offset < 0 {
+		count = -offset
+	}
+	if count <= 0 || count > maxCommandReadBytes {
+		count = maxCommandReadBytes
+	}
+	command := fmt.Sprintf(`f=%s o=%d
+[ -e "$f" ] || { echo missing; exit 0; }
+s=$(stat -L -c %%s -- "$f") || exit 1
+if [ "$o" -lt 0 ]; then o=$((s + o)); [ "$o" -ge 0 ] || o=0; elif [ "$o" -gt "$s" ]; then o=$s; fi
+echo "$o $s"
+tail -c +$((o + 1)) -- "$f" | head -c %d | base64`, shellQuote(path), offset, count)
+
+	result, err := c.runCommandTask(ctx, ClassLogs, command)
+	if err != nil {
+		return LogChunk{}, fmt.Errorf("read %s: %w", path, err)
+	}
+	header, encoded, _ := strings.Cut(result.Output, "\n")
+	header = strings.TrimSpace(header)
+	if header == "missing" {
+		return LogChunk{}, fmt.Errorf("read %s: %w", path, notFoundError("no such file"))
+	}
+	var chunk LogChunk
+	if _, err := fmt.Sscanf(header, "%d %d", &chunk.Offset, &chunk.Size); err != nil {
+		return LogChunk{}, fmt.Errorf("read %s: unexpected command output %q", path, header)
+	}
+	if chunk.Data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded)); err != nil {
+		return LogChunk{}, fmt.Errorf("read %s: decode command output: %w", path, err)
+	}
+	return chunk, nil
+}
+
+// runCommandTask runs a command on a login node of the client's machine as
+// class and waits for its result. A command that failed is returned as an
+// error, and Slurm's "Invalid job id" as a not found APIError.
+func (c *Client) runCommandTask(ctx context.Context, class EndpointClass, command string) (CommandResult, error) {
+	taskID, err := c.runCommand(ctx, class, c.machine(), command)
+	if err != nil {
+		return CommandResult{}, err
+	}
+	task, err := c.waitForTask(ctx, class, taskID)
+	if err != nil {
+		return CommandResult{}, fmt.Errorf("command task %s: %w", taskID, err)
+	}
+	result, err := task.CommandResult()
+	if err != nil {
+		if !task.failed() {
+			return CommandResult{}, err
+		}
+		// Failed tasks may report a plain error message.
+		result = CommandResult{Status: "error", Error: task.Result}
+	}
+	if task.failed() || strings.EqualFold(result.Status, "error") {
+		message := strings.TrimSpace(result.Error)
+		if message == "" {
+			message = "task " + task.Status
+		}
+		if strings.Contains(strings.ToLower(message), "invalid job id") {
+			return result, fmt.Errorf("command task %s failed: %w", taskID, notFoundError(message))
+		}
+		return result, fmt.Errorf("command task %s failed: %s", taskID, message)
+	}
+	return result, nil
+}
+
+func validSignal(signal string) bool {
+	if signal == "" {
+		return false
+	}
+	for _, r := range signal {
+		if (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// shellQuote quotes value as a single shell word.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,134 @@
+package superfacility
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const maxErrorBodyBytes = 4096
+
+// APIError is an unsuccessful response from the Superfacility API or its
+// token endpoint. Message is the error the API reported in a JSON body, if
+// any, and Body the start of the raw body.
+type APIError struct {
+	StatusCode int
+	Status     string
+	Method     string
+	Endpoint   string
+	RequestID  string
+	Message    string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	if e.Body == "" {
+		return e.Status
+	}
+	return fmt.Sprintf("%s: %s", e.Status, e.Body)
+}
+
+// newAPIError reads the error in resp.
+func newAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RequestID:  resp.Header.Get("X-Request-Id"),
+	}
+	if apiErr.Status == "" {
+		apiErr.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	if resp.Request != nil {
+		apiErr.Method = resp.Request.Method
+		apiErr.Endpoint = resp.Request.URL.Path
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	if err != nil {
+		apiErr.Body = fmt.Sprintf("(failed to read response body: %v)", err)
+		return apiErr
+	}
+	apiErr.Body = strings.TrimSpace(string(body))
+
+	var decoded struct {
+		Detail  interface{} `json:"detail"`
+		Error   interface{} `json:"error"`
+		Message interface{} `json:"message"`
+	}
+	if json.Unmarshal(body, &decoded) == nil {
+		for _, value := range []interface{}{decoded.Detail, decoded.Error, decoded.Message} {
+			if message, ok := value.(string); ok && message != "" {
+				apiErr.Message = message
+				break
+			}
+		}
+	}
+	return apiErr
+}
+
+// PendingSubmitError is returned when the API accepted a job submission but
+// its submit task could not be waited for. The job may have been submitted,
+// so TaskID should be resolved with ResolveSubmitTask before submitting
+// again.
+type PendingSubmitError struct {
+	TaskID string
+	Err    error
+}
+
+func (e *PendingSubmitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PendingSubmitError) Unwrap() error {
+	return e.Err
+}
+
+// notFoundError is a 404 APIError for a job that a successful response says
+// Slurm does not know, so that IsNotFound holds for it as for a 404.
+func notFoundError(message string) *APIError {
+	return &APIError{
+		StatusCode: http.StatusNotFound,
+		Status:     fmt.Sprintf("%d %s", http.StatusNotFound, http.StatusText(http.StatusNotFound)),
+		Message:    message,
+		Body:       message,
+	}
+}
+
+func hasStatus(err error, codes ...int) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, code := range codes {
+		if apiErr.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNotFound reports whether err is a 404 from the API, such as for a job
+// Slurm no longer knows.
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsUnauthorized reports whether err is a 401 from the API or its token
+// endpoint, meaning the credentials are missing, invalid or expired.
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+// IsRateLimited reports whether err is a 429 from the API.
+func IsRateLimited(err error) bool {
+	return hasStatus(err, http.StatusTooManyRequests)
+}
+
+// IsUnavailable reports whether err is a gateway or availability error from
+// the API, such as during NERSC maintenance.
+func IsUnavailable(err error) bool {
+	return hasStatus(err, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout)
+}
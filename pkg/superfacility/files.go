@@ -0,0 +1,270 @@
+package superfacility
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MaxFileSize bounds the files UploadFile and DownloadFile move. The
+// utilities endpoints are meant for small files such as configuration and
+// status files; larger data is moved with Globus.
+const MaxFileSize = 5 << 20
+
+// ErrFileTooLarge is returned for files larger than MaxFileSize.
+var ErrFileTooLarge = errors.New("file exceeds the utilities size limit")
+
+// FileEntry is an entry of a directory listing.
+type FileEntry struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Perms     string `json:"perms"`
+	User      string `json:"user"`
+	Group     string `json:"group"`
+	Date      string `json:"date"`
+	Hardlinks int    `json:"hardlinks"`
+}
+
+// IsDir reports whether the entry is a directory.
+func (e FileEntry) IsDir() bool {
+	return strings.HasPrefix(e.Perms, "d")
+}
+
+// utilitiesResponse is the envelope of the utilities endpoints' responses.
+type utilitiesResponse struct {
+	Status   string      `json:"status"`
+	Error    string      `json:"error"`
+	File     string      `json:"file"`
+	IsBinary bool        `json:"is_binary"`
+	Entries  []FileEntry `json:"entries"`
+}
+
+func (r utilitiesResponse) err(operation, path string) error {
+	if !strings.EqualFold(r.Status, "error") {
+		return nil
+	}
+	message := r.Error
+	if message == "" {
+		message = "unknown error"
+	}
+	if strings.Contains(strings.ToLower(message), "no such file") {
+		return fmt.Errorf("%s %s failed: %w", operation, path, notFoundError(message))
+	}
+	return fmt.Errorf("%s %s failed: %s", operation, path, message)
+}
+
+func (c *Client) utilitiesPath(utility, path string) string {
+	return fmt.Sprintf("utilities/%s/%s/%s", utility, url.PathEscape(c.machine()), url.PathEscape(path))
+}
+
+// UploadFile writes size bytes read from content to the file at path on the
+// client's machine, replacing it if it exists. The content is streamed as a
+// multipart form without being buffered.
+func (c *Client) UploadFile(ctx context.Context, path string, content io.Reader, size int64) error {
+	if path == "" {
+		return fmt.Errorf("file path is required")
+	}
+	if size < 0 || size > MaxFileSize {
+		return fmt.Errorf("upload %s of %d bytes: %w", path, size, ErrFileTooLarge)
+	}
+
+	// The form is written around the content so that its length is known
+	// and the content is read once, as the request is sent.
+	var head, tail bytes.Buffer
+	form := multipart.NewWriter(&head)
+	name := path[strings.LastIndex(path, "/")+1:]
+	if _, err := form.CreateFormFile("file", name); err != nil {
+		return fmt.Errorf("create upload form: %w", err)
+	}
+	tail.WriteString("\r\n--" + form.Boundary() + "--\r\n")
+	body := io.MultiReader(bytes.NewReader(head.Bytes()), io.LimitReader(content, size), &tail)
+
+	req, err := c.newRequest(ctx, http.MethodPut, c.utilitiesPath("upload", path), io.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(head.Len()) + size + int64(tail.Len())
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := c.do("UploadFile", ClassTransfer, req)
+	if err != nil {
+		return fmt.Errorf("upload file request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("upload %s failed: %w", path, newAPIError(resp))
+	}
+	var out utilitiesResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxErrorBodyBytes)).Decode(&out); err != nil && err != io.EOF {
+		return fmt.Errorf("decode upload response: %w", err)
+	}
+	return out.err("upload", path)
+}
+
+// DownloadFile reads a byte range of the file at path on the client's
+// machine, like FetchJobLogRange: length bytes from offset, to the end of
+// the file if length is 0, or the last -offset bytes if offset is negative.
+// The caller must close the returned body. Raw responses are streamed; the
+// JSON responses of the NERSC API hold the whole file, which is decoded
+// before the range is applied. Files larger than MaxFileSize fail with
+// ErrFileTooLarge, possibly while the body is read.
+func (c *Client) DownloadFile(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file path is required")
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, c.utilitiesPath("download", path)+"?binary=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset != 0 || length > 0 {
+		req.Header.Set("Range", byteRange(offset, length))
+	}
+
+	resp, err := c.do("DownloadFile", ClassLogs, req)
+	if err != nil {
+		return nil, fmt.Errorf("download file request: %w", err)
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The range starts past the end of the file.
+		resp.Body.Close()
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("download %s failed: %w", path, newAPIError(resp))
+	}
+	if resp.ContentLength > MaxFileSize {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download %s of %d bytes: %w", path, resp.ContentLength, ErrFileTooLarge)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		if resp.StatusCode == http.StatusPartialContent || (offset == 0 && length == 0) {
+			return &limitedBody{ReadCloser: resp.Body, path: path, remaining: MaxFileSize}, nil
+		}
+		// The server ignored the range.
+		data, err := readLimited(resp.Body, path)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		chunk, _ := applyRange(data, offset, length)
+		return io.NopCloser(bytes.NewReader(chunk)), nil
+	}
+
+	defer resp.Body.Close()
+	// Base64 grows the file by a third.
+	var out utilitiesResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxFileSize*4/3+maxErrorBodyBytes)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode download response: %w", err)
+	}
+	if err := out.err("download", path); err != nil {
+		return nil, err
+	}
+	data := []byte(out.File)
+	if out.IsBinary {
+		if data, err = base64.StdEncoding.DecodeString(out.File); err != nil {
+			return nil, fmt.Errorf("decode download of %s: %w", path, err)
+		}
+	}
+	if len(data) > MaxFileSize {
+		return nil, fmt.Errorf("download %s of %d bytes: %w", path, len(data), ErrFileTooLarge)
+	}
+	chunk, _ := applyRange(data, offset, length)
+	return io.NopCloser(bytes.NewReader(chunk)), nil
+}
+
+// ListDirectory lists the directory at path on the client's machine.
+func (c *Client) ListDirectory(ctx context.Context, path string) ([]FileEntry, error) {
+	if path == "" {
+		return nil, fmt.Errorf("directory path is required")
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, c.utilitiesPath("ls", path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do("ListDirectory", ClassLogs, req)
+	if err != nil {
+		return nil, fmt.Errorf("list directory request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list %s failed: %w", path, newAPIError(resp))
+	}
+	var out utilitiesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode list response: %w", err)
+	}
+	if err := out.err("list", path); err != nil {
+		return nil, err
+	}
+	return out.Entries, nil
+}
+
+// applyRange returns the byte range of data that DownloadFile describes, and
+// its start.
+func applyRange(data []byte, offset, length int64) ([]byte, int64) {
+	size := int64(len(data))
+	start := offset
+	if start < 0 {
+		start = size + offset
+		if start < 0 {
+			start = 0
+		}
+	} else if start > size {
+		start = size
+	}
+	end := size
+	if offset >= 0 && length > 0 && start+length < size {
+		end = start + length
+	}
+	return data[start:end], start
+}
+
+func readLimited(r io.Reader, path string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read download of %s: %w", path, err)
+	}
+	if len(data) > MaxFileSize {
+		return nil, fmt.Errorf("download %s: %w", path, ErrFileTooLarge)
+	}
+	return data, nil
+}
+
+// limitedBody fails reads once more than MaxFileSize bytes were read.
+type limitedBody struct {
+	io.ReadCloser
+	path      string
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Only fail if there is more data.
+		var probe [1]byte
+		if n, _ := b.ReadCloser.Read(probe[:]); n > 0 {
+			return 0, fmt.Errorf("download %s: %w", b.path, ErrFileTooLarge)
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,169 @@
+package superfacility
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Call describes a finished call to the API. Header holds the request
+// headers with the Authorization header redacted. StatusCode is 0 and Err
+// set if no response was received. Duration runs from the first attempt
+// until the response body was closed, and Retries counts the attempts after
+// the first. BytesSent counts the request body of every attempt and
+// BytesReceived the response body read by the caller.
+type Call struct {
+	Operation     string
+	Class         EndpointClass
+	Method        string
+	URL           string
+	Header        http.Header
+	StatusCode    int
+	Err           error
+	Duration      time.Duration
+	Retries       int
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// Hook observes calls to the API. ObserveCall is called once for each call,
+// once its response body is closed or it failed, and may be called
+// concurrently.
+type Hook interface {
+	ObserveCall(Call)
+}
+
+// HookFunc adapts a function to a Hook.
+type HookFunc func(Call)
+
+func (f HookFunc) ObserveCall(call Call) {
+	f(call)
+}
+
+// WithHooks has the client report every call to hooks.
+func WithHooks(hooks ...Hook) ClientOption {
+	return func(c *clientConfig) {
+		c.hooks = append(c.hooks, hooks...)
+	}
+}
+
+// do sends req as the named operation, as send does, and reports the call
+// to the client's hooks.
+func (c *Client) do(operation string, class EndpointClass, req *http.Request) (*http.Response, error) {
+	call := Call{
+		Operation: operation,
+		Class:     class,
+		Method:    req.Method,
+		URL:       req.URL.Redacted(),
+		Header:    redactHeader(req.Header),
+	}
+	start := time.Now()
+	attempts := 0
+	resp, err := c.send(class, req, &attempts)
+	if attempts > 1 {
+		call.Retries = attempts - 1
+	}
+	if req.ContentLength > 0 {
+		call.BytesSent = req.ContentLength * int64(attempts)
+	}
+	if err != nil {
+		call.Err = err
+		call.Duration = time.Since(start)
+		c.observe(call)
+		return nil, err
+	}
+
+	call.StatusCode = resp.StatusCode
+	resp.Body = &observeOnClose{ReadCloser: resp.Body, done: func(received int64) {
+		call.Duration = time.Since(start)
+		call.BytesReceived = received
+		c.observe(call)
+	}}
+	return resp, nil
+}
+
+func (c *Client) observe(call Call) {
+	for _, hook := range c.hooks {
+		hook.ObserveCall(call)
+	}
+}
+
+func redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	if header.Get("Authorization") != "" {
+		header.Set("Authorization", "REDACTED")
+	}
+	return header
+}
+
+// observeOnClose counts the bytes read from a response body and ends its
+// call once the body is closed.
+type observeOnClose struct {
+	io.ReadCloser
+	read int64
+	once sync.Once
+	done func(received int64)
+}
+
+func (r *observeOnClose) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *observeOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(func() { r.done(r.read) })
+	return err
+}
+
+// CallRecorder is a Hook that records calls, such as for tests that assert
+// the sequence of calls a client made.
+type CallRecorder struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+func (r *CallRecorder) ObserveCall(call Call) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+// Calls returns the calls recorded so far, in the order they finished.
+func (r *CallRecorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+// Operations returns the operation names of the calls recorded so far.
+func (r *CallRecorder) Operations() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	operations := make([]string, 0, len(r.calls))
+	for _, call := range r.calls {
+		operations = append(operations, call.Operation)
+	}
+	return operations
+}
+
+// DebugLogger returns a Hook that logs every call and its request headers
+// to logger, or the standard logger if logger is nil. The Authorization
+// header is redacted.
+func DebugLogger(logger *log.Logger) Hook {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return HookFunc(func(call Call) {
+		status := http.StatusText(call.StatusCode)
+		if call.Err != nil {
+			status = call.Err.Error()
+		}
+		logger.Printf("SF API %s: %s %s -> %d %s in %s (%d retries, %d bytes sent, %d bytes received), headers %v",
+			call.Operation, call.Method, call.URL, call.StatusCode, status, call.Duration.Round(time.Millisecond),
+			call.Retries, call.BytesSent, call.BytesReceived, call.Header)
+	})
+}
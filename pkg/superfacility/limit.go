@@ -0,0 +1,286 @@
+package superfacility
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EndpointClass groups the operations that share a rate limit.
+type EndpointClass string
+
+const (
+	// ClassSubmit covers submitting, cancelling and signalling jobs, and
+	// polling the tasks that do so.
+	ClassSubmit EndpointClass = "submit"
+	// ClassStatus covers job status and other task polling, and login
+	// node commands.
+	ClassStatus EndpointClass = "status"
+	// ClassTransfer covers Globus transfers and file uploads.
+	ClassTransfer EndpointClass = "transfer"
+	// ClassLogs covers reading job logs and files, and listing directories.
+	ClassLogs EndpointClass = "logs"
+)
+
+// priority orders requests waiting for the global limit. Job control comes
+// first, so a flood of status polling cannot hold up a pod deletion.
+func (c EndpointClass) priority() int {
+	switch c {
+	case ClassSubmit:
+		return 2
+	case ClassStatus:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// Limit caps a group of requests with a token bucket of Rate requests per
+// second and bursts of Burst, and with at most MaxInFlight requests at once.
+// A zero Rate or MaxInFlight leaves that dimension unlimited.
+type Limit struct {
+	Rate        float64
+	Burst       int
+	MaxInFlight int
+}
+
+// Limits are the request limits of a Client. Global is shared by every
+// request, and waiting requests pass it in priority order. Classes limit
+// each endpoint class on its own.
+type Limits struct {
+	Global  Limit
+	Classes map[EndpointClass]Limit
+}
+
+// DefaultLimits are the limits of clients returned by New.
+var DefaultLimits = Limits{
+	Global: Limit{Rate: 10, Burst: 20, MaxInFlight: 16},
+	Classes: map[EndpointClass]Limit{
+		ClassStatus: {MaxInFlight: 8},
+		ClassLogs:   {MaxInFlight: 4},
+	},
+}
+
+// ParseLimits parses limits such as "global=10:20:16,status=5:10:8", giving
+// the rate, burst and maximum in-flight requests of the global limit or of
+// an endpoint class. Groups that are not mentioned keep their limits in
+// base.
+func ParseLimits(spec string, base Limits) (Limits, error) {
+	limits := Limits{Global: base.Global, Classes: make(map[EndpointClass]Limit, len(base.Classes))}
+	for class, limit := range base.Classes {
+		limits.Classes[class] = limit
+	}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return Limits{}, fmt.Errorf("invalid limit %q: want name=rate:burst:inflight", item)
+		}
+		parts := strings.Split(value, ":")
+		if len(parts) != 3 {
+			return Limits{}, fmt.Errorf("invalid limit %q: want name=rate:burst:inflight", item)
+		}
+		rate, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || rate < 0 {
+			return Limits{}, fmt.Errorf("invalid rate in limit %q", item)
+		}
+		burst, err := strconv.Atoi(parts[1])
+		if err != nil || burst < 0 {
+			return Limits{}, fmt.Errorf("invalid burst in limit %q", item)
+		}
+		inFlight, err := strconv.Atoi(parts[2])
+		if err != nil || inFlight < 0 {
+			return Limits{}, fmt.Errorf("invalid in-flight maximum in limit %q", item)
+		}
+		limit := Limit{Rate: rate, Burst: burst, MaxInFlight: inFlight}
+
+		switch class := EndpointClass(strings.TrimSpace(name)); class {
+		case "global":
+			limits.Global = limit
+		case ClassSubmit, ClassStatus, ClassTransfer, ClassLogs:
+			limits.Classes[class] = limit
+		default:
+			return Limits{}, fmt.Errorf("unknown endpoint class %q", name)
+		}
+	}
+	return limits, nil
+}
+
+// SetLimits replaces the client's request limits. It must not be called
+// while requests are in flight.
+func (c *Client) SetLimits(limits Limits) {
+	c.global = newLimiter(limits.Global)
+	c.classes = make(map[EndpointClass]*limiter, len(limits.Classes))
+	for class, limit := range limits.Classes {
+		c.classes[class] = newLimiter(limit)
+	}
+}
+
+// acquire waits until a request of class may be sent, and returns the
+// function that ends it.
+func (c *Client) acquire(ctx context.Context, class EndpointClass) (func(), error) {
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, l := range []*limiter{c.classes[class], c.global} {
+		if l == nil {
+			continue
+		}
+		r, err := l.acquire(ctx, class.priority())
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	return release, nil
+}
+
+// releaseOnClose ends a request once its response body is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// limiter is a token bucket combined with a cap on in-flight requests.
+// Waiters are served highest priority first, then in arrival order.
+type limiter struct {
+	limit Limit
+
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	inFlight int
+	seq      uint64
+	waiters  []*waiter
+	changed  chan struct{}
+}
+
+type waiter struct {
+	priority int
+	seq      uint64
+}
+
+func newLimiter(limit Limit) *limiter {
+	if limit.Rate <= 0 && limit.MaxInFlight <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &limiter{
+		limit:   limit,
+		tokens:  float64(limit.Burst),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+func (l *limiter) acquire(ctx context.Context, priority int) (func(), error) {
+	l.mu.Lock()
+	l.seq++
+	w := &waiter{priority: priority, seq: l.seq}
+	l.waiters = append(l.waiters, w)
+	sort.SliceStable(l.waiters, func(i, j int) bool {
+		if l.waiters[i].priority != l.waiters[j].priority {
+			return l.waiters[i].priority > l.waiters[j].priority
+		}
+		return l.waiters[i].seq < l.waiters[j].seq
+	})
+
+	for {
+		var wait time.Duration
+		if l.waiters[0] == w && (l.limit.MaxInFlight <= 0 || l.inFlight < l.limit.MaxInFlight) {
+			if wait = l.takeToken(time.Now()); wait == 0 {
+				l.waiters = l.waiters[1:]
+				l.inFlight++
+				l.broadcast()
+				l.mu.Unlock()
+				var once sync.Once
+				return func() { once.Do(l.release) }, nil
+			}
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		l.mu.Lock()
+		if ctx.Err() != nil {
+			l.remove(w)
+			l.broadcast()
+			l.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// takeToken takes a token from the bucket, or returns how long until one is
+// available.
+func (l *limiter) takeToken(now time.Time) time.Duration {
+	if l.limit.Rate <= 0 {
+		return 0
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.limit.Rate
+	if burst := float64(l.limit.Burst); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.limit.Rate * float64(time.Second))
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	l.inFlight--
+	l.broadcast()
+	l.mu.Unlock()
+}
+
+func (l *limiter) remove(w *waiter) {
+	for i, other := range l.waiters {
+		if other == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// broadcast wakes every waiter to recheck whether it may proceed.
+func (l *limiter) broadcast() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
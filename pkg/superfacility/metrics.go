@@ -0,0 +1,60 @@
+package superfacility
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics is a Hook that records calls to the API in Prometheus metrics,
+// labelled by operation and, for requests, by status code. Calls that got
+// no response have the code "error".
+type Metrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	retries  *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+}
+
+// NewMetrics returns a Metrics registered with reg.
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sf_api_requests_total",
+			Help: "Superfacility API calls by operation and status code.",
+		}, []string{"operation", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sf_api_request_duration_seconds",
+			Help:    "Duration of Superfacility API calls, including retries and reading the response.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+		}, []string{"operation"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sf_api_request_retries_total",
+			Help: "Retried attempts of Superfacility API calls.",
+		}, []string{"operation"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sf_api_bytes_total",
+			Help: "Bytes of request and response bodies of Superfacility API calls.",
+		}, []string{"operation", "direction"}),
+	}
+	for _, collector := range []prometheus.Collector{m.requests, m.duration, m.retries, m.bytes} {
+		if err := reg.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Metrics) ObserveCall(call Call) {
+	code := "error"
+	if call.StatusCode != 0 {
+		code = strconv.Itoa(call.StatusCode)
+	}
+	m.requests.WithLabelValues(call.Operation, code).Inc()
+	m.duration.WithLabelValues(call.Operation).Observe(call.Duration.Seconds())
+	if call.Retries > 0 {
+		m.retries.WithLabelValues(call.Operation).Add(float64(call.Retries))
+	}
+	m.bytes.WithLabelValues(call.Operation, "sent").Add(float64(call.BytesSent))
+	m.bytes.WithLabelValues(call.Operation, "received").Add(float64(call.BytesReceived))
+}
@@ -0,0 +1,188 @@
+package superfacility
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how a Client retries requests that failed with a
+// connection error, a 429 or a 5xx response. MaxAttempts counts the first
+// attempt, so a MaxAttempts of 1 or less disables retries.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of clients returned by New.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// send sends req within the limits of its endpoint class, retrying as the
+// client's retry policy allows, and counts the attempts it made in
+// attempts. Each attempt counts against the limits until its response body
+// is closed. Requests that are not idempotent, such as a SubmitJob POST,
+// are only retried when the server cannot have acted on them: when the
+// connection could not be made, or when the server answered 429 or 503.
+// Retrying them after any other failure could submit a job twice.
+func (c *Client) send(class EndpointClass, req *http.Request, attempts *int) (*http.Response, error) {
+	idempotent := isIdempotent(req.Method)
+	policy := c.Retry
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		release, err := c.acquire(req.Context(), class)
+		if err != nil {
+			return nil, fmt.Errorf("wait for %s request limit: %w", class, err)
+		}
+		attemptReq, cancel := c.withAttemptTimeout(req, class)
+		*attempts = attempt
+		resp, err := c.http.Do(attemptReq)
+		timedOut := err != nil && attemptReq.Context().Err() != nil && req.Context().Err() == nil
+		if err != nil {
+			cancel()
+			release()
+		} else {
+			if resp.Request == nil {
+				resp.Request = attemptReq
+			}
+			resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() {
+				cancel()
+				release()
+			}}
+		}
+		// An attempt that timed out may have reached the server, so only
+		// idempotent requests are retried.
+		if attempt >= policy.MaxAttempts || !(retryable(resp, err, idempotent) || timedOut && idempotent) {
+			return resp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			// The body was consumed and cannot be sent again.
+			return resp, err
+		}
+
+		delay := policy.backoff(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				if retryAfter > policy.MaxDelay {
+					// Waiting that long would stall the caller, so report the
+					// failure instead.
+					return resp, nil
+				}
+				delay = retryAfter
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBodyBytes))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			if err == nil {
+				err = fmt.Errorf("retry %s %s: %w", req.Method, req.URL.Redacted(), req.Context().Err())
+			}
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// withAttemptTimeout returns req bounded by the timeout of its endpoint
+// class, and the function that releases the timeout's resources once the
+// response body is read.
+func (c *Client) withAttemptTimeout(req *http.Request, class EndpointClass) (*http.Request, context.CancelFunc) {
+	timeout := c.timeoutFor(class)
+	if timeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryable reports whether a request that got resp or err may be sent
+// again.
+func retryable(resp *http.Response, err error, idempotent bool) bool {
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		return idempotent
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+		return true
+	case resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented:
+		return idempotent
+	default:
+		return false
+	}
+}
+
+// backoff returns the delay before the attempt after the given one:
+// exponential in the attempt, capped at MaxDelay, with jitter so that many
+// callers retrying at once spread out.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// parseRetryAfter parses a Retry-After header, given in seconds or as an
+// HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := at.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
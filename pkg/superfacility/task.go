@@ -0,0 +1,133 @@
+package superfacility
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTaskPollInterval = 500 * time.Millisecond
+	maxTaskPollInterval     = 5 * time.Second
+)
+
+// JobTaskResult is the result of a task that submitted or cancelled a job.
+type JobTaskResult struct {
+	Status string    `json:"status"`
+	JobID  apiString `json:"jobid"`
+	Error  string    `json:"error"`
+}
+
+// apiString accepts a value the API gives as a JSON string or number, such
+// as a job ID.
+type apiString string
+
+func (v *apiString) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = apiString(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("value must be a string or number: %s", data)
+	}
+	*v = apiString(n.String())
+	return nil
+}
+
+// JobResult decodes the result of a finished job task.
+func (t Task) JobResult() (JobTaskResult, error) {
+	var out JobTaskResult
+	if strings.TrimSpace(t.Result) == "" {
+		return out, fmt.Errorf("task %s has no result", t.ID)
+	}
+	if err := json.Unmarshal([]byte(t.Result), &out); err != nil {
+		// Failed tasks may report a plain error message.
+		if t.failed() {
+			return JobTaskResult{Status: "error", Error: t.Result}, nil
+		}
+		return out, fmt.Errorf("decode result of task %s: %w", t.ID, err)
+	}
+	return out, nil
+}
+
+func (t Task) failed() bool {
+	switch strings.ToLower(t.Status) {
+	case "failed", "error":
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitForTask polls a task until it is done. Polling starts at half a
+// second and backs off to every five seconds, since a task that is not done
+// soon is usually waiting for Slurm.
+func (c *Client) WaitForTask(ctx context.Context, taskID string) (Task, error) {
+	return c.waitForTask(ctx, ClassStatus, taskID)
+}
+
+// waitForTask is WaitForTask polling as class, so that the polls of a job
+// control task keep its priority.
+func (c *Client) waitForTask(ctx context.Context, class EndpointClass, taskID string) (Task, error) {
+	interval := c.taskPollInterval
+	if interval <= 0 {
+		interval = defaultTaskPollInterval
+	}
+	for {
+		task, err := c.getTask(ctx, class, taskID)
+		if err != nil {
+			return Task{}, err
+		}
+		if task.Done() {
+			return task, nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Task{}, fmt.Errorf("wait for task %s: %w", taskID, ctx.Err())
+		case <-timer.C:
+		}
+		if interval *= 2; interval > maxTaskPollInterval {
+			interval = maxTaskPollInterval
+		}
+	}
+}
+
+// resolveJobTask waits for a task that submitted or cancelled a job and
+// returns its result. A failed task is returned as an error. Slurm's
+// "Invalid job id" is returned as a not found APIError, the way the API
+// reports jobs it does not know. The task is polled as ClassSubmit, so that
+// status polling cannot hold up the job control waiting on it.
+func (c *Client) resolveJobTask(ctx context.Context, operation, taskID string) (JobTaskResult, error) {
+	task, err := c.waitForTask(ctx, ClassSubmit, taskID)
+	if err != nil {
+		return JobTaskResult{}, fmt.Errorf("%s task %s: %w", operation, taskID, err)
+	}
+	return jobTaskResult(operation, taskID, task)
+}
+
+// jobTaskResult returns the result of a finished job task, or an error if
+// the task failed.
+func jobTaskResult(operation, taskID string, task Task) (JobTaskResult, error) {
+	result, err := task.JobResult()
+	if err != nil {
+		return JobTaskResult{}, fmt.Errorf("%s task %s: %w", operation, taskID, err)
+	}
+	if task.failed() || strings.EqualFold(result.Status, "error") {
+		message := result.Error
+		if message == "" {
+			message = "task " + task.Status
+		}
+		if strings.Contains(strings.ToLower(message), "invalid job id") {
+			return result, fmt.Errorf("%s task %s failed: %w", operation, taskID, notFoundError(message))
+		}
+		return result, fmt.Errorf("%s task %s failed: %s", operation, taskID, message)
+	}
+	return result, nil
+}
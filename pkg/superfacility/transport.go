@@ -0,0 +1,188 @@
+package superfacility
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultUserAgent is the User-Agent of requests from clients returned by New.
+const DefaultUserAgent = "vk-provider-nersc"
+
+// DefaultTimeout bounds each attempt of a request, from sending it to
+// reading its response body. Log reads get DefaultLogsTimeout, since job
+// logs can be large.
+const (
+	DefaultTimeout     = 30 * time.Second
+	DefaultLogsTimeout = 5 * time.Minute
+)
+
+// ClientOption configures a Client returned by New or the HTTP client
+// returned by NewHTTPClient.
+type ClientOption func(*clientConfig)
+
+type clientConfig struct {
+	transport http.RoundTripper
+	rootCAs   *x509.CertPool
+	certs     []tls.Certificate
+	proxy     *url.URL
+	timeout   time.Duration
+	timeouts  map[EndpointClass]time.Duration
+	userAgent string
+	hooks     []Hook
+}
+
+func newClientConfig(opts []ClientOption) clientConfig {
+	config := clientConfig{
+		timeout:   DefaultTimeout,
+		timeouts:  map[EndpointClass]time.Duration{ClassLogs: DefaultLogsTimeout},
+		userAgent: DefaultUserAgent,
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
+
+// WithTransport sends requests through rt, such as an instrumented or test
+// transport. It replaces the default transport, so WithRootCAs,
+// WithClientCertificate and WithProxy have no effect.
+func WithTransport(rt http.RoundTripper) ClientOption {
+	return func(c *clientConfig) {
+		c.transport = rt
+	}
+}
+
+// WithRootCAs verifies the API's certificate against pool instead of the
+// system roots, such as for an egress proxy with a private CA.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(c *clientConfig) {
+		c.rootCAs = pool
+	}
+}
+
+// WithClientCertificate presents cert to servers that request a client
+// certificate.
+func WithClientCertificate(cert tls.Certificate) ClientOption {
+	return func(c *clientConfig) {
+		c.certs = append(c.certs, cert)
+	}
+}
+
+// WithProxy sends requests through the proxy at proxyURL instead of the one
+// named by the HTTPS_PROXY and NO_PROXY environment variables.
+func WithProxy(proxyURL *url.URL) ClientOption {
+	return func(c *clientConfig) {
+		c.proxy = proxyURL
+	}
+}
+
+// WithTimeout bounds each attempt of requests of any endpoint class without
+// a timeout of its own. Zero means no timeout.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.timeout = timeout
+	}
+}
+
+// WithClassTimeout bounds each attempt of requests of an endpoint class.
+// Zero means no timeout.
+func WithClassTimeout(class EndpointClass, timeout time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.timeouts[class] = timeout
+	}
+}
+
+// WithUserAgent sets the User-Agent of requests.
+func WithUserAgent(userAgent string) ClientOption {
+	return func(c *clientConfig) {
+		c.userAgent = userAgent
+	}
+}
+
+// NewHTTPClient returns an HTTP client with the transport options in opts,
+// such as for the token requests of a ClientCredentials. Its requests are
+// bounded by the default timeout of opts.
+func NewHTTPClient(opts ...ClientOption) *http.Client {
+	config := newClientConfig(opts)
+	return &http.Client{Transport: config.roundTripper(), Timeout: config.timeout}
+}
+
+func (c clientConfig) roundTripper() http.RoundTripper {
+	if c.transport != nil {
+		return c.transport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.rootCAs != nil || len(c.certs) > 0 {
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			RootCAs:      c.rootCAs,
+			Certificates: c.certs,
+		}
+	}
+	if c.proxy != nil {
+		transport.Proxy = http.ProxyURL(c.proxy)
+	}
+	return transport
+}
+
+// timeoutFor returns the timeout of each attempt of a request of class.
+func (c *Client) timeoutFor(class EndpointClass) time.Duration {
+	if timeout, ok := c.timeouts[class]; ok {
+		return timeout
+	}
+	return c.timeout
+}
+
+// LoadCABundle returns the system roots with the PEM certificates in the
+// file at path added.
+func LoadCABundle(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("CA bundle %s has no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// ParseTimeouts parses request timeouts given as comma separated
+// class=duration pairs, where the class "default" applies to classes without
+// a timeout of their own. For example "default=1m,logs=10m". A duration of 0
+// disables the timeout.
+func ParseTimeouts(spec string) ([]ClientOption, error) {
+	var opts []ClientOption
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("timeout %q must be class=duration", entry)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("timeout %q has an invalid duration", entry)
+		}
+		switch class := EndpointClass(strings.TrimSpace(name)); class {
+		case "default":
+			opts = append(opts, WithTimeout(timeout))
+		case ClassSubmit, ClassStatus, ClassTransfer, ClassLogs:
+			opts = append(opts, WithClassTimeout(class, timeout))
+		default:
+			return nil, fmt.Errorf("unknown endpoint class %q", name)
+		}
+	}
+	return opts, nil
+}